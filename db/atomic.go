@@ -0,0 +1,274 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/ahui2016/mima-go/util"
+)
+
+// 为了防止程序崩溃, 磁盘已满或断电时留下写了一半的数据库文件 (或碎片),
+// 全部写入都先写到同一文件夹中的临时文件, fsync 之后再改名覆盖目标文件 (改名是原子操作),
+// 最后 fsync 文件夹以确保改名本身也已落盘. 因此目标文件要么是旧的完整内容, 要么是新的完整内容.
+//
+// 数据库碎片 (日志) 采用追加的方式写入, 不适用上述方法, 详见 journal.go.
+//
+// Rebuild, Compact 和 RotateKey 把碎片整合到新的数据库文件后会删除这些碎片 (和日志文件). 如果在新文件落盘之后,
+// 删除碎片之前中断, 剩下的碎片会被当作重复的碎片 (详见 chainProblems).
+// 因此在改名之前先写一个清理清单 (cleanupExt), 记录新文件的 SHA256 和需要删除的碎片,
+// 下次启动时由 RecoverPendingWrites 根据数据库文件的 SHA256 判断新文件是否已生效, 再决定是否删除.
+//
+// 以上均由 FileStorage 负责 (详见 storage.go), DB 不直接读写文件.
+
+const (
+	// 临时文件的后缀名. 临时文件名为 "目标文件名.随机数.tmp", 不会与碎片或备份文件混淆.
+	tempExt = ".tmp"
+
+	// 清理清单的后缀名, 清单文件与数据库文件放在一起.
+	cleanupExt = ".cleanup"
+)
+
+// errPendingCleanup 表示新的数据库文件已生效, 但未能删除已整合的碎片 (清理清单仍保留).
+var errPendingCleanup = errors.New("新的数据库文件已生效, 但未能删除已整合的碎片, 下次启动时会再次尝试")
+
+// cleanupList 记录已整合到新数据库文件中, 等待删除的碎片.
+type cleanupList struct {
+	// Sum 是新数据库文件的 SHA256, 只有数据库文件的 SHA256 与之相同时才删除碎片.
+	Sum []byte
+
+	// Files 是碎片的文件名 (不含文件夹).
+	Files []string
+}
+
+// atomicFile 是一个临时文件, 调用 commit 后才会改名为目标文件.
+type atomicFile struct {
+	*os.File
+	target string
+}
+
+// createAtomic 在 target 所在的文件夹中新建一个临时文件.
+func createAtomic(target string) (*atomicFile, error) {
+	file, err := ioutil.TempFile(filepath.Dir(target), filepath.Base(target)+".*"+tempExt)
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: file, target: target}, nil
+}
+
+// commit 把临时文件 fsync 后改名为目标文件, 并 fsync 文件夹. 出错时删除临时文件.
+func (f *atomicFile) commit() error {
+	if err := f.Sync(); err != nil {
+		f.abort()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.target); err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(f.target))
+}
+
+// abort 放弃写入, 删除临时文件.
+func (f *atomicFile) abort() {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
+
+// writeFileAtomic 以原子方式把 data 写入 fullPath.
+func writeFileAtomic(fullPath string, data []byte) error {
+	file, err := createAtomic(fullPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.abort()
+		return err
+	}
+	return file.commit()
+}
+
+// syncDir fsync 文件夹, 确保其中的新建, 改名, 删除等操作已落盘.
+// Windows 不支持 (也不需要) fsync 文件夹, 因此直接忽略.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return util.WrapErrors(d.Sync(), d.Close())
+}
+
+func (s *FileStorage) cleanupPath() string {
+	return s.FullPath + cleanupExt
+}
+
+// WriteVault 以原子方式用 data 覆盖重写数据库文件.
+// integrated 是已整合到新数据库文件中的碎片, 新文件落盘后才删除它们 (详见本文件开头的说明).
+// 如果新文件已生效但删除碎片时出错, 返回的错误包含 errPendingCleanup.
+func (s *FileStorage) WriteVault(data []byte, integrated []string) error {
+	file, err := createAtomic(s.FullPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.abort()
+		return err
+	}
+	if len(integrated) > 0 {
+		sum := sha256.Sum256(data)
+		list := cleanupList{Sum: sum[:], Files: integrated}
+		listJSON, err := json.Marshal(list)
+		if err == nil {
+			err = writeFileAtomic(s.cleanupPath(), listJSON)
+		}
+		if err != nil {
+			file.abort()
+			return err
+		}
+	}
+	if err := file.commit(); err != nil {
+		return err
+	}
+	if len(integrated) == 0 {
+		return nil
+	}
+	for _, name := range integrated {
+		if err = os.Remove(s.path(name)); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = syncDir(s.BackupDir)
+	}
+	if err == nil {
+		err = os.Remove(s.cleanupPath())
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPendingCleanup, err)
+	}
+	return nil
+}
+
+// isTempFile 判断 name (不含文件夹) 是否 createAtomic 为数据库文件, 清理清单或备份文件创建的临时文件,
+// 即 "目标文件名.随机数.tmp" (随机数由 ioutil.TempFile 生成, 只含数字).
+func (s *FileStorage) isTempFile(name string) bool {
+	if !strings.HasSuffix(name, tempExt) {
+		return false
+	}
+	name = strings.TrimSuffix(name, tempExt)
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 {
+		return false
+	}
+	target, random := name[:dot], name[dot+1:]
+	if random == "" || strings.Trim(random, "0123456789") != "" {
+		return false
+	}
+	return target == filepath.Base(s.FullPath) || target == filepath.Base(s.cleanupPath()) ||
+		strings.HasSuffix(target, TarballExt)
+}
+
+// RecoverPendingWrites 删除残留的临时文件, 并根据清理清单删除已整合到数据库文件中的碎片
+// (如果新的数据库文件已生效). 不需要密码.
+func (s *FileStorage) RecoverPendingWrites() (notes []string, err error) {
+	dirs := []string{filepath.Dir(s.FullPath)}
+	if s.BackupDir != dirs[0] {
+		dirs = append(dirs, s.BackupDir)
+	}
+	for _, dir := range dirs {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+tempExt))
+		if err != nil {
+			return nil, err
+		}
+		// 只删除 createAtomic 创建的临时文件, 不删除用户放在同一文件夹中的其他 .tmp 文件.
+		var tempFiles []string
+		for _, f := range matches {
+			if s.isTempFile(filepath.Base(f)) {
+				tempFiles = append(tempFiles, f)
+			}
+		}
+		if err := DeleteFiles(tempFiles); err != nil {
+			return nil, err
+		}
+		for _, f := range tempFiles {
+			notes = append(notes, fmt.Sprintf("已删除未完成写入的临时文件 %s", f))
+		}
+	}
+
+	data, err := ioutil.ReadFile(s.cleanupPath())
+	if os.IsNotExist(err) {
+		return notes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list cleanupList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("无法读取清理清单 %s: %v", s.cleanupPath(), err)
+	}
+	vault, err := s.ReadVault()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sum := sha256.Sum256(vault)
+	if vault != nil && len(list.Sum) > 0 && bytes.Equal(sum[:], list.Sum) {
+		for _, name := range list.Files {
+			// 清单只能删除备份文件夹中的碎片和日志, 不能删除其他文件.
+			if name != filepath.Base(name) || !(strings.HasSuffix(name, FragExt) || name == JournalName) {
+				continue
+			}
+			err := os.Remove(s.path(name))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			if err == nil {
+				notes = append(notes, fmt.Sprintf("已删除整合到数据库文件中的碎片 %s", name))
+			}
+		}
+		if err := syncDir(s.BackupDir); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Remove(s.cleanupPath()); err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// RecoverPendingWrites 处理上次未完成的写入: 由 Storage 删除残留的临时文件以及已整合的碎片等
+// (详见 FileStorage.RecoverPendingWrites), 然后截掉日志文件末尾不完整的条目 (详见 journal.go).
+// 不需要密码, 在程序启动时以及每次 Rebuild 之前执行. 返回已执行的操作的说明.
+// 日志文件损坏时返回 ErrTampered 以及此前已执行的操作的说明, 此时只能用 Fsck 或 Salvage 处理.
+func (db *DB) RecoverPendingWrites() (notes []string, err error) {
+	if notes, err = db.storage.RecoverPendingWrites(); err != nil {
+		return nil, err
+	}
+	return db.recoverJournal(notes)
+}
+
+// recoverJournal 截掉日志文件末尾不完整的条目 (如有), 并添加到 notes 中.
+// 日志文件损坏时返回 ErrTampered (详见 repairJournal), 同时仍返回 notes.
+func (db *DB) recoverJournal(notes []string) ([]string, error) {
+	repaired, err := db.repairJournal()
+	if err != nil {
+		return notes, err
+	}
+	if repaired {
+		notes = append(notes, "已截掉日志文件末尾不完整的条目 (写入时中断, 该条目未生效)")
+	}
+	return notes, nil
+}
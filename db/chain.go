@@ -0,0 +1,262 @@
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 校验链 (hash chain):
+//
+// 数据库文件头记录了已整合的最后一个碎片的序号 (Seq) 和校验码 (Chain),
+// 数据库文件末尾附有覆盖文件头和全部记录的校验码, 因此可发现截断或篡改.
+// 每个数据库碎片都带有序号, 前一个状态的校验码 (Prev) 以及本碎片的校验码 (MAC),
+// 其中 MAC 由 Prev, 序号和碎片内容计算得出, 因此碎片之间首尾相连,
+// 可发现碎片缺失, 重复, 顺序错乱或重放旧碎片.
+//
+// 注意: 如果最新的一个或几个碎片被删除, 剩下的碎片仍然首尾相连, 这种情况无法发现.
+//
+// 全部校验码均采用 HMAC-SHA256, 其 key 由内部密码 (DB.key) 派生.
+
+// ErrTampered 表示发现数据库被篡改或有碎片缺失.
+var ErrTampered = errors.New("数据库已被篡改或有碎片缺失")
+
+// fragMagic 用来区分带有校验链的数据库碎片与旧版碎片.
+var fragMagic = []byte("MIMA-FR\x00")
+
+// FragMeta 是数据库碎片的序号, 生成时间和校验码.
+// Time 用于重建某个时间点的数据库 (详见 pointintime.go), 旧的碎片没有 Time (为零).
+type FragMeta struct {
+	Seq  uint64
+	Time int64 `json:",omitempty"`
+	Prev []byte
+	MAC  []byte
+}
+
+// fragment 表示一个已读取并解密的数据库碎片.
+type fragment struct {
+	name string
+	meta *FragMeta // 旧版碎片没有序号和校验码, 此时为 nil.
+	mima *Mima
+}
+
+// macKey 由内部密码派生出用于计算校验码的 key, 以免与加密共用同一个 key.
+func macKey(key *SecretKey) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("mima-go chain"))
+	return mac.Sum(nil)
+}
+
+// vaultMAC 计算数据库文件的校验码, 覆盖版本号, 文件头以及全部记录.
+func vaultMAC(key *SecretKey, version uint16, headerJSON []byte, boxes [][]byte) []byte {
+	mac := hmac.New(sha256.New, macKey(key))
+	mac.Write([]byte("db"))
+	_ = binary.Write(mac, binary.BigEndian, version)
+	_ = writeRecord(mac, headerJSON)
+	for _, box := range boxes {
+		_ = writeRecord(mac, box)
+	}
+	return mac.Sum(nil)
+}
+
+// fragMAC 计算数据库碎片的校验码, 覆盖序号, 生成时间 (如有), 前一个状态的校验码以及碎片内容.
+// 没有生成时间的旧碎片的计算方式保持不变.
+func fragMAC(key *SecretKey, meta *FragMeta, sealed []byte) []byte {
+	mac := hmac.New(sha256.New, macKey(key))
+	mac.Write([]byte("frag"))
+	_ = binary.Write(mac, binary.BigEndian, meta.Seq)
+	if meta.Time != 0 {
+		mac.Write([]byte("time"))
+		_ = binary.Write(mac, binary.BigEndian, meta.Time)
+	}
+	_ = writeRecord(mac, meta.Prev)
+	_ = writeRecord(mac, sealed)
+	return mac.Sum(nil)
+}
+
+// verifyMAC 检查数据库文件的校验码. 旧版数据库文件没有校验码, 不检查.
+func (header *Header) verifyMAC(key *SecretKey, boxes [][]byte) error {
+	if header.Version < chainVersion {
+		return nil
+	}
+	want := vaultMAC(key, uint16(header.Version), header.rawJSON, boxes)
+	if !hmac.Equal(want, header.MAC) {
+		return fmt.Errorf("%w: 数据库文件的校验码不符 (文件可能被截断或篡改)", ErrTampered)
+	}
+	return nil
+}
+
+// decodeFrag 解析旧版碎片文件的内容 (base64), 即 fragMagic 加上一个日志条目的内容 (详见 encodeRecords).
+// 更早的碎片只有已加密的数据, 此时 meta 为 nil.
+func decodeFrag(content []byte) (meta *FragMeta, sealed []byte, err error) {
+	data, err := base64.StdEncoding.DecodeString(string(content))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasPrefix(data, fragMagic) {
+		return nil, data, nil
+	}
+	r := bytes.NewReader(data[len(fragMagic):])
+	metaJSON, err := readRecord(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta = new(FragMeta)
+	if err := json.Unmarshal(metaJSON, meta); err != nil {
+		return nil, nil, err
+	}
+	if sealed, err = readRecord(r); err != nil {
+		return nil, nil, err
+	}
+	return meta, sealed, nil
+}
+
+// nextFragMeta 生成下一个数据库碎片的序号, 生成时间和校验码.
+func (db *DB) nextFragMeta(sealed []byte) *FragMeta {
+	meta := &FragMeta{
+		Seq:  db.seq + 1,
+		Time: time.Now().UnixNano(),
+		Prev: db.chain,
+	}
+	meta.MAC = fragMAC(db.key, meta, sealed)
+	return meta
+}
+
+// readFragFile 读取并解密一个旧版数据库碎片文件, 如有校验码则检查校验码.
+func (db *DB) readFragFile(name string) (*fragment, error) {
+	content, err := db.storage.ReadFragment(name)
+	if err != nil {
+		return nil, err
+	}
+	meta, sealed, err := decodeFrag(content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: 碎片 %s 格式错误: %v", ErrTampered, name, err)
+	}
+	if meta != nil && !hmac.Equal(meta.MAC, fragMAC(db.key, meta, sealed)) {
+		return nil, fmt.Errorf("%w: 碎片 %s 的校验码不符", ErrTampered, name)
+	}
+	mima, err := openBox(db.header, sealed, db.key, fragSlot(name))
+	if err != nil {
+		return nil, err
+	}
+	return &fragment{name: name, meta: meta, mima: mima}, nil
+}
+
+// readFragments 读取一个旧版碎片文件, 或日志文件中的全部条目.
+func (db *DB) readFragments(name string) ([]*fragment, error) {
+	if name == JournalName {
+		return db.readJournal()
+	}
+	frag, err := db.readFragFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return []*fragment{frag}, nil
+}
+
+// readFragFiles 读取全部数据库碎片 (包括日志中的条目), 检查校验链, 并按应用的先后顺序排列.
+// 各个碎片文件并行读取 (详见 parallel), 日志中的条目也是并行解密的.
+func (db *DB) readFragFiles(names []string) ([]*fragment, error) {
+	results := make([][]*fragment, len(names))
+	err := parallel(len(names), func(i int) (err error) {
+		results[i], err = db.readFragments(names[i])
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	var frags []*fragment
+	for _, fs := range results {
+		frags = append(frags, fs...)
+	}
+	if problems := db.chainProblems(frags); len(problems) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrTampered, strings.Join(problems, "; "))
+	}
+	return frags, nil
+}
+
+// chainProblems 检查数据库碎片是否与数据库文件首尾相连, 返回发现的全部问题.
+// 检查之后 frags 按应用的先后顺序排列 (旧版碎片按文件名排序, 新版碎片按序号排序).
+func (db *DB) chainProblems(frags []*fragment) (problems []string) {
+	if db.header.Version < chainVersion {
+		// 旧版数据库只可能有旧版碎片 (由旧版程序生成).
+		sort.Slice(frags, func(i, j int) bool { return frags[i].name < frags[j].name })
+		for _, frag := range frags {
+			if frag.meta != nil {
+				problems = append(problems, fmt.Sprintf("碎片 %s 不属于旧版数据库", frag.name))
+			}
+		}
+		return
+	}
+	for _, frag := range frags {
+		if frag.meta == nil {
+			problems = append(problems, fmt.Sprintf("碎片 %s 缺少序号和校验码", frag.name))
+		}
+	}
+	if len(problems) > 0 {
+		return
+	}
+	sort.Slice(frags, func(i, j int) bool { return frags[i].meta.Seq < frags[j].meta.Seq })
+	seq, chain := db.header.Seq, db.header.Chain
+	for _, frag := range frags {
+		meta := frag.meta
+		switch {
+		case meta.Seq <= seq:
+			problems = append(problems, fmt.Sprintf(
+				"碎片 %s (序号 %d) 是已整合过的旧碎片或重复的碎片 (当前序号 %d)", frag.name, meta.Seq, seq))
+			continue
+		case meta.Seq > seq+1:
+			problems = append(problems, fmt.Sprintf(
+				"缺少序号 %d 至 %d 的碎片", seq+1, meta.Seq-1))
+		case !hmac.Equal(meta.Prev, chain):
+			problems = append(problems, fmt.Sprintf(
+				"碎片 %s (序号 %d) 与前一个状态不相连", frag.name, meta.Seq))
+		}
+		seq, chain = meta.Seq, meta.MAC
+	}
+	return
+}
+
+// Inspect 检查数据库文件和全部数据库碎片, 返回发现的全部问题.
+// 不修改任何文件, 也不影响内存数据库. 主要用于登入时报告数据库被篡改后, 查看具体情况.
+func (db *DB) Inspect(password string, keyfile []byte) (problems []string, err error) {
+	tmp := NewDBWithStorage(db.storage)
+	if err := tmp.readFullPath(password, keyfile); err != nil {
+		if !errors.Is(err, ErrTampered) {
+			return nil, err
+		}
+		problems = append(problems, err.Error())
+	}
+	fragFiles, err := tmp.storage.Fragments()
+	if err != nil {
+		return nil, err
+	}
+	var frags []*fragment
+	for _, f := range fragFiles {
+		fs, err := tmp.readFragments(f)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		frags = append(frags, fs...)
+	}
+	_, size, fileSize, err := tmp.journalEntries()
+	if err == nil && size < fileSize {
+		problems = append(problems, tornTail(fileSize-size))
+	}
+	problems = append(problems, tmp.chainProblems(frags)...)
+	return problems, nil
+}
+
+// tornTail 说明日志文件末尾有 n 字节不完整的条目.
+func tornTail(n int64) string {
+	return fmt.Sprintf("日志文件末尾有 %d 字节不完整的条目 (写入时中断, 该条目未生效, 下次启动时会自动截掉)", n)
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 数据库文件格式:
+//
+//	magic (8 bytes) | version (uint16) | header 长度 (uint32) | header (json)
+//	记录长度 (uint32) | 记录 | 记录长度 | 记录 | ... | 校验码长度 (uint32) | 校验码
+//
+// 其中整数均采用 big endian. 旧版数据库文件 (version 0) 没有 magic,
+// 每行一条 base64 格式的记录, 第一行可能是 KDF 参数.
+// 记录的加密方式由文件头中的 Cipher 决定, 详见 seal.go
+// 校验码 (version 4 开始才有) 详见 chain.go
+//
+// 版本历史:
+//
+//	0: 每行一条 base64 记录
+//	1: 采用 magic, 文件头和带长度前缀的记录
+//	2: 格式与 1 相同, 但保证全部记录均采用新的随机 nonce 加密 (1 及以前的记录可能重复使用 nonce)
+//	3: 文件头增加 VaultID, 记录改用 XChaCha20-Poly1305 加密并带有附加认证数据
+//	4: 文件头增加 Seq 和 Chain, 文件末尾增加校验码, 数据库碎片带有序号和校验码
+//	5: 文件头增加 Slots (详见 keyslot.go), 第一条记录改由内部密码加密
+const (
+	// FormatVersion 是当前的数据库文件格式版本.
+	// 低于该版本的数据库文件会在登入时 (DB.Rebuild) 重新加密并重写.
+	FormatVersion = 5
+
+	// chainVersion 是开始采用校验链的版本.
+	chainVersion = 4
+
+	// slotsVersion 是开始采用 key slot 的版本.
+	slotsVersion = 5
+
+	// CipherSecretbox 是 nacl/secretbox 的加密算法.
+	CipherSecretbox = "xsalsa20poly1305"
+
+	// maxRecordSize 是单条记录的最大长度, 用于防止读取损坏的文件时分配过多内存.
+	maxRecordSize = 64 << 20
+)
+
+var magic = []byte("MIMA-DB\x00")
+
+var errBadFormat = errors.New("数据库文件格式错误")
+
+// Header 数据库文件头, 用于描述数据库文件的格式以及解密所需的参数.
+type Header struct {
+	// Version 单独保存在 magic 之后, 不保存在 json 中.
+	Version int `json:"-"`
+
+	// VaultID 是数据库的唯一 ID, 每条记录都与它绑定 (详见 RecordAD).
+	// 修改密码, 云备份和恢复都不会改变 VaultID.
+	VaultID string
+
+	// KDF 只用于旧版数据库 (version 4 及以前), 是由用户密码生成 userKey 的参数.
+	// 为 nil 时表示 userKey 由 sha256 直接生成.
+	KDF *KDFParams `json:",omitempty"`
+
+	Cipher string
+
+	// Slots 保存由用户密码, 恢复密钥等加密的内部密码.
+	Slots []*KeySlot
+
+	// Seq 和 Chain 是已整合到数据库文件中的最后一个数据库碎片的序号和校验码.
+	Seq   uint64
+	Chain []byte
+
+	// MAC 是数据库文件末尾的校验码, 单独保存, 不保存在 json 中.
+	// rawJSON 是从文件中读取的原始文件头, 用于计算校验码.
+	MAC     []byte `json:"-"`
+	rawJSON []byte
+}
+
+// newHeader 生成一个当前版本的文件头, 并生成新的 VaultID. 需要另外添加 key slot.
+func newHeader() *Header {
+	return &Header{
+		Version: FormatVersion,
+		VaultID: NewID(),
+		Cipher:  CipherXChaCha,
+	}
+}
+
+// isLegacy 判断数据库文件是否需要升级.
+func (header *Header) isLegacy() bool {
+	return header.Version < FormatVersion || header.Cipher != CipherXChaCha ||
+		header.VaultID == "" || header.slot(SlotPassword) == nil
+}
+
+// hasSlots 判断第一条记录是否由内部密码加密 (version 5 开始), 否则由 userKey 加密.
+func (header *Header) hasSlots() bool {
+	return header.Version >= slotsVersion
+}
+
+// readVault 读取数据库内容, 自动识别新旧格式.
+func readVault(r io.Reader) (*Header, [][]byte, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(magic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	if !bytes.Equal(head, magic) {
+		return readLegacyVault(br)
+	}
+	if _, err := br.Discard(len(magic)); err != nil {
+		return nil, nil, err
+	}
+
+	var version uint16
+	if err := binary.Read(br, binary.BigEndian, &version); err != nil {
+		return nil, nil, err
+	}
+	if version > FormatVersion {
+		return nil, nil, fmt.Errorf("数据库文件版本 (%d) 高于本程序支持的版本 (%d)", version, FormatVersion)
+	}
+	headerJSON, err := readRecord(br)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: 无法读取文件头: %v", errBadFormat, err)
+	}
+	header := new(Header)
+	if err := json.Unmarshal(headerJSON, header); err != nil {
+		return nil, nil, err
+	}
+	header.Version = int(version)
+	header.rawJSON = headerJSON
+
+	var boxes [][]byte
+	for {
+		box, err := readRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: 第 %d 条记录: %v", errBadFormat, len(boxes), err)
+		}
+		boxes = append(boxes, box)
+	}
+	if header.Version >= chainVersion {
+		// 最后一条记录是校验码.
+		if len(boxes) == 0 {
+			return nil, nil, fmt.Errorf("%w: 缺少校验码", errBadFormat)
+		}
+		header.MAC = boxes[len(boxes)-1]
+		boxes = boxes[:len(boxes)-1]
+	}
+	return header, boxes, nil
+}
+
+// readLegacyVault 逐行读取旧版数据库, 如果第一行是 KDF 参数则解析出来.
+// 不受 bufio.Scanner 默认的 64 KB 行长度限制.
+func readLegacyVault(r io.Reader) (*Header, [][]byte, error) {
+	header := new(Header)
+	var boxes [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxRecordSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(boxes) == 0 && header.KDF == nil && isKDFLine(line) {
+			params, err := parseKDFParams(line)
+			if err != nil {
+				return nil, nil, err
+			}
+			header.KDF = params
+			continue
+		}
+		box, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: 第 %d 行: %v", errBadFormat, len(boxes), err)
+		}
+		boxes = append(boxes, box)
+	}
+	return header, boxes, scanner.Err()
+}
+
+// writeVault 以当前格式写入文件头, 全部记录以及校验码, 并把校验码记录在 header.MAC 中.
+// 版本号一般就是 header.Version, 但旧版 (低于 chainVersion) 的文件头会被标记为 chainVersion,
+// 因为它们与 chainVersion 的区别只在于校验码. 其余差别 (加密方式, key slot 等) 由 Rebuild 负责升级.
+func writeVault(w io.Writer, header *Header, boxes [][]byte, key *SecretKey) error {
+	version := uint16(header.Version)
+	if version < chainVersion {
+		version = chainVersion
+	}
+	bw := bufio.NewWriter(w)
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if _, err := bw.Write(magic); err != nil {
+		return err
+	}
+	if err := binary.Write(bw, binary.BigEndian, version); err != nil {
+		return err
+	}
+	if err := writeRecord(bw, headerJSON); err != nil {
+		return err
+	}
+	for _, box := range boxes {
+		if err := writeRecord(bw, box); err != nil {
+			return err
+		}
+	}
+	mac := vaultMAC(key, version, headerJSON, boxes)
+	if err := writeRecord(bw, mac); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	header.MAC, header.rawJSON = mac, headerJSON
+	return nil
+}
+
+// readRecord 读取一条带长度前缀的记录. 刚好在记录开头遇到文件末尾时返回 io.EOF.
+func readRecord(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("记录长度不完整")
+		}
+		return nil, err
+	}
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("记录长度 (%d) 超出上限", size)
+	}
+	record := make([]byte, size)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, fmt.Errorf("记录内容不完整: %v", err)
+	}
+	return record, nil
+}
+
+func writeRecord(w io.Writer, record []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(record))); err != nil {
+		return err
+	}
+	_, err := w.Write(record)
+	return err
+}
@@ -2,17 +2,11 @@
 package db
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/sha256"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"github.com/ahui2016/mima-go/tarball"
-	"github.com/ahui2016/mima-go/util"
 	"io"
-	"os"
-	"path/filepath"
+	"log"
 	"sort"
 	"strings"
 	"sync"
@@ -33,165 +27,286 @@ const (
 )
 
 // DB 相当于一个数据库.
-// 其中 mimaTable 相当于一个数据表, Mima 相当于这个数据表的 schema.
+// 其中 mimaTable 相当于一个数据表 (详见 table.go), Mima 相当于这个数据表的 schema.
 type DB struct {
 	// 每次使用 DB 时注意需要上锁.
 	sync.RWMutex
 
 	// 原始数据, 按 UpdatedAt 排序, 最新(最近)的在后面.
-	mimaTable []*Mima
+	mimaTable *table
 
-	// 由用户密码生成 userKey, 用来加密解密 key, 再用 key 去实际加密数据.
-	userKey *SecretKey
-	key     *SecretKey
+	// key 是内部密码, 用来实际加密数据. 它由用户密码等加密后保存在文件头的 key slot 中.
+	// header 是数据库文件头 (详见 container.go 和 keyslot.go).
+	key    *SecretKey
+	header *Header
+
+	// slotID 是当前登入所用的 key slot 的 ID (旧版数据库升级前为空字符串).
+	slotID string
+
+	// 校验链的当前状态, 即最新一个数据库碎片的序号和校验码 (详见 chain.go).
+	// 数据库文件头中的 Seq 和 Chain 则是已整合到数据库文件中的状态.
+	seq   uint64
+	chain []byte
 
 	// 本数据库具有定时关闭功能, 这是数据库启动时刻和有效时长.
 	StartedAt time.Time
 	ValidTerm time.Duration
 
-	// 数据库文件的绝对路径, 备份文件夹的绝对路径.
+	// 数据库碎片达到 CompactAfter 个时自动整合到数据库文件中 (详见 Compact), 为零表示不自动整合.
+	CompactAfter int
+
+	// 本地备份文件的保留策略 (详见 retention.go).
+	// snapshotSeq 是上次定时备份 (或登入时备份) 时的序号, 用来判断之后有没有修改.
+	Retention   Retention
+	snapshotSeq uint64
+
+	// 本次登入期间的操作日志, 用于撤销和重做 (详见 undo.go).
+	undoLog []*opRecord
+	redoLog []*opRecord
+
+	// 数据库文件的绝对路径, 备份文件夹的绝对路径 (只有由 NewDB 生成时才有).
 	// 另外, 数据库碎片文件的后缀名和数据库备份文件的后缀名在 db/init.go 中定义.
 	// 为了方便测试, 权限设为 public.
 	FullPath  string
 	BackupDir string
+
+	// storage 保存数据库文件, 数据库碎片和备份文件 (详见 storage.go).
+	storage Storage
 }
 
-// NewDB 生成一个新的 DB. 此时, 内存数据库里没有数据, 也没有 key.
+// NewDB 生成一个采用 FileStorage 的 DB. 此时, 内存数据库里没有数据, 也没有 key.
 // 要么通过 DB.Init 生成新的数据库, 要么通过 DB.Rebuild 从文件中恢复数据库.
 func NewDB(fullPath, backupDir string) *DB {
+	db := NewDBWithStorage(NewFileStorage(fullPath, backupDir))
+	db.FullPath = fullPath
+	db.BackupDir = backupDir
+	return db
+}
+
+// NewDBWithStorage 生成一个采用指定 Storage 的 DB (比如 MemStorage), 其余与 NewDB 相同.
+func NewDBWithStorage(storage Storage) *DB {
 	return &DB{
-		FullPath:  fullPath,
-		BackupDir: backupDir,
-		StartedAt: time.Now(),
-		ValidTerm: time.Minute * 30,
+		storage:      storage,
+		StartedAt:    time.Now(),
+		ValidTerm:    time.Minute * 30,
+		CompactAfter: 100,
+		Retention:    DefaultRetention,
 	}
 }
 
 func (db *DB) Reset() {
-	db.userKey = nil
 	db.key = nil
+	db.header = nil
+	db.slotID = ""
+	db.seq = 0
+	db.chain = nil
+	db.snapshotSeq = 0
 	db.mimaTable = nil
+	db.clearOpLog()
 }
 
 func (db *DB) IsNotInit() bool {
-	return db.userKey == nil || db.key == nil || db.Len() < 1
+	return db.header == nil || db.key == nil || db.Len() < 1
 }
 
-// Init 生成第一条记录, 用于保存密码.
+// Init 生成第一条记录 (用于保存程序的设定), 以及内部密码和两个 key slot:
+// 一个由用户密码 (和 keyfile) 加密, 另一个由恢复密钥加密, 返回恢复密钥 (只有这一次机会看到).
 // 第一条记录的 ID 特殊处理, 手动设置为空字符串.
-// 同时会生成数据库文件 DB.FullPath
-func (db *DB) Init(userKey *SecretKey) error {
+// 同时会生成数据库文件.
+// keyfile 不为 nil 时, 以后解锁除了密码还需要同一个 keyfile.
+func (db *DB) Init(password string, keyfile []byte) (recoveryKey string, err error) {
 	if !db.FileNotExist() {
-		return errors.New("数据库文件已存在, 不可重复创建")
+		return "", errors.New("数据库文件已存在, 不可重复创建")
 	}
 	key := newRandomKey()
+	header := newHeader()
+	passwordSlot, err := newKeySlot(
+		SlotPassword, defaultPasswordLabel, password, keyfile, &key, header.VaultID)
+	if err != nil {
+		return "", err
+	}
+	recoveryKey, recoverySlot, err := newRecoverySlot(&key, header.VaultID)
+	if err != nil {
+		return "", err
+	}
+	header.Slots = []*KeySlot{passwordSlot, recoverySlot}
+	db.header = header
 	db.key = &key
-	db.userKey = userKey
+	db.slotID = passwordSlot.ID()
+
 	mima, err := NewMima("")
 	if err != nil {
-		return err
+		return "", err
 	}
 	mima.ID = ""
-	mima.Password = base64.StdEncoding.EncodeToString(key[:])
 	mima.Username = randomString()
-	db.mimaTable = []*Mima{mima}
-	box64, err := mima.Seal(db.userKey) // 第一条记录特殊处理, 用 userKey 加密.
+	db.mimaTable = newTable(mima)
+	box, err := mima.Seal(db.key, db.header.VaultID, dbSlot(0))
 	if err != nil {
-		return err
+		return "", err
 	}
-	return writeFile(db.FullPath, box64)
+	if err := db.saveVault(db.header, [][]byte{box}, db.key, nil); err != nil {
+		return "", err
+	}
+	return recoveryKey, nil
 }
 
 // Rebuild 填充内存数据库，读取数据库碎片, 整合到数据库文件中.
 // 每次启动程序, 初始化时, 如果已有账号, 自动执行一次 Rebuild.
-// 为了方便测试返回 tarball 文件路径.
-func (db *DB) Rebuild(userKey *SecretKey) (tarballFile string, err error) {
-	db.userKey = userKey
+// 如果是旧版数据库 (旧的文件格式, 或 userKey 直接由 sha256 生成),
+// 会自动升级为当前格式并采用 argon2id 和 key slot, 重写数据库文件 (重写前先备份).
+// 为了方便测试返回 tarball 的文件名.
+func (db *DB) Rebuild(password string, keyfile []byte) (tarballFile string, err error) {
 	if !db.isEmpty() {
 		return tarballFile, errors.New("初始化失败: 内存中的数据库已有数据")
 	}
 	if db.FileNotExist() {
 		return "", FileNotFound
 	}
-	if err = db.readFullPath(); err != nil {
+	if _, err = db.RecoverPendingWrites(); err != nil {
+		return
+	}
+	if err = db.readFullPath(password, keyfile); err != nil {
 		return
 	}
-	fragFiles, err := db.getFragPaths()
+	fragFiles, err := db.storage.Fragments()
 	if err != nil {
 		return
 	}
-	if len(fragFiles) == 0 {
+	needUpgrade := db.header.isLegacy()
+	if len(fragFiles) == 0 && !needUpgrade {
 		// 如果没有数据库碎片文件, Rebuild 就相当于只执行 scanDBtoMemory.
+		// 此时数据库文件没有未备份的修改, 不需要定时备份 (详见 Snapshot).
+		db.snapshotSeq = db.seq
+		err = db.markSlotUsed()
 		return
 	}
-	if tarballFile, err = db.backupToTar(db.filesToBackup(fragFiles)); err != nil {
+	if tarballFile, err = db.backup(fragFiles); err != nil {
 		return
 	}
+	// 数据库碎片采用与数据库文件相同的加密方式和校验方式, 因此必须在升级之前读取.
 	if err = db.readFragFilesAndUpdate(fragFiles); err != nil {
 		return
 	}
-	if err = db.rewriteDBFile(); err != nil {
+	if needUpgrade {
+		if err = db.upgrade(password, keyfile); err != nil {
+			return
+		}
+	}
+	if err = db.rewriteDBFile(fragFiles); err != nil {
 		return
 	}
-	err = DeleteFiles(fragFiles)
+	db.snapshotSeq = db.seq
+	err = db.markSlotUsed()
 	return
 }
 
-func (db *DB) UserKey() SecretKey {
-	return *db.userKey
+// upgrade 把旧版数据库的文件头更新为当前版本 (保留原有的 VaultID),
+// 如果原来没有 key slot, 就用 password (和 keyfile) 生成采用 argon2id 的密码 key slot.
+// 第一条记录不再保存内部密码. 校验链的序号保持不变 (序号必须一直递增, 详见 History).
+// 只更新内存, 由 Rebuild 负责重写数据库文件.
+func (db *DB) upgrade(password string, keyfile []byte) error {
+	header := newHeader()
+	if db.header.VaultID != "" {
+		header.VaultID = db.header.VaultID
+	}
+	if db.header.hasSlots() {
+		header.Slots = db.header.Slots
+	} else {
+		slot, err := newKeySlot(
+			SlotPassword, defaultPasswordLabel, password, keyfile, db.key, header.VaultID)
+		if err != nil {
+			return err
+		}
+		header.Slots = []*KeySlot{slot}
+		db.slotID = slot.ID()
+	}
+	db.mimaTable.first.Password = ""
+	db.header = header
+	return nil
+}
+
+// CheckPassword 检查 password 和 keyfile 能否解锁当前数据库, 并把所用的 key slot 记为当前 key slot.
+// 可根据返回的错误区分 ErrWrongPassword (或 ErrWrongPasswordOrKeyfile) 与缺少或多余的 keyfile (详见 DeriveKey).
+func (db *DB) CheckPassword(password string, keyfile []byte) error {
+	slot, err := db.findSlot(password, keyfile)
+	if err != nil {
+		return err
+	}
+	db.slotID = slot.ID()
+	return nil
 }
 
 // rewriteDBFile 覆盖重写数据库文件, 将其更新为当前内存数据库的内容.
-func (db *DB) rewriteDBFile() error {
-	dbFile, err := os.Create(db.FullPath)
+// integrated 是已整合到内存数据库中的碎片, 新的数据库文件落盘后删除 (详见 Storage.WriteVault).
+func (db *DB) rewriteDBFile(integrated []string) error {
+	boxes, err := db.sealAll()
 	if err != nil {
 		return err
 	}
-	//noinspection GoUnhandledErrorResult
-	defer dbFile.Close()
+	header := db.currentHeader()
+	if err := db.saveVault(header, boxes, db.key, integrated); err != nil {
+		if errors.Is(err, errPendingCleanup) {
+			db.header = header
+		}
+		return err
+	}
+	db.header = header
+	return nil
+}
 
-	dbWriter := bufio.NewWriter(dbFile)
-	for i, mima := range db.mimaTable {
-		box64, err := mima.Seal(db.Key(i))
+// currentHeader 返回与内存数据库对应的文件头 (包含校验链的当前状态).
+func (db *DB) currentHeader() *Header {
+	header := *db.header
+	header.Seq = db.seq
+	header.Chain = db.chain
+	return &header
+}
+
+// sealAll 把内存数据库中的全部 mima 加密.
+func (db *DB) sealAll() (boxes [][]byte, err error) {
+	for i, mima := range db.mimaTable.all() {
+		box, err := sealBox(db.header, mima, db.key, dbSlot(i))
 		if err != nil {
-			return err
-		}
-		if err := bufWriteln(dbWriter, box64); err != nil {
-			return err
+			return nil, err
 		}
+		boxes = append(boxes, box)
 	}
-	return dbWriter.Flush()
+	return
 }
 
-// ReadMimaTable 读取内存数据库中的 mimaTable, 把每个 mima 加密并转换为 base64 字符串,
-// 通过 buf 输出. 主要用于云备份.
+// ReadMimaTable 读取内存数据库中的 mimaTable, 把每个 mima 加密,
+// 通过 buf 输出 (格式与数据库文件相同). 主要用于云备份.
 func (db *DB) ReadMimaTable() (buf bytes.Buffer, err error) {
-	var box64 string
-	for i, mima := range db.mimaTable {
-		if box64, err = mima.Seal(db.Key(i)); err != nil {
-			return
-		}
-		if _, err = buf.WriteString(box64 + "\n"); err != nil {
-			return
-		}
+	boxes, err := db.sealAll()
+	if err != nil {
+		return
 	}
+	err = writeVault(&buf, db.currentHeader(), boxes, db.key)
 	return
 }
 
 // EqualByUpdatedAt 用于对比从云端下载回来的数据是否与内存数据库一致.
 func (db *DB) EqualByUpdatedAt(data io.ReadCloser) error {
-	scanner := bufio.NewScanner(data)
-	var i int
-	for scanner.Scan() {
-		box64 := scanner.Text()
-		mima, err := Decrypt(box64, db.Key(i))
+	header, boxes, err := readVault(data)
+	if err != nil {
+		return err
+	}
+	if len(boxes) != db.Len() {
+		return errCloudDataNotEqual
+	}
+	if err := header.verifyMAC(db.key, boxes); err != nil {
+		return err
+	}
+	mimas := db.mimaTable.all()
+	for i, box := range boxes {
+		mima, err := openBox(header, box, db.key, dbSlot(i))
 		if err != nil {
 			return err
 		}
-		if !mima.EqualByUpdatedAt(db.GetByIndex(i)) {
+		if !mima.EqualByUpdatedAt(mimas[i]) {
 			return errCloudDataNotEqual
 		}
-		i++
 	}
 	return nil
 }
@@ -199,124 +314,110 @@ func (db *DB) EqualByUpdatedAt(data io.ReadCloser) error {
 // WriteDBFileFromReader 主要用于把从云端下载回来的数据写到本地文件里.
 // 此时, 必须更新 settings 以确保下次上传到云端时不会覆盖原文件.
 // 在本函数内不关闭 data, 应在外层关闭.
-func (db *DB) WriteDBFileFromReader(data io.ReadCloser, password string, settings string) error {
-	var dbFile *os.File
-	var dbWriter *bufio.Writer
-	scanner := bufio.NewScanner(data)
-	key := sha256.Sum256([]byte(password))
-
-	i := 0
-	for scanner.Scan() {
-		box64 := scanner.Text()
-		if i == 0 {
-			if mima, err := Decrypt(box64, &key); err != nil {
-				return errors.New("Password Wrong: 密码错误 ")
-			} else {
-				mima.Notes = settings
-				if box64, err = mima.Seal(&key); err != nil {
-					return err
-				}
-				i++
-				dbFile, err = os.Create(db.FullPath)
-				if err != nil {
-					return err
-				}
-				//noinspection GoUnhandledErrorResult
-				defer dbFile.Close()
-				dbWriter = bufio.NewWriter(dbFile)
-			}
-		}
-		if err := bufWriteln(dbWriter, box64); err != nil {
-			return err
-		}
+func (db *DB) WriteDBFileFromReader(data io.ReadCloser, password string, keyfile []byte, settings string) error {
+	header, boxes, err := readVault(data)
+	if err != nil {
+		return err
 	}
-	return dbWriter.Flush()
-}
-
-// Key 根据 i 选择不同的 key. 因为第 0 个 mima 是特殊的, 采用不同的 key.
-func (db *DB) Key(i int) *SecretKey {
-	if i == 0 {
-		return db.userKey
+	if len(boxes) == 0 {
+		return errors.New("云端数据为空")
+	}
+	dataKey, firstKey, mima, _, err := unlockVault(header, boxes, password, keyfile)
+	if err != nil {
+		return err
+	}
+	if err := header.verifyMAC(dataKey, boxes); err != nil {
+		return err
 	}
-	return db.key
+	mima.Notes = settings
+	if boxes[0], err = sealBox(header, mima, firstKey, dbSlot(0)); err != nil {
+		return err
+	}
+	return db.saveVault(header, boxes, dataKey, nil)
 }
 
-// readFragFilesAndUpdate 读取数据库碎片文件, 并根据其内容更新内存数据库.
+// readFragFilesAndUpdate 读取数据库碎片文件, 检查校验链, 并根据其内容更新内存数据库.
 // 分为 新增, 更新, 软删除, 彻底删除 四种情形.
-func (db *DB) readFragFilesAndUpdate(filePaths []string) error {
-	if !sort.StringsAreSorted(filePaths) {
-		return errors.New("filePaths 必须从小到大排序")
+func (db *DB) readFragFilesAndUpdate(names []string) error {
+	frags, err := db.readFragFiles(names)
+	if err != nil {
+		return err
 	}
-	for _, f := range filePaths {
-		frag, err := readAndDecrypt(f, db.key)
-		if err != nil {
+	for _, f := range frags {
+		if err := db.applyFrag(f); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		if frag.Operation == Insert {
-			db.mimaTable = append(db.mimaTable, frag)
-			continue
-		}
+// applyFrag 根据一个数据库碎片更新内存数据库, 并更新校验链的当前状态.
+func (db *DB) applyFrag(f *fragment) error {
+	if f.meta != nil {
+		db.seq, db.chain = f.meta.Seq, f.meta.MAC
+	}
+	frag := f.mima
 
-		i, mima, err := db.GetByID(frag.ID)
-		if err != nil {
-			return err
-		}
+	if frag.Operation == Insert {
+		return db.mimaTable.add(frag)
+	}
 
-		switch frag.Operation {
-		case Insert: // 上面已操作, 这里不需要再操作.
-		case Update:
-			if mima.UpdateFromFrag(frag) {
-				db.mimaTable = append(db.mimaTable, mima)
-				db.mimaTable = append(db.mimaTable[:i], db.mimaTable[i+1:]...)
-			}
-		case SoftDelete:
-			mima.Delete()
-		case UnDelete:
-			mima.Alias = frag.Alias // 从垃圾桶里恢复时, Alias 有可能被删除.
-			mima.UnDelete()
-		case DeleteForever:
-			if _, err := db.deleteByID(mima.ID); err != nil {
-				return err
-			}
-		default: // 一共 5 种 Operation 已在上面全部处理, 没有其他可能.
+	mima, err := db.GetByID(frag.ID)
+	if err != nil {
+		return err
+	}
+	oldAlias := mima.Alias
+
+	switch frag.Operation {
+	case Insert: // 上面已操作, 这里不需要再操作.
+	case Update:
+		if mima.UpdateFromFrag(frag) {
+			db.mimaTable.moveToBack(mima)
 		}
+	case SoftDelete:
+		mima.Delete()
+	case UnDelete:
+		mima.Alias = frag.Alias // 从垃圾桶里恢复时, Alias 有可能被删除.
+		mima.UnDelete()
+	case DeleteForever:
+		db.mimaTable.remove(mima)
+		return nil
+	default: // 一共 5 种 Operation 已在上面全部处理, 没有其他可能.
 	}
+	db.mimaTable.updateAlias(mima, oldAlias)
 	return nil
 }
 
 // deleteByID 删除内存数据库中的指定记录, 不生成数据库碎片.
 // 用于 ReBuild 时根据数据库碎片删除记录.
 func (db *DB) deleteByID(id string) (*Mima, error) {
-	i, mima, err := db.GetByID(id)
+	mima, err := db.GetByID(id)
 	if err != nil {
 		return nil, err
 	}
-	db.mimaTable = append(db.mimaTable[:i], db.mimaTable[i+1:]...)
+	db.mimaTable.remove(mima)
 	return mima, nil
 }
 
-// GetByIndex 为了测试方便.
+// GetByIndex 为了测试方便. 需要逐条数过去, 不可用于其他用途.
 func (db *DB) GetByIndex(i int) *Mima {
-	return db.mimaTable[i]
+	return db.mimaTable.all()[i]
 }
 
 // GetByID 凭 id 找 mima. 忽略 index:0. 只有一种错误: 找不到记录.
 // 为什么找不到时要返回错误不返回 nil? 因为后续需要返回错误, 在这里集中处理更方便.
-func (db *DB) GetByID(id string) (index int, mima *Mima, err error) {
-	for index = 1; index < db.Len(); index++ {
-		mima = db.mimaTable[index]
-		if mima.ID == id {
-			return
+func (db *DB) GetByID(id string) (*Mima, error) {
+	if db.mimaTable != nil {
+		if mima := db.mimaTable.get(id); mima != nil {
+			return mima, nil
 		}
 	}
-	err = fmt.Errorf("NotFound: 找不到 id: %s 的记录", id)
-	return
+	return nil, fmt.Errorf("NotFound: 找不到 id: %s 的记录", id)
 }
 
 // GetFormByID 凭 id 找 mima 并转换为有 History 的 MimaForm.
 func (db *DB) GetFormByID(id string) *MimaForm {
-	_, mima, err := db.GetByID(id)
+	mima, err := db.GetByID(id)
 	if err != nil {
 		return &MimaForm{Err: err}
 	}
@@ -325,15 +426,11 @@ func (db *DB) GetFormByID(id string) *MimaForm {
 
 // GetByAlias 凭 alias 找 mima, 如果找不到就返回 nil.
 func (db *DB) GetByAlias(alias string) (mimas []*Mima) {
-	if alias == "" {
+	if alias == "" || db.mimaTable == nil {
 		return
 	}
-	for i := 1; i < db.Len(); i++ {
-		mima := db.mimaTable[i]
-		if mima.IsDeleted() {
-			continue
-		}
-		if mima.Alias == alias {
+	for _, mima := range db.mimaTable.getByAlias(alias) {
+		if !mima.IsDeleted() {
 			mimas = append(mimas, mima)
 		}
 	}
@@ -349,240 +446,318 @@ func (db *DB) GetFormsByAlias(alias string) (forms []*MimaForm) {
 	return
 }
 
-// backupToTar 把数据库文件以及碎片文件备份到一个 tarball 里.
-// 主要在 Rebuild 或 ChangePassword 之前使用, 以防万一出错.
-// 为了方便测试返回 tarball 的完整路径.
-func (db *DB) backupToTar(files []string) (filePath string, err error) {
-	filePath = filepath.Join(db.BackupDir, newTimestampFilename(TarballExt))
-	err = tarball.Create(filePath, files)
-	return
-}
-
-// filesToBackup 返回 Rebuild 前需要备份的文件的完整路径.
-func (db *DB) filesToBackup(fragFiles []string) []string {
-	return append(fragFiles, db.FullPath)
-}
-
-// getFragPaths 返回数据库碎片文件的完整路径, 并且已排序.
-// 必须确保从小到大排序.
-func (db *DB) getFragPaths() ([]string, error) {
-	return db.getPathsByExt(FragExt)
-}
-
-// getTarballPaths 返回备份文件的完整路径, 从小到大排序.
-func (db *DB) GetTarballPaths() ([]string, error) {
-	return db.getPathsByExt(TarballExt)
-}
-
-func (db *DB) getPathsByExt(ext string) ([]string, error) {
-	pattern := filepath.Join(db.BackupDir, "*"+ext)
-	filePaths, err := filepath.Glob(pattern)
-	if err != nil {
-		return nil, err
-	}
-	sort.Strings(filePaths)
-	return filePaths, nil
-}
-
 func (db *DB) isEmpty() bool {
 	return db.Len() == 0
 }
 
 func (db *DB) Len() int {
-	return len(db.mimaTable)
+	if db.mimaTable == nil {
+		return 0
+	}
+	return db.mimaTable.len()
 }
 
 func (db *DB) FileNotExist() bool {
-	_, err := os.Stat(db.FullPath)
-	if os.IsNotExist(err) {
-		return true
-	}
+	exists, err := db.storage.VaultExists()
 	if err != nil {
 		panic(err)
 	}
-	return false
+	return !exists
 }
 
-// readFullPath 读取 db.FullPath, 填充 db.
-// blankMima 是一个空的 Mima 实体, 它携带着 Mima.Decrypt 的具体实现.
-func (db *DB) readFullPath() error {
-	scanner, file, err := util.NewFileScanner(db.FullPath)
+// readFullPath 读取数据库文件, 用 password 和 keyfile 解锁 (详见 unlockVault), 填充 db.
+// 即使发现校验码不符, 也会读取全部记录, 最后才返回 ErrTampered.
+func (db *DB) readFullPath(password string, keyfile []byte) error {
+	header, boxes, err := db.loadVault()
 	if err != nil {
 		return err
 	}
-	//noinspection GoUnhandledErrorResult
-	defer file.Close()
+	key, _, first, slotID, err := unlockVault(header, boxes, password, keyfile)
+	if err != nil {
+		return err
+	}
+	db.header = header
+	db.key = key
+	db.slotID = slotID
+	db.seq, db.chain = header.Seq, header.Chain
+	if err := db.fillTable(boxes, first); err != nil {
+		return fmt.Errorf("用户密码正确, 但内部密码错误: %w", err)
+	}
+	return header.verifyMAC(db.key, boxes)
+}
 
-	for scanner.Scan() {
-		var mima *Mima
-		box64 := scanner.Text()
-		if db.key == nil {
-			if mima, err = Decrypt(box64, db.userKey); err != nil {
-				return fmt.Errorf("用户密码错误: %w", err)
-			}
-			keyBytes, err := base64.StdEncoding.DecodeString(mima.Password)
-			if err != nil {
-				return err
-			}
-			key := bytesToKey(keyBytes)
-			db.key = &key
-		} else {
-			if mima, err = Decrypt(box64, db.key); err != nil {
-				return fmt.Errorf("用户密码正确, 但内部密码错误: %w", err)
-			}
+// fillTable 用 db.key 解密 boxes (第一条除外, 已解密为 first), 填充 db.
+// 解密是最耗时的部分, 因此并行解密 (详见 parallel), 然后按原来的顺序填充.
+func (db *DB) fillTable(boxes [][]byte, first *Mima) error {
+	mimas := make([]*Mima, len(boxes))
+	err := parallel(len(boxes)-1, func(i int) (err error) {
+		mimas[i+1], err = openBox(db.header, boxes[i+1], db.key, dbSlot(i+1))
+		return
+	})
+	if err != nil {
+		return err
+	}
+	db.mimaTable = newTable(first)
+	for i := 1; i < len(mimas); i++ {
+		if err := db.mimaTable.add(mimas[i]); err != nil {
+			return fmt.Errorf("%w: %v", ErrTampered, err)
 		}
-		db.mimaTable = append(db.mimaTable, mima)
 	}
-	return scanner.Err()
+	return nil
 }
 
-// ChangeUserKey 根据新密码更改 db.userKey, 重写 db.FullPath.
-func (db *DB) ChangeUserKey(newPassword string) error {
-	newKey := sha256.Sum256([]byte(newPassword))
-	allBoxes, err := db.getAllBoxes()
+// ChangeUserKey 用新密码 (以及新的 keyfile, 如有) 重新生成当前 key slot, 重写数据库文件.
+// 只修改文件头, 不需要重新加密任何记录. 每次修改密码都会生成新的盐, 并采用当前默认的成本参数.
+// newKeyfile 为 nil 时表示以后只采用密码解锁 (即取消原有的 keyfile).
+func (db *DB) ChangeUserKey(newPassword string, newKeyfile []byte) error {
+	current := db.header.slotByID(db.slotID)
+	if current == nil {
+		return errSlotNotFound
+	}
+	slot, err := newKeySlot(
+		SlotPassword, current.Label, newPassword, newKeyfile, db.key, db.header.VaultID)
 	if err != nil {
 		return err
 	}
-	if _, err = db.backupToTar([]string{db.FullPath}); err != nil {
+	err = db.updateSlots(func(header *Header) error {
+		return header.replaceSlot(db.slotID, slot)
+	})
+	if err != nil {
 		return err
 	}
+	db.slotID = slot.ID()
+	return nil
+}
 
-	// 解密
-	firstMima, err := Decrypt(allBoxes[0], db.userKey)
-	if err != nil {
-		return fmt.Errorf("用户密码错误: %w", err)
+// updateSlots 备份数据库文件, 然后修改文件头中的 key slot (详见 rewriteHeader).
+func (db *DB) updateSlots(update func(header *Header) error) error {
+	if _, err := db.backup(nil); err != nil {
+		return err
 	}
-	firstMima.UpdatedAt = time.Now().UnixNano()
-	// 用新密码重新加密
-	box64, err := firstMima.Seal(&newKey)
+	return db.rewriteHeader(update)
+}
+
+// rewriteHeader 修改数据库文件头并重写数据库文件. 不修改任何记录,
+// 文件头中的 Seq 和 Chain 也保持不变, 以便之后能继续整合碎片.
+func (db *DB) rewriteHeader(update func(header *Header) error) error {
+	fileHeader, boxes, err := db.readAndVerify()
 	if err != nil {
 		return err
 	}
-	// 持久化
-	allBoxes[0] = box64
-	if err = db.writeBoxes(allBoxes); err != nil {
+	header := *fileHeader
+	if err := update(&header); err != nil {
 		return err
 	}
+	if err = db.saveVault(&header, boxes, db.key, nil); err != nil {
+		return err
+	}
+	db.header = &header
+	return nil
+}
+
+// RotateKey 生成新的内部密码 (DB.key), 用它重新加密全部记录并重写数据库文件.
+// 以后即使有人得到了旧的内部密码, 也无法解密新的数据库文件 (包括以后的云备份).
+// 由于全部 key slot 都要重新生成, 需要提供当前的 password 和 keyfile, 而其他成员的
+// 密码 key slot 无法重新生成, 只能删除 (之后可以重新添加).
+// 如果原来有恢复密钥, 旧的恢复密钥随之失效, 并返回新的恢复密钥.
+// 重写前先备份数据库文件和全部数据库碎片. 数据库碎片已在内存中生效, 重写后即可删除
+// (它们采用旧的内部密码加密, 此后不可再用), 校验链也从头开始, 但序号继续递增 (详见 History).
+func (db *DB) RotateKey(password string, keyfile []byte) (recoveryKey string, err error) {
+	if db.isEmpty() {
+		return "", errors.New("内存中的数据库没有数据, 请先登入")
+	}
+	current, err := db.findSlot(password, keyfile)
+	if err != nil {
+		return
+	}
+	if _, _, err = db.readAndVerify(); err != nil {
+		return
+	}
+	fragFiles, err := db.storage.Fragments()
+	if err != nil {
+		return
+	}
+	if _, err = db.backup(fragFiles); err != nil {
+		return
+	}
+
+	newKey := newRandomKey()
+	header := *db.header
+	passwordSlot, err := newKeySlot(
+		SlotPassword, current.Label, password, keyfile, &newKey, header.VaultID)
+	if err != nil {
+		return
+	}
+	header.Slots = []*KeySlot{passwordSlot}
+	if db.header.slot(SlotRecovery) != nil {
+		var recoverySlot *KeySlot
+		if recoveryKey, recoverySlot, err = newRecoverySlot(&newKey, header.VaultID); err != nil {
+			return
+		}
+		header.setSlot(SlotRecovery, recoverySlot)
+	}
 
-	// 这句应该可以删掉吧? 此时内存中 db.userKey 已经没有用了.
-	// 不能删掉, 因为如果紧接着再修改一次密码, 就会用到.
-	db.userKey = &newKey
+	oldKey, oldHeader, oldSeq, oldChain, oldSlotID := db.key, db.header, db.seq, db.chain, db.slotID
+	db.key, db.header, db.slotID = &newKey, &header, passwordSlot.ID()
+	db.chain = nil
+	if err = db.rewriteDBFile(fragFiles); err != nil {
+		if errors.Is(err, errPendingCleanup) {
+			// 新的数据库文件已生效, 只是未能删除碎片, 下次启动时 RecoverPendingWrites 会继续删除.
+			return
+		}
+		// 数据库文件未能更新, 内存数据库也要恢复原状, 否则之后的碎片会采用新的内部密码.
+		db.key, db.header, db.slotID = oldKey, oldHeader, oldSlotID
+		db.seq, db.chain = oldSeq, oldChain
+		return "", err
+	}
+	return
+}
+
+// PendingFragments 返回尚未整合到数据库文件中的数据库碎片的数量.
+func (db *DB) PendingFragments() int {
+	if db.header == nil {
+		return 0
+	}
+	return int(db.seq - db.header.Seq)
+}
+
+// Compact 在不重新登入的情况下把数据库碎片整合到数据库文件中 (相当于登入时 Rebuild 的后半部分):
+// 先备份数据库文件和全部碎片, 然后用内存数据库重写数据库文件, 最后删除已整合的碎片.
+// 整合前会检查数据库文件是否仍是内存数据库所对应的文件, 以及碎片是否完整 (与内存数据库一致),
+// 否则拒绝整合, 以免覆盖其他操作 (比如在登出状态下用恢复密钥设置新密码) 的结果.
+// 没有碎片时什么都不做. 为了方便测试返回 tarball 的文件名.
+func (db *DB) Compact() (tarballFile string, err error) {
+	if db.IsNotInit() {
+		return "", errors.New("内存中的数据库没有数据, 请先登入")
+	}
+	fragFiles, err := db.storage.Fragments()
+	if err != nil || len(fragFiles) == 0 {
+		return "", err
+	}
+	if err := db.checkVaultUnchanged(); err != nil {
+		return "", err
+	}
+	frags, err := db.readFragFiles(fragFiles)
+	if err != nil {
+		return "", err
+	}
+	if last := frags[len(frags)-1].meta; last == nil || last.Seq != db.seq {
+		return "", fmt.Errorf("%w: 数据库碎片与内存数据库不一致, 请重新登入", ErrTampered)
+	}
+	if tarballFile, err = db.backup(fragFiles); err != nil {
+		return "", err
+	}
+	if err = db.rewriteDBFile(fragFiles); err != nil {
+		return
+	}
+	db.snapshotSeq = db.seq
+	return
+}
 
+// checkVaultUnchanged 检查数据库文件是否仍是内存数据库所对应的文件, 即没有被其他操作
+// (比如在登出状态下用恢复密钥设置新密码) 修改过, 以免用内存数据库重写时覆盖其结果.
+func (db *DB) checkVaultUnchanged() error {
+	header, _, err := db.loadVault()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(header.MAC, db.header.MAC) {
+		return errVaultChanged
+	}
 	return nil
 }
 
 // UpdateSettings 利用 The First Mima 的 Notes 来保存程序的设定, 主要用于云备份.
 // settings 应采用 json 格式, 并且转为 base64 字符串.
 func (db *DB) UpdateSettings(settings string) error {
-	allBoxes, err := db.getAllBoxes()
+	header, boxes, err := db.readAndVerify()
 	if err != nil {
 		return err
 	}
-	if _, err = db.backupToTar([]string{db.FullPath}); err != nil {
+	if _, err = db.backup(nil); err != nil {
 		return err
 	}
 
 	// 解密
-	firstMima, err := Decrypt(allBoxes[0], db.userKey)
+	firstMima, err := openBox(header, boxes[0], db.key, dbSlot(0))
 	if err != nil {
-		return fmt.Errorf("用户密码错误: %w", err)
+		return err
 	}
 	//修改
 	firstMima.Notes = settings
 	firstMima.UpdatedAt = time.Now().UnixNano()
-	db.GetByIndex(0).Notes = settings
-	db.GetByIndex(0).UpdatedAt = firstMima.UpdatedAt
+	db.mimaTable.first.Notes = settings
+	db.mimaTable.first.UpdatedAt = firstMima.UpdatedAt
 	// 重新加密
-	box64, err := firstMima.Seal(db.userKey)
+	box, err := sealBox(header, firstMima, db.key, dbSlot(0))
 	if err != nil {
 		return err
 	}
 	// 持久化
-	allBoxes[0] = box64
-	return db.writeBoxes(allBoxes)
-}
-
-func (db *DB) HasSettings() bool {
-	return len(db.mimaTable[0].Notes) > 0
-}
-
-// GetSettings 返回本软件的一些设定 (json 格式, 且已被 base64 编码).
-// 利用了 The First Mima 的 Notes 来保存设定. 主要用于云备份.
-func (db *DB) GetSettings() string {
-	return db.GetByIndex(0).Notes
-}
-
-func (db *DB) EqualToUserKey(key SecretKey) bool {
-	return key == *db.userKey
+	boxes[0] = box
+	if err := db.saveVault(header, boxes, db.key, nil); err != nil {
+		return err
+	}
+	db.header = header
+	return nil
 }
 
-func (db *DB) writeBoxes(allBoxes []string) error {
-	dbFile, err := os.Create(db.FullPath)
+// readAndVerify 读取数据库文件并检查校验码. 用于只修改第一条记录 (不整合碎片) 的情形,
+// 此时数据库文件头中的 Seq 和 Chain 必须保持不变, 以便之后能继续整合碎片.
+func (db *DB) readAndVerify() (*Header, [][]byte, error) {
+	header, boxes, err := db.loadVault()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	//noinspection GoUnhandledErrorResult
-	defer dbFile.Close()
-
-	dbWriter := bufio.NewWriter(dbFile)
-	for _, box64 := range allBoxes {
-		if err := bufWriteln(dbWriter, box64); err != nil {
-			return err
-		}
+	if len(boxes) == 0 {
+		return nil, nil, fmt.Errorf("%w: 数据库文件中没有任何记录", ErrTampered)
+	}
+	if err := header.verifyMAC(db.key, boxes); err != nil {
+		return nil, nil, err
 	}
-	return dbWriter.Flush()
+	return header, boxes, nil
 }
 
-// getAllBoxes 从数据库文件中读取全部数据, 转换为字符串数组.
-func (db *DB) getAllBoxes() (allBoxes []string, err error) {
-	scanner, file, err := util.NewFileScanner(db.FullPath)
-	if err != nil {
-		return nil, err
-	}
-	//noinspection GoUnhandledErrorResult
-	defer file.Close()
+func (db *DB) HasSettings() bool {
+	return len(db.mimaTable.first.Notes) > 0
+}
 
-	for scanner.Scan() {
-		box64 := scanner.Text()
-		allBoxes = append(allBoxes, box64)
-	}
-	return allBoxes, scanner.Err()
+// GetSettings 返回本软件的一些设定 (json 格式, 且已被 base64 编码).
+// 利用了 The First Mima 的 Notes 来保存设定. 主要用于云备份.
+func (db *DB) GetSettings() string {
+	return db.mimaTable.first.Notes
 }
 
 // MimaTable 为了测试方便.
 func (db *DB) MimaTable() []*Mima {
-	return db.mimaTable
+	return db.mimaTable.all()
 }
 
 // All 返回全部 Mima, 但不包含 index:0, 也不包含已软删除的条目.
 // 并且删除含密码和备注等敏感信息. 另外, 更新时间最新(最近)的排在前面.
 func (db *DB) All() (all []*MimaForm) {
-	if db.Len()-1 == 0 {
+	if db.Len()-1 <= 0 {
 		return
 	}
-	for i := db.Len() - 1; i > 0; i-- {
-		mima := db.mimaTable[i].ToForm().HideSecrets()
-		if mima.IsDeleted() {
-			continue
+	db.mimaTable.reverse(func(mima *Mima) {
+		if !mima.IsDeleted() {
+			all = append(all, mima.ToForm().HideSecrets())
 		}
-		all = append(all, mima)
-	}
+	})
 	return
 }
 
 // DeletedMimas 返回全部被软删除的 Mima, 不包含密码.
 // 删除日期最新(最近)的排在前面.
 func (db *DB) DeletedMimas() (deleted []*MimaForm) {
-	if db.Len()-1 == 0 {
+	if db.Len()-1 <= 0 {
 		return nil
 	}
-	for i := db.Len() - 1; i > 0; i-- {
-		mima := db.mimaTable[i].ToForm().HideSecrets()
-		if !mima.IsDeleted() {
-			continue
+	db.mimaTable.reverse(func(mima *Mima) {
+		if mima.IsDeleted() {
+			deleted = append(deleted, mima.ToForm().HideSecrets())
 		}
-		deleted = append(deleted, mima)
-	}
+	})
 	sort.Slice(deleted, func(i, j int) bool {
 		return deleted[i].DeletedAt > deleted[j].DeletedAt
 	})
@@ -597,8 +772,15 @@ func (db *DB) Add(mima *Mima) error {
 	if len(mima.Title) == 0 {
 		return errNeedTitle
 	}
-	db.mimaTable = append(db.mimaTable, mima)
-	return db.sealAndWriteFrag(mima, Insert)
+	if err := db.mimaTable.add(mima); err != nil {
+		return err
+	}
+	if err := db.sealAndWriteFrag(mima, Insert); err != nil {
+		db.restoreRecord(mima, nil)
+		return err
+	}
+	db.logOp(fmt.Sprintf("新增 %q", mima.Title), mima.ID, nil)
+	return nil
 }
 
 // Update 根据 MimaForm 更新对应的 Mima 内容, 并生成一块数据库碎片.
@@ -606,61 +788,94 @@ func (db *DB) Update(form *MimaForm) (err error) {
 	if len(form.Title) == 0 {
 		return errNeedTitle
 	}
-	i, mima, err := db.GetByID(form.ID)
-	if err != nil {
-		return err
-	}
-	needChangeIndex, needWriteFrag, err := mima.UpdateFromForm(form)
+	mima, err := db.GetByID(form.ID)
 	if err != nil {
 		return err
 	}
+	before := mima.clone()
+	oldAlias := mima.Alias
+	// 如果生成历史记录, 以下一个碎片的序号作为历史记录的序号.
+	needChangeIndex, needWriteFrag := mima.UpdateFromForm(form, db.seq+1)
+	db.mimaTable.updateAlias(mima, oldAlias)
 	if needChangeIndex {
-		db.mimaTable = append(db.mimaTable, mima)
-		db.mimaTable = append(db.mimaTable[:i], db.mimaTable[i+1:]...)
+		db.mimaTable.moveToBack(mima)
 	}
 	if needWriteFrag {
-		err = db.sealAndWriteFrag(mima, Update)
+		if err = db.sealAndWriteFrag(mima, Update); err != nil {
+			db.restoreRecord(mima, before)
+			return
+		}
+		db.logOp(describeUpdate(before, mima), mima.ID, before)
 	}
 	return
 }
 
 // TrashByID 软删除一个 mima, 并生成一块数据库碎片.
 func (db *DB) TrashByID(id string) error {
-	_, mima, err := db.GetByID(id)
+	mima, err := db.GetByID(id)
 	if err != nil {
 		return err
 	}
+	before := mima.clone()
 	mima.Delete()
-	return db.sealAndWriteFrag(mima, SoftDelete)
+	if err := db.sealAndWriteFrag(mima, SoftDelete); err != nil {
+		db.restoreRecord(mima, before)
+		return err
+	}
+	db.logOp(fmt.Sprintf("把 %q 移到回收站", mima.Title), id, before)
+	return nil
 }
 
 // UnDeleteByID 从回收站中还原一个 mima (DeletedAt 重置为零), 并生成一块数据库碎片.
 // 此时, 需要判断 Alias 有无冲突, 如有冲突则清空本条记录的 Alias.
 func (db *DB) UnDeleteByID(id string) (err error) {
-	_, mima, err := db.GetByID(id)
+	mima, err := db.GetByID(id)
 	if err != nil {
 		return err
 	}
+	before := mima.clone()
 	mima.UnDelete()
 	if err2 := db.sealAndWriteFrag(mima, UnDelete); err2 != nil {
+		db.restoreRecord(mima, before)
 		return err2
 	}
+	db.logOp(fmt.Sprintf("从回收站还原 %q", mima.Title), id, before)
 	return
 }
 
+// sealAndWriteFrag 加密 mima 并追加到日志文件中 (即生成一个新的数据库碎片, 详见 journal.go).
+// 序号作为附加认证数据的一部分, 因此条目不可挪动位置.
+// 每个碎片都带有序号和校验码, 与前一个状态首尾相连.
+// 碎片数量达到 CompactAfter 时自动整合 (详见 Compact). 此时碎片已经落盘, 数据已保存,
+// 因此自动整合失败时只记录日志并返回 nil, 碎片会保留到下次整合.
 func (db *DB) sealAndWriteFrag(mima *Mima, op Operation) error {
 	mima.Operation = op
-	sealed, err := mima.Seal(db.key)
+	sealed, err := mima.Seal(db.key, db.header.VaultID, journalSlot(db.seq+1))
 	if err != nil {
 		return err
 	}
-	return db.writeFragFile(sealed)
+	meta := db.nextFragMeta(sealed)
+	if err := db.appendJournal(meta, sealed); err != nil {
+		return err
+	}
+	db.seq, db.chain = meta.Seq, meta.MAC
+	if db.CompactAfter > 0 && db.PendingFragments() >= db.CompactAfter {
+		if _, err := db.Compact(); err != nil {
+			log.Println("数据已保存, 但自动整合数据库碎片失败:", err)
+		}
+	}
+	return nil
 }
 
-// 把已加密的数据写到一个新文件中 (即生成一个新的数据库碎片).
-func (db *DB) writeFragFile(box64 string) error {
-	fragmentPath := filepath.Join(db.BackupDir, newTimestampFilename(FragExt))
-	return writeFile(fragmentPath, box64)
+// restoreRecord 在写入数据库碎片失败时把 mima 恢复为 before 的状态 (包括在数据表中的位置和索引),
+// 以免内存数据库与数据库文件和碎片不一致. before 为 nil 表示 mima 原来不存在.
+// 数据表必须在写入碎片之前修改, 因为写入碎片后可能自动整合 (详见 sealAndWriteFrag).
+func (db *DB) restoreRecord(mima, before *Mima) {
+	db.mimaTable.remove(mima)
+	if before != nil {
+		*mima = *before
+		_ = db.mimaTable.insert(mima) // 上面已删除该 ID, 不会出错.
+	}
 }
 
 // DeleteForeverByID 彻底删除一条记录, 并生成一块数据库碎片.
@@ -669,18 +884,31 @@ func (db *DB) DeleteForeverByID(id string) error {
 	if err != nil {
 		return err
 	}
-	return db.sealAndWriteFrag(mima, DeleteForever)
+	before := mima.clone()
+	if err := db.sealAndWriteFrag(mima, DeleteForever); err != nil {
+		db.restoreRecord(mima, before)
+		return err
+	}
+	db.logOp(fmt.Sprintf("彻底删除 %q", mima.Title), id, before)
+	return nil
 }
 
-func (db *DB) DeleteHistoryItem(id string, datetime string) error {
-	_, mima, err := db.GetByID(id)
+// DeleteHistoryItem 彻底删除一条历史记录 (详见 Mima.DeleteHistory), 并生成一块数据库碎片.
+func (db *DB) DeleteHistoryItem(id string, seq uint64, datetime string) error {
+	mima, err := db.GetByID(id)
 	if err != nil {
 		return err
 	}
-	if err = mima.DeleteHistory(datetime); err != nil {
+	before := mima.clone()
+	if err = mima.DeleteHistory(seq, datetime); err != nil {
 		return err
 	}
-	return db.sealAndWriteFrag(mima, Update)
+	if err := db.sealAndWriteFrag(mima, Update); err != nil {
+		db.restoreRecord(mima, before)
+		return err
+	}
+	db.logOp(fmt.Sprintf("删除 %q 的一条历史记录 (%s)", mima.Title, datetime), id, before)
+	return nil
 }
 
 func (db *DB) IsExpired() bool {
@@ -0,0 +1,1613 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahui2016/mima-go/tarball"
+)
+
+const testPassword = "我是密码"
+
+// 测试时采用较低的成本参数, 以加快速度.
+func init() {
+	Argon2Time = 1
+	Argon2Memory = 1024
+	Argon2Threads = 1
+}
+
+// newTestDB 在临时文件夹中生成一个新的 DB, 测试结束后自动删除临时文件夹.
+func newTestDB(t *testing.T) *DB {
+	dir, err := ioutil.TempDir("", "mimadb")
+	checkTestErr(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return NewDB(filepath.Join(dir, "mima.db"), dir)
+}
+
+func fileStorage(db *DB) *FileStorage {
+	return db.storage.(*FileStorage)
+}
+
+func TestDB_InitAndRebuild(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	mima, err := NewMima("one")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db2.Len() != 2 {
+		t.Fatalf("db2.Len(), want: 2, got: %d", db2.Len())
+	}
+	if db2.CheckPassword(testPassword, nil) != nil || db2.CheckPassword("wrong", nil) != ErrWrongPassword {
+		t.Fatal("CheckPassword 结果错误")
+	}
+
+	db3 := NewDB(db.FullPath, db.BackupDir)
+	if _, err := db3.Rebuild("wrong", nil); err == nil {
+		t.Fatal("want: 密码错误, got: no error")
+	}
+}
+
+// TestDB_UpgradeLegacy 测试旧版数据库 (每行一条 base64 记录, userKey 由 sha256 直接生成)
+// 能否打开并自动升级. 其中一条记录超过 bufio.Scanner 默认的 64 KB 限制.
+func TestDB_UpgradeLegacy(t *testing.T) {
+	db := newTestDB(t)
+	legacyKey := sha256.Sum256([]byte(testPassword))
+	key := newRandomKey()
+	first, err := NewMima("")
+	checkTestErr(t, err)
+	first.ID = ""
+	first.Password = base64.StdEncoding.EncodeToString(key[:])
+	box, err := first.sealSecretbox(&legacyKey)
+	checkTestErr(t, err)
+	long, err := NewMima("long")
+	checkTestErr(t, err)
+	long.Notes = strings.Repeat("n", 100*1024)
+	longBox, err := long.sealSecretbox(&key)
+	checkTestErr(t, err)
+	legacy := base64.StdEncoding.EncodeToString(box) + "\n" +
+		base64.StdEncoding.EncodeToString(longBox) + "\n"
+	checkTestErr(t, ioutil.WriteFile(db.FullPath, []byte(legacy), 0644))
+
+	_, err = db.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	header, boxes, err := db.loadVault()
+	checkTestErr(t, err)
+	slot := header.slot(SlotPassword)
+	if header.Version != FormatVersion || header.Cipher != CipherXChaCha ||
+		slot == nil || slot.KDF.Name != kdfArgon2id {
+		t.Fatalf("want: version %d with argon2id, got: %+v", FormatVersion, header)
+	}
+	if len(boxes) != 2 {
+		t.Fatalf("len(boxes), want: 2, got: %d", len(boxes))
+	}
+
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if *db2.key != key {
+		t.Fatal("升级后内部密码发生了变化")
+	}
+}
+
+// TestKDFParams_Limits 测试超出上限的 argon2 参数在调用 argon2.IDKey 之前就被拒绝.
+func TestKDFParams_Limits(t *testing.T) {
+	if _, err := parseKDFParams("$argon2id$v=19$m=4294967295,t=3,p=4$c2FsdA"); !errors.Is(err, ErrTampered) {
+		t.Fatalf("parseKDFParams, want: %v, got: %v", ErrTampered, err)
+	}
+	params, err := newKDFParams(nil)
+	checkTestErr(t, err)
+	for _, tweak := range []func(p *KDFParams){
+		func(p *KDFParams) { p.Time = maxArgon2Time + 1 },
+		func(p *KDFParams) { p.Memory = maxArgon2Memory + 1 },
+		func(p *KDFParams) { p.Threads = 0 },
+	} {
+		bad := *params
+		tweak(&bad)
+		if _, err := DeriveKey(testPassword, nil, &bad); !errors.Is(err, ErrTampered) {
+			t.Fatalf("DeriveKey(%+v), want: %v, got: %v", bad, ErrTampered, err)
+		}
+	}
+}
+
+func TestMima_SealFreshNonce(t *testing.T) {
+	key := newRandomKey()
+	mima, err := NewMima("nonce")
+	checkTestErr(t, err)
+	box1, err := mima.Seal(&key, "vault", dbSlot(1))
+	checkTestErr(t, err)
+	box2, err := mima.Seal(&key, "vault", dbSlot(1))
+	checkTestErr(t, err)
+	if bytes.Equal(box1[len(box1)-len(box2):], box2) {
+		t.Fatal("两次加密的结果相同")
+	}
+	for _, box := range [][]byte{box1, box2} {
+		if _, err := Open(box, &key, "vault", dbSlot(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestOpen_WrongPlace 测试记录被移动到另一个数据库或另一个位置时, 能否识别出来.
+func TestOpen_WrongPlace(t *testing.T) {
+	key := newRandomKey()
+	mima, err := NewMima("moved")
+	checkTestErr(t, err)
+	box, err := mima.Seal(&key, "vault", dbSlot(1))
+	checkTestErr(t, err)
+	if _, err := Open(box, &key, "other-vault", dbSlot(1)); err == nil {
+		t.Fatal("want: 属于另一个数据库, got: no error")
+	}
+	if _, err := Open(box, &key, "vault", dbSlot(2)); err == nil {
+		t.Fatal("want: 位置不符, got: no error")
+	}
+	// 篡改明文保存的附加认证数据
+	tampered := bytes.Replace(box, []byte(dbSlot(1)), []byte(dbSlot(2)), 1)
+	if _, err := Open(tampered, &key, "vault", dbSlot(2)); err == nil {
+		t.Fatal("want: 解密失败, got: no error")
+	}
+}
+
+// initTestDB 以 testPassword 生成新的数据库, 返回恢复密钥.
+func initTestDB(t *testing.T, db *DB, keyfile []byte) string {
+	t.Helper()
+	recoveryKey, err := db.Init(testPassword, keyfile)
+	checkTestErr(t, err)
+	return recoveryKey
+}
+
+func checkTestErr(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeFragFile 以旧版的方式 (每个碎片一个文件) 新增一条记录, 返回碎片文件的完整路径.
+func writeFragFile(t *testing.T, db *DB, title string) string {
+	t.Helper()
+	mima, err := NewMima(title)
+	checkTestErr(t, err)
+	mima.Operation = Insert
+	name := newTimestampFilename(FragExt)
+	sealed, err := mima.Seal(db.key, db.header.VaultID, fragSlot(name))
+	checkTestErr(t, err)
+	meta := db.nextFragMeta(sealed)
+	records, err := encodeRecords(meta, sealed)
+	checkTestErr(t, err)
+	content := base64.StdEncoding.EncodeToString(append(append([]byte{}, fragMagic...), records...))
+	fullPath := filepath.Join(db.BackupDir, name)
+	checkTestErr(t, ioutil.WriteFile(fullPath, []byte(content), 0644))
+	checkTestErr(t, db.mimaTable.add(mima))
+	db.seq, db.chain = meta.Seq, meta.MAC
+	return fullPath
+}
+
+// TestDB_RenamedFragment 测试旧版碎片文件改名后 (比如用旧碎片冒充新碎片), Rebuild 会报错.
+func TestDB_RenamedFragment(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	fragFile := writeFragFile(t, db, "one")
+	renamed := filepath.Join(db.BackupDir, "1"+filepath.Base(fragFile))
+	checkTestErr(t, os.Rename(fragFile, renamed))
+
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	if _, err := db2.Rebuild(testPassword, nil); err == nil {
+		t.Fatal("want: 位置不符, got: no error")
+	}
+}
+
+// TestDB_TamperedDBFile 测试数据库文件被截断或篡改后, Rebuild 会报告 ErrTampered.
+func TestDB_TamperedDBFile(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	for _, title := range []string{"one", "two"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+	}
+	_, err := NewDB(db.FullPath, db.BackupDir).Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+
+	content, err := ioutil.ReadFile(db.FullPath)
+	checkTestErr(t, err)
+	// 截断: 删除末尾的校验码, 此时最后一条记录会被当作校验码.
+	truncated := content[:len(content)-4-sha256.Size]
+	// 篡改: 修改文件头中的序号.
+	tampered := bytes.Replace(content, []byte(`"Seq":2`), []byte(`"Seq":1`), 1)
+	if bytes.Equal(tampered, content) {
+		t.Fatal("找不到文件头中的序号")
+	}
+	for _, data := range [][]byte{truncated, tampered} {
+		checkTestErr(t, ioutil.WriteFile(db.FullPath, data, 0644))
+		_, err = NewDB(db.FullPath, db.BackupDir).Rebuild(testPassword, nil)
+		if !errors.Is(err, ErrTampered) {
+			t.Fatalf("want: ErrTampered, got: %v", err)
+		}
+	}
+}
+
+// TestDB_MissingAndReplayedFragment 测试日志缺少中间的条目, 或重放已整合过的旧日志时,
+// Rebuild 会报告 ErrTampered, 并且 Inspect 能列出问题.
+func TestDB_MissingAndReplayedFragment(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	for _, title := range []string{"one", "two", "three"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+	}
+	entries, _, _, err := db.journalEntries()
+	checkTestErr(t, err)
+	if len(entries) != 3 {
+		t.Fatalf("len(entries), want: 3, got: %d", len(entries))
+	}
+	journal, err := ioutil.ReadFile(fileStorage(db).journalPath())
+	checkTestErr(t, err)
+
+	// 缺少中间的条目
+	withoutMiddle := append(append([]byte{}, journal[:entries[0].end]...), journal[entries[1].end:]...)
+	checkTestErr(t, ioutil.WriteFile(fileStorage(db).journalPath(), withoutMiddle, 0644))
+	_, err = NewDB(db.FullPath, db.BackupDir).Rebuild(testPassword, nil)
+	if !errors.Is(err, ErrTampered) {
+		t.Fatalf("want: ErrTampered, got: %v", err)
+	}
+	problems, err := db.Inspect(testPassword, nil)
+	checkTestErr(t, err)
+	if len(problems) != 1 || !strings.Contains(problems[0], "缺少序号 2 至 2") {
+		t.Fatalf("want: 缺少序号 2 的碎片, got: %v", problems)
+	}
+
+	// 放回之后可正常整合, 然后重放旧日志
+	checkTestErr(t, ioutil.WriteFile(fileStorage(db).journalPath(), journal, 0644))
+	_, err = NewDB(db.FullPath, db.BackupDir).Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	checkTestErr(t, ioutil.WriteFile(fileStorage(db).journalPath(), journal, 0644))
+	_, err = NewDB(db.FullPath, db.BackupDir).Rebuild(testPassword, nil)
+	if !errors.Is(err, ErrTampered) {
+		t.Fatalf("want: ErrTampered, got: %v", err)
+	}
+}
+
+// TestDB_RotateKey 测试更换内部密码后, 旧的内部密码不能再解密数据库文件, 并且之后的碎片仍可整合.
+func TestDB_RotateKey(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	mima, err := NewMima("before")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+	oldKey := *db.key
+
+	_, err = db.RotateKey(testPassword, nil)
+	checkTestErr(t, err)
+	if *db.key == oldKey {
+		t.Fatal("内部密码没有变化")
+	}
+	fragFiles, err := db.storage.Fragments()
+	checkTestErr(t, err)
+	if len(fragFiles) != 0 {
+		t.Fatalf("len(fragFiles), want: 0, got: %d", len(fragFiles))
+	}
+	header, boxes, err := db.loadVault()
+	checkTestErr(t, err)
+	if _, err := openBox(header, boxes[1], &oldKey, dbSlot(1)); err == nil {
+		t.Fatal("旧的内部密码仍可解密")
+	}
+
+	mima, err = NewMima("after")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db2.Len() != 3 || *db2.key != *db.key {
+		t.Fatalf("db2.Len(), want: 3, got: %d", db2.Len())
+	}
+}
+
+// TestDB_Keyfile 测试采用 keyfile 时, 能识别 keyfile 缺失, 密码或 keyfile 错误时返回同一个错误
+// (文件头中不保存可用来离线猜测 keyfile 的校验值), 并且修改密码时可取消 keyfile.
+func TestDB_Keyfile(t *testing.T) {
+	keyfile := []byte("content of a photo on a usb stick")
+	db := newTestDB(t)
+	initTestDB(t, db, keyfile)
+
+	for _, c := range []struct {
+		password string
+		keyfile  []byte
+		want     error
+	}{
+		{testPassword, nil, ErrNeedKeyfile},
+		{testPassword, []byte("another file"), ErrWrongPasswordOrKeyfile},
+		{"wrong", keyfile, ErrWrongPasswordOrKeyfile},
+		{testPassword, keyfile, nil},
+	} {
+		_, err := NewDB(db.FullPath, db.BackupDir).Rebuild(c.password, c.keyfile)
+		if !errors.Is(err, c.want) {
+			t.Fatalf("want: %v, got: %v", c.want, err)
+		}
+		if err := db.CheckPassword(c.password, c.keyfile); !errors.Is(err, c.want) {
+			t.Fatalf("CheckPassword, want: %v, got: %v", c.want, err)
+		}
+	}
+
+	checkTestErr(t, db.ChangeUserKey(testPassword, nil))
+	_, err := NewDB(db.FullPath, db.BackupDir).Rebuild(testPassword, keyfile)
+	if !errors.Is(err, ErrNoKeyfile) {
+		t.Fatalf("want: %v, got: %v", ErrNoKeyfile, err)
+	}
+	_, err = NewDB(db.FullPath, db.BackupDir).Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+}
+
+// TestDB_RecoveryKey 测试忘记密码时可用恢复密钥添加新密码, 以及撤销恢复密钥.
+func TestDB_RecoveryKey(t *testing.T) {
+	db := newTestDB(t)
+	recoveryKey := initTestDB(t, db, nil)
+	mima, err := NewMima("one")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+
+	if err := db.RecoverWithKey("AAAA-BBBB", "new", nil); !errors.Is(err, ErrWrongRecoveryKey) {
+		t.Fatalf("want: %v, got: %v", ErrWrongRecoveryKey, err)
+	}
+	// 恢复密钥不区分大小写, 也可以没有分隔符.
+	lower := strings.ToLower(strings.Replace(recoveryKey, "-", "", -1))
+	checkTestErr(t, db.RecoverWithKey(lower, "new", nil))
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.Rebuild("new", nil)
+	checkTestErr(t, err)
+	if db2.Len() != 2 {
+		t.Fatalf("db2.Len(), want: 2, got: %d", db2.Len())
+	}
+
+	checkTestErr(t, db2.RevokeRecoveryKey())
+	if err := db2.RecoverWithKey(recoveryKey, "other", nil); err != ErrNoRecoveryKey {
+		t.Fatalf("want: %v, got: %v", ErrNoRecoveryKey, err)
+	}
+	newKey, err := db2.NewRecoveryKey()
+	checkTestErr(t, err)
+	checkTestErr(t, db2.RecoverWithKey(newKey, "other", nil))
+}
+
+// TestDB_KeySlots 测试多个成员各自用自己的密码解锁, 删除 key slot, 以及删除后更换内部密码.
+func TestDB_KeySlots(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	checkTestErr(t, db.AddSlot("alice", "alice-pwd", nil))
+	checkTestErr(t, db.AddSlot("bob", "bob-pwd", []byte("bob's keyfile")))
+	if err := db.AddSlot(" ", "pwd", nil); err == nil {
+		t.Fatal("want: 标签不可为空, got: no error")
+	}
+
+	bob := NewDB(db.FullPath, db.BackupDir)
+	_, err := bob.Rebuild("bob-pwd", []byte("bob's keyfile"))
+	checkTestErr(t, err)
+	alice := NewDB(db.FullPath, db.BackupDir)
+	_, err = alice.Rebuild("alice-pwd", nil)
+	checkTestErr(t, err)
+	if _, err := NewDB(db.FullPath, db.BackupDir).Rebuild("nobody", nil); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("want: %v, got: %v", ErrWrongPassword, err)
+	}
+
+	var bobID string
+	for _, slot := range alice.Slots() {
+		if slot.Label == "bob" {
+			bobID = slot.ID
+			if !slot.UsesKeyfile || slot.LastUsed == "-" {
+				t.Fatalf("bob 的 key slot 信息错误: %+v", slot)
+			}
+		}
+		if slot.Current != (slot.Label == "alice") {
+			t.Fatalf("当前 key slot 错误: %+v", slot)
+		}
+	}
+	if err := alice.RemoveSlot(alice.slotID); err == nil {
+		t.Fatal("want: 不可删除当前 key slot, got: no error")
+	}
+	checkTestErr(t, alice.RemoveSlot(bobID))
+	if _, err := NewDB(db.FullPath, db.BackupDir).Rebuild("bob-pwd", []byte("bob's keyfile")); err == nil {
+		t.Fatal("want: bob 已被删除, got: no error")
+	}
+
+	// 更换内部密码后, 只剩下 alice 的密码 key slot 和新的恢复密钥.
+	recoveryKey, err := alice.RotateKey("alice-pwd", nil)
+	checkTestErr(t, err)
+	if recoveryKey == "" || len(alice.Slots()) != 2 {
+		t.Fatalf("want: alice 和恢复密钥, got: %+v", alice.Slots())
+	}
+	if _, err := NewDB(db.FullPath, db.BackupDir).Rebuild(testPassword, nil); err == nil {
+		t.Fatal("want: 主密码已失效, got: no error")
+	}
+	_, err = NewDB(db.FullPath, db.BackupDir).Rebuild("alice-pwd", nil)
+	checkTestErr(t, err)
+}
+
+// TestDB_Shares 测试把内部密码拆分为 5 份, 任意 3 份即可还原并设置新密码.
+func TestDB_Shares(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	shares, err := db.SplitKey(5, 3)
+	checkTestErr(t, err)
+	if len(shares) != 5 {
+		t.Fatalf("len(shares), want: 5, got: %d", len(shares))
+	}
+
+	if err := db.RecoverWithShares(shares[:2], "new", nil); err == nil {
+		t.Fatal("want: 分享不足, got: no error")
+	}
+	typo := strings.Replace(shares[0], "MIMA-", "MIMA-X", 1)
+	if err := db.RecoverWithShares([]string{typo, shares[1], shares[2]}, "new", nil); err == nil {
+		t.Fatal("want: 校验码不符, got: no error")
+	}
+	others, err := db.SplitKey(5, 3)
+	checkTestErr(t, err)
+	err = db.RecoverWithShares([]string{shares[0], others[1], shares[2]}, "new", nil)
+	if err == nil || !strings.Contains(err.Error(), "第 2 份") {
+		t.Fatalf("want: 第 2 份分享来自另一次拆分, got: %v", err)
+	}
+
+	// 较早版本的分享没有 SetID, 仍可使用.
+	var legacy []string
+	for _, text := range others[:3] {
+		info, err := parseShare(text)
+		checkTestErr(t, err)
+		body := fmt.Sprintf("%s-%s-%d-%s", sharePrefix, info.vaultID, info.threshold,
+			shareEncoding.EncodeToString(info.share))
+		legacy = append(legacy, fmt.Sprintf("%s-%08X", body, crc32.ChecksumIEEE([]byte(body))))
+	}
+	checkTestErr(t, db.RecoverWithShares(legacy, "legacy", nil))
+	lower := strings.ToLower(shares[4])
+	checkTestErr(t, db.RecoverWithShares([]string{shares[3], "", lower, shares[1]}, "new", nil))
+	_, err = NewDB(db.FullPath, db.BackupDir).Rebuild("new", nil)
+	checkTestErr(t, err)
+}
+
+// TestDB_RecoverPendingWrites 模拟新的数据库文件已生效, 但删除碎片之前程序中断的情形,
+// 以及残留的临时文件. 下次 Rebuild 时应自动清理, 而不是把剩下的碎片当作重复的碎片.
+func TestDB_RecoverPendingWrites(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	for _, title := range []string{"one", "two"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+	}
+	fragFiles, err := db.storage.Fragments()
+	checkTestErr(t, err)
+
+	// 整合碎片并写好清理清单, 但不删除碎片.
+	checkTestErr(t, db.rewriteDBFile(nil))
+	vault, err := ioutil.ReadFile(db.FullPath)
+	checkTestErr(t, err)
+	sum := sha256.Sum256(vault)
+	list := cleanupList{Sum: sum[:], Files: fragFiles}
+	data, err := json.Marshal(list)
+	checkTestErr(t, err)
+	checkTestErr(t, ioutil.WriteFile(fileStorage(db).cleanupPath(), data, 0644))
+	tempFile := db.FullPath + ".123" + tempExt
+	checkTestErr(t, ioutil.WriteFile(tempFile, []byte("half"), 0644))
+	otherTemp := filepath.Join(filepath.Dir(db.FullPath), "notes"+tempExt)
+	checkTestErr(t, ioutil.WriteFile(otherTemp, []byte("not ours"), 0644))
+
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db2.Len() != 3 {
+		t.Fatalf("db2.Len(), want: 3, got: %d", db2.Len())
+	}
+	paths := []string{tempFile, fileStorage(db).cleanupPath()}
+	for _, name := range fragFiles {
+		paths = append(paths, filepath.Join(db.BackupDir, name))
+	}
+	for _, f := range paths {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("%s 应已被删除", f)
+		}
+	}
+	if _, err := os.Stat(otherTemp); err != nil {
+		t.Fatalf("不是 createAtomic 创建的临时文件, 不应删除: %v", err)
+	}
+
+	// 清理清单的校验码与数据库文件不符 (改名之前中断), 碎片必须保留.
+	mima, err := NewMima("three")
+	checkTestErr(t, err)
+	checkTestErr(t, db2.Add(mima))
+	fragFiles, err = db2.storage.Fragments()
+	checkTestErr(t, err)
+	list = cleanupList{Sum: []byte("not the current sum"), Files: []string{fragFiles[0]}}
+	data, err = json.Marshal(list)
+	checkTestErr(t, err)
+	checkTestErr(t, ioutil.WriteFile(fileStorage(db).cleanupPath(), data, 0644))
+
+	db3 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db3.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db3.Len() != 4 {
+		t.Fatalf("db3.Len(), want: 4, got: %d", db3.Len())
+	}
+}
+
+func TestDB_LockDir(t *testing.T) {
+	db := newTestDB(t)
+	// 已退出的进程留下的锁.
+	checkTestErr(t, ioutil.WriteFile(fileStorage(db).lockPath(), []byte("999999999"), 0644))
+	stalePID, err := db.LockDir()
+	checkTestErr(t, err)
+	if stalePID != 999999999 {
+		t.Fatalf("stalePID, want: 999999999, got: %d", stalePID)
+	}
+
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.LockDir()
+	var lockedErr *LockedError
+	if !errors.As(err, &lockedErr) || lockedErr.PID != os.Getpid() {
+		t.Fatalf("want: LockedError (PID: %d), got: %v", os.Getpid(), err)
+	}
+
+	checkTestErr(t, db.UnlockDir())
+	stalePID, err = db2.LockDir()
+	checkTestErr(t, err)
+	if stalePID != 0 {
+		t.Fatalf("正常释放的锁不应被当作 stale lock, got: %d", stalePID)
+	}
+	checkTestErr(t, db2.UnlockDir())
+}
+
+func TestDB_Compact(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	db.CompactAfter = 3
+	for i, title := range []string{"one", "two", "three"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+		entries, _, _, err := db.journalEntries()
+		checkTestErr(t, err)
+		want := (i + 1) % 3
+		if db.PendingFragments() != want || len(entries) != want {
+			t.Fatalf("第 %d 个碎片之后, want: %d 个碎片, got: %d (日志中有 %d 个条目)",
+				i+1, want, db.PendingFragments(), len(entries))
+		}
+	}
+	tarballs, err := db.Backups()
+	checkTestErr(t, err)
+	if len(tarballs) != 1 {
+		t.Fatalf("整合前应备份一次, got: %d 个 tarball", len(tarballs))
+	}
+
+	// 整合之后继续生成碎片, 手动整合, 然后重新登入.
+	mima, err := NewMima("four")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+	_, err = db.Compact()
+	checkTestErr(t, err)
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db2.Len() != 5 {
+		t.Fatalf("db2.Len(), want: 5, got: %d", db2.Len())
+	}
+
+	// 数据库文件已被其他操作修改时拒绝整合.
+	mima, err = NewMima("five")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+	_, err = db2.NewRecoveryKey()
+	checkTestErr(t, err)
+	if _, err := db.Compact(); err == nil {
+		t.Fatal("want: 数据库文件已被修改, got: no error")
+	}
+
+	// 自动整合失败时碎片已经落盘, 不应当作保存失败.
+	db.CompactAfter = 1
+	mima, err = NewMima("six")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+	if db.PendingFragments() != 2 {
+		t.Fatalf("自动整合失败后碎片应保留, want: 2, got: %d", db.PendingFragments())
+	}
+}
+
+// TestDB_MigrateFragFiles 测试旧版碎片文件与日志中的条目能一起整合到数据库文件中.
+func TestDB_MigrateFragFiles(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	writeFragFile(t, db, "one")
+	writeFragFile(t, db, "two")
+	mima, err := NewMima("three")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db2.Len() != 4 {
+		t.Fatalf("db2.Len(), want: 4, got: %d", db2.Len())
+	}
+	fragFiles, err := db2.storage.Fragments()
+	checkTestErr(t, err)
+	if len(fragFiles) != 0 {
+		t.Fatalf("整合后应删除全部碎片文件和日志, got: %v", fragFiles)
+	}
+}
+
+// TestDB_TornJournal 测试日志末尾有不完整的条目 (追加时中断) 时, Inspect 能报告,
+// 并且 Rebuild 会截掉它, 而不影响之前的条目.
+func TestDB_TornJournal(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	for _, title := range []string{"one", "two"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+	}
+	journal, err := ioutil.ReadFile(fileStorage(db).journalPath())
+	checkTestErr(t, err)
+	entries, _, _, err := db.journalEntries()
+	checkTestErr(t, err)
+	lastEntry := journal[entries[0].end:]
+	torn := append(journal, lastEntry[:len(lastEntry)/2]...)
+	checkTestErr(t, ioutil.WriteFile(fileStorage(db).journalPath(), torn, 0644))
+
+	problems, err := db.Inspect(testPassword, nil)
+	checkTestErr(t, err)
+	if len(problems) != 1 || !strings.Contains(problems[0], "不完整") {
+		t.Fatalf("want: 日志末尾不完整, got: %v", problems)
+	}
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db2.Len() != 3 {
+		t.Fatalf("db2.Len(), want: 3, got: %d", db2.Len())
+	}
+}
+
+// TestDB_AppendLegacyJournal 测试不会把新的条目追加到较早版本的日志中, 并且内存数据库保持原状.
+func TestDB_AppendLegacyJournal(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	legacy := append(append([]byte{}, legacyJournalMagic...), "old entries"...)
+	checkTestErr(t, ioutil.WriteFile(fileStorage(db).journalPath(), legacy, 0644))
+	mima, err := NewMima("one")
+	checkTestErr(t, err)
+	if err := db.Add(mima); !errors.Is(err, errJournalHead) {
+		t.Fatalf("want: %v, got: %v", errJournalHead, err)
+	}
+	journal, err := ioutil.ReadFile(fileStorage(db).journalPath())
+	checkTestErr(t, err)
+	if !bytes.Equal(journal, legacy) {
+		t.Fatal("较早版本的日志不应被修改")
+	}
+	if db.Len() != 1 {
+		t.Fatalf("db.Len(), want: 1, got: %d", db.Len())
+	}
+}
+
+// TestDB_CorruptJournal 测试日志中间条目的长度前缀损坏时, 启动时不会截掉其后的条目,
+// 而是返回 ErrTampered, 并且 Fsck 能报告损坏的部分, 同时读取其前后的条目.
+func TestDB_CorruptJournal(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	for _, title := range []string{"one", "two", "three"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+	}
+	journal, err := ioutil.ReadFile(fileStorage(db).journalPath())
+	checkTestErr(t, err)
+	entries, _, _, err := db.journalEntries()
+	checkTestErr(t, err)
+	corrupt := append([]byte{}, journal...)
+	corrupt[entries[0].end] ^= 0xff // 第二个条目的长度前缀
+	checkTestErr(t, ioutil.WriteFile(fileStorage(db).journalPath(), corrupt, 0644))
+
+	if _, err := db.RecoverPendingWrites(); !errors.Is(err, ErrTampered) {
+		t.Fatalf("want: %v, got: %v", ErrTampered, err)
+	}
+	after, err := ioutil.ReadFile(fileStorage(db).journalPath())
+	checkTestErr(t, err)
+	if !bytes.Equal(after, corrupt) {
+		t.Fatal("日志文件损坏时不应被截短")
+	}
+	report, err := NewDB(db.FullPath, db.BackupDir).Fsck(testPassword, nil, false, false)
+	checkTestErr(t, err)
+	if report.Fragments != 2 || !strings.Contains(strings.Join(report.Problems, "\n"), "日志文件已损坏") {
+		t.Fatalf("want: 2 个可读的碎片并报告日志损坏, got: %d, %v", report.Fragments, report.Problems)
+	}
+}
+
+// TestDB_HistorySeq 测试历史记录以碎片序号区分: 同一秒内多次修改不会冲突,
+// 更换内部密码后序号继续递增, 并且重新登入后仍可按序号删除历史记录.
+func TestDB_HistorySeq(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	mima, err := NewMima("v1")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+	update := func(title string) {
+		t.Helper()
+		form := mima.ToForm()
+		form.Title = title
+		checkTestErr(t, db.Update(form))
+	}
+	update("v2")
+	update("v3")
+	_, err = db.RotateKey(testPassword, nil)
+	checkTestErr(t, err)
+	update("v4")
+
+	var seqs []uint64
+	for _, h := range mima.History {
+		seqs = append(seqs, h.Seq)
+	}
+	if len(seqs) != 3 || !(seqs[0] > seqs[1] && seqs[1] > seqs[2] && seqs[2] > 0) {
+		t.Fatalf("历史记录的序号应递增且不重复, got: %v", seqs)
+	}
+
+	db2 := NewDB(db.FullPath, db.BackupDir)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	h := mima.History[1]
+	checkTestErr(t, db2.DeleteHistoryItem(mima.ID, h.Seq, h.DateTime))
+	mima2, err := db2.GetByID(mima.ID)
+	checkTestErr(t, err)
+	if len(mima2.History) != 2 || mima2.History[0].Title != "v3" || mima2.History[1].Title != "v1" {
+		t.Fatalf("删除了错误的历史记录: %+v", mima2.History)
+	}
+}
+
+// TestDB_MemStorage 测试采用 MemStorage 时, 数据库的生成, 修改, 整合与备份都不需要读写文件.
+func TestDB_MemStorage(t *testing.T) {
+	storage := NewMemStorage()
+	db := NewDBWithStorage(storage)
+	if !db.FileNotExist() {
+		t.Fatal("want: 数据库文件不存在")
+	}
+	initTestDB(t, db, nil)
+	for _, title := range []string{"one", "two"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+	}
+	form := db.GetByIndex(1).ToForm()
+	form.Title = "one (updated)"
+	checkTestErr(t, db.Update(form))
+
+	db2 := NewDBWithStorage(storage)
+	_, err := db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db2.Len() != 3 || db2.GetByIndex(2).Title != "one (updated)" {
+		t.Fatalf("db2.Len(), want: 3, got: %d", db2.Len())
+	}
+	fragments, err := storage.Fragments()
+	checkTestErr(t, err)
+	tarballs, err := db2.Backups()
+	checkTestErr(t, err)
+	if len(fragments) != 0 || len(tarballs) != 1 {
+		t.Fatalf("整合后应删除日志并备份一次, got: %v, %v", fragments, tarballs)
+	}
+	if stalePID, err := db2.LockDir(); stalePID != 0 || err != nil {
+		t.Fatalf("MemStorage 不需要锁定, got: %d, %v", stalePID, err)
+	}
+}
+
+// TestDB_RestoreBackup 测试预览备份文件 (与当前数据库对比), 恢复选中的记录 (包括已彻底删除的记录),
+// 以及恢复整个数据库. 每次恢复前都应先备份当前状态, 并且恢复后重新登入结果不变.
+func TestDB_RestoreBackup(t *testing.T) {
+	storage := NewMemStorage()
+	db := NewDBWithStorage(storage)
+	initTestDB(t, db, nil)
+	var ids []string
+	for _, title := range []string{"one", "two"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+		ids = append(ids, mima.ID)
+	}
+	fragments, err := storage.Fragments()
+	checkTestErr(t, err)
+	name, err := db.backup(fragments)
+	checkTestErr(t, err)
+
+	form := db.GetFormByID(ids[0])
+	form.Title = "one (updated)"
+	checkTestErr(t, db.Update(form))
+	checkTestErr(t, db.DeleteForeverByID(ids[1]))
+	three, err := NewMima("three")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(three))
+
+	infos, err := db.BackupInfos()
+	checkTestErr(t, err)
+	if len(infos) != 1 || infos[0].Name != name || infos[0].Size == 0 {
+		t.Fatalf("BackupInfos, got: %+v", infos)
+	}
+	info, entries, err := db.BackupEntries(name)
+	checkTestErr(t, err)
+	if info.Records != 2 {
+		t.Fatalf("BackupEntries, want: 2 条记录, got: %+v", info)
+	}
+	diffs := make(map[string]string)
+	for _, entry := range entries {
+		diffs[entry.ID] = entry.Diff
+	}
+	if diffs[ids[0]] != DiffChanged || diffs[ids[1]] != DiffMissing {
+		t.Fatalf("BackupEntries, got: %v", diffs)
+	}
+
+	safety, err := db.RestoreEntries(name, ids[1:])
+	checkTestErr(t, err)
+	if safety == "" || safety == name {
+		t.Fatalf("恢复前应先备份当前状态, got: %q", safety)
+	}
+	if db.Len() != 4 || db.GetFormByID(ids[1]).Title != "two" {
+		t.Fatalf("RestoreEntries, db.Len() want: 4, got: %d", db.Len())
+	}
+
+	_, err = db.RestoreBackup(name)
+	checkTestErr(t, err)
+	backups, err := db.Backups()
+	checkTestErr(t, err)
+	if len(backups) != 3 {
+		t.Fatalf("want: 3 个备份文件, got: %v", backups)
+	}
+	db2 := NewDBWithStorage(storage)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if _, err := db2.GetByID(three.ID); err == nil || db2.Len() != 3 {
+		t.Fatalf("恢复整个数据库后应与备份相同, db2.Len() want: 3, got: %d", db2.Len())
+	}
+	if db2.GetFormByID(ids[0]).Title != "one" || db2.GetFormByID(ids[1]).Title != "two" {
+		t.Fatal("恢复整个数据库后应与备份相同")
+	}
+}
+
+func TestDB_PointInTime(t *testing.T) {
+	storage := NewMemStorage()
+	db := NewDBWithStorage(storage)
+	initTestDB(t, db, nil)
+	before := time.Now()
+	var ids []string
+	for _, title := range []string{"one", "two"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+		ids = append(ids, mima.ID)
+	}
+	fragments, err := storage.Fragments()
+	checkTestErr(t, err)
+	_, err = db.backup(fragments)
+	checkTestErr(t, err)
+	if _, _, err := db.PointInTimeEntries(before); err == nil {
+		t.Fatal("没有该时间点之前的备份文件时应返回错误")
+	}
+
+	// t1 之后的碎片整合到数据库文件中, 整合前的备份文件保存了这些碎片.
+	t1 := time.Now()
+	form := db.GetFormByID(ids[0])
+	form.Title = "one (updated)"
+	checkTestErr(t, db.Update(form))
+	compacted, err := db.Compact()
+	checkTestErr(t, err)
+	t2 := time.Now()
+	checkTestErr(t, db.DeleteForeverByID(ids[1]))
+	three, err := NewMima("three")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(three))
+
+	titles := func(at time.Time) (string, map[string]string) {
+		pit, entries, err := db.PointInTimeEntries(at)
+		checkTestErr(t, err)
+		diffs := make(map[string]string)
+		for _, entry := range entries {
+			diffs[entry.Title] = entry.Diff
+		}
+		return pit.Note, diffs
+	}
+	for _, tc := range []struct {
+		at   time.Time
+		want map[string]string
+	}{
+		{t1, map[string]string{"one": DiffChanged, "two": DiffMissing, "three": DiffAdded}},
+		{t2, map[string]string{"one (updated)": DiffSame, "two": DiffMissing, "three": DiffAdded}},
+		{time.Now(), map[string]string{"one (updated)": DiffSame, "three": DiffSame}},
+	} {
+		note, diffs := titles(tc.at)
+		if note != "" || !reflect.DeepEqual(diffs, tc.want) {
+			t.Fatalf("PointInTimeEntries(%v), want: %v, got: %v (%s)", tc.at, tc.want, diffs, note)
+		}
+	}
+
+	safety, err := db.RestoreEntriesAt(t1, ids[:1])
+	checkTestErr(t, err)
+	if safety == "" || db.GetFormByID(ids[0]).Title != "one" {
+		t.Fatal("RestoreEntriesAt 应恢复 t1 时的记录, 并先备份当前状态")
+	}
+
+	// 删除保存了碎片的备份文件后, 只能重建到缺少的碎片之前.
+	checkTestErr(t, storage.DeleteBackups([]string{compacted}))
+	if note, _ := titles(t2); note == "" {
+		t.Fatal("缺少碎片时应说明无法完全重建")
+	}
+}
+
+func TestDB_UndoRedo(t *testing.T) {
+	storage := NewMemStorage()
+	db := NewDBWithStorage(storage)
+	initTestDB(t, db, nil)
+	mima, err := NewMima("one")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+	id := mima.ID
+	form := db.GetFormByID(id)
+	form.Title, form.Alias = "two", "alias"
+	checkTestErr(t, db.Update(form))
+	h := db.GetFormByID(id).History[0]
+	checkTestErr(t, db.DeleteHistoryItem(id, h.Seq, h.DateTime))
+	checkTestErr(t, db.TrashByID(id))
+	checkTestErr(t, db.DeleteForeverByID(id))
+	if undo, _ := db.OpLog(); len(undo) != 5 {
+		t.Fatalf("OpLog, want: 5 个操作, got: %d", len(undo))
+	}
+
+	// check 检查内存数据库以及根据数据库碎片重建的数据库中的记录.
+	check := func(title, alias string, history int, deleted bool) {
+		t.Helper()
+		db2 := NewDBWithStorage(storage)
+		_, err := db2.Rebuild(testPassword, nil)
+		checkTestErr(t, err)
+		for _, d := range []*DB{db, db2} {
+			mima, err := d.GetByID(id)
+			checkTestErr(t, err)
+			if mima.Title != title || mima.Alias != alias || len(mima.History) != history || mima.IsDeleted() != deleted {
+				t.Fatalf("want: %s [%s] %d %v, got: %+v", title, alias, history, deleted, mima)
+			}
+			if ids := d.mimaTable.getByAlias(alias); alias != "" && len(ids) != 1 {
+				t.Fatalf("Alias 索引未更新: %v", ids)
+			}
+		}
+	}
+	_, err = db.Undo(1)
+	checkTestErr(t, err)
+	check("two", "alias", 0, true)
+	_, err = db.Undo(3)
+	checkTestErr(t, err)
+	check("one", "", 0, false)
+	if _, err := db.Undo(2); err == nil {
+		t.Fatal("只有 1 个操作可以撤销, 应返回错误")
+	}
+	_, err = db.Redo(2)
+	checkTestErr(t, err)
+	check("two", "alias", 0, false)
+	_, err = db.Undo(1)
+	checkTestErr(t, err)
+	check("two", "alias", 1, false)
+
+	// 撤销后进行新的操作会清空重做列表.
+	checkTestErr(t, db.TrashByID(id))
+	if _, redo := db.OpLog(); len(redo) != 0 {
+		t.Fatalf("want: 重做列表为空, got: %d", len(redo))
+	}
+	_, err = db.Undo(3)
+	checkTestErr(t, err)
+	if _, err := db.GetByID(id); err == nil {
+		t.Fatal("撤销新增操作后应删除该记录")
+	}
+}
+
+func TestDB_Compare(t *testing.T) {
+	storage := NewMemStorage()
+	db := NewDBWithStorage(storage)
+	initTestDB(t, db, nil)
+	var ids []string
+	for _, title := range []string{"one", "two", "three", "four", "five"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		mima.Password = "secret"
+		checkTestErr(t, db.Add(mima))
+		ids = append(ids, mima.ID)
+	}
+	checkTestErr(t, db.TrashByID(ids[3]))
+	fragments, err := storage.Fragments()
+	checkTestErr(t, err)
+	name, err := db.backup(fragments)
+	checkTestErr(t, err)
+
+	form := db.GetFormByID(ids[0])
+	form.Password = "changed"
+	checkTestErr(t, db.Update(form))
+	checkTestErr(t, db.DeleteForeverByID(ids[1]))
+	checkTestErr(t, db.TrashByID(ids[2]))
+	checkTestErr(t, db.UnDeleteByID(ids[3]))
+	six, err := NewMima("six")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(six))
+
+	for _, reveal := range []bool{false, true} {
+		result, err := db.Compare(name, CurrentVault, reveal)
+		checkTestErr(t, err)
+		kinds := make(map[string]string)
+		for _, change := range result.Changes {
+			kinds[change.Title] = change.Kind
+		}
+		want := map[string]string{
+			"one": ChangeModified, "two": ChangeRemoved, "three": ChangeTrashed,
+			"four": ChangeRestored, "six": ChangeAdded,
+		}
+		if !reflect.DeepEqual(kinds, want) || result.Unchanged != 1 {
+			t.Fatalf("Compare, want: %v, got: %v (unchanged: %d)", want, kinds, result.Unchanged)
+		}
+		password := result.Changes[len(result.Changes)-1]
+		for _, change := range result.Changes {
+			if change.Title == "one" {
+				password = change
+			}
+		}
+		got := password.Fields[0]
+		if got.Field != "Password" || (got.New == "changed") != reveal || (got.New == masked) == reveal {
+			t.Fatalf("Compare(reveal: %v), got: %+v", reveal, got)
+		}
+	}
+
+	db2 := NewDBWithStorage(storage)
+	if _, err := db2.CompareWithPassword(testPassword+"x", nil, name, CurrentVault, false); err == nil {
+		t.Fatal("密码错误时应返回错误")
+	}
+	result, err := db2.CompareWithPassword(testPassword, nil, CurrentVault, CurrentVault, false)
+	checkTestErr(t, err)
+	if len(result.Changes) != 0 || result.Unchanged != 5 {
+		t.Fatalf("与自身对比应没有变化, got: %v", result.Changes)
+	}
+
+	// 数据库文件夹以外的备份文件.
+	data, err := storage.ReadBackup(name)
+	checkTestErr(t, err)
+	dir, err := ioutil.TempDir("", "mimadb")
+	checkTestErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	checkTestErr(t, ioutil.WriteFile(path, data, 0644))
+	result, err = db2.CompareWithPassword(testPassword, nil, path, CurrentVault, false)
+	checkTestErr(t, err)
+	if len(result.Changes) != 5 || result.Unchanged != 1 {
+		t.Fatalf("用路径对比, got: %v (unchanged: %d)", result.Changes, result.Unchanged)
+	}
+	if _, err := db2.CompareWithPassword(
+		testPassword, nil, filepath.Join(dir, "missing"+TarballExt), CurrentVault, false); err == nil {
+		t.Fatal("路径不存在时应返回错误")
+	}
+}
+
+func TestRetention_Select(t *testing.T) {
+	day := func(year int, month time.Month, d, hour int) string {
+		nano := time.Date(year, month, d, hour, 0, 0, 0, time.Local).UnixNano()
+		return strconv.FormatInt(nano, 10) + TarballExt
+	}
+	names := []string{
+		day(2019, 11, 20, 9),
+		day(2019, 12, 30, 9),
+		day(2020, 1, 5, 9),
+		day(2020, 1, 6, 9),
+		day(2020, 1, 7, 9),
+		day(2020, 1, 7, 10),
+		day(2020, 1, 7, 11),
+		"not-a-timestamp" + TarballExt,
+	}
+	keep, prune := Retention{Last: 2, Daily: 2, Weekly: 2, Monthly: 2}.Select(names)
+	// Last: 最新的两个 (其中一个无法得出时间); Daily: 1/7 11 点, 1/6; Weekly: 1/7 11 点, 1/5;
+	// Monthly: 1/7 11 点, 2019/12/30.
+	want := []string{names[1], names[2], names[3], names[6], names[7]}
+	if !reflect.DeepEqual(keep, want) || !reflect.DeepEqual(prune, []string{names[0], names[4], names[5]}) {
+		t.Fatalf("Select, got: %v, %v", keep, prune)
+	}
+	if keep, prune := (Retention{}).Select(names); len(keep) != len(names) || prune != nil {
+		t.Fatal("保留策略全部为零时应保留全部备份文件")
+	}
+}
+
+// TestDB_Snapshot 测试定时备份: 没有修改时不备份, 备份后按保留策略删除旧的备份文件.
+func TestDB_Snapshot(t *testing.T) {
+	db := NewDBWithStorage(NewMemStorage())
+	db.Retention = Retention{Last: 2}
+	initTestDB(t, db, nil)
+	for i := 0; i < 3; i++ {
+		mima, err := NewMima(strconv.Itoa(i))
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+		name, pruned, err := db.Snapshot()
+		checkTestErr(t, err)
+		if name == "" || len(pruned) != 0 && i < 2 {
+			t.Fatalf("第 %d 次备份, got: %q, %v", i, name, pruned)
+		}
+	}
+	if name, _, err := db.Snapshot(); name != "" || err != nil {
+		t.Fatalf("没有修改时不应备份, got: %q, %v", name, err)
+	}
+	backups, err := db.Backups()
+	checkTestErr(t, err)
+	if len(backups) != 2 {
+		t.Fatalf("want: 2 个备份文件, got: %v", backups)
+	}
+	info, _, err := db.BackupEntries(backups[len(backups)-1])
+	checkTestErr(t, err)
+	if info.Records != 3 {
+		t.Fatalf("最新的备份应包括全部记录, got: %d", info.Records)
+	}
+
+	// 整合碎片时已经备份, 之后没有修改就不应再备份.
+	mima, err := NewMima("compacted")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(mima))
+	_, err = db.Compact()
+	checkTestErr(t, err)
+	if name, _, err := db.Snapshot(); name != "" || err != nil {
+		t.Fatalf("整合碎片后没有修改时不应备份, got: %q, %v", name, err)
+	}
+}
+
+// corruptStorage 写入备份文件时弄坏其中最后一个文件 (数据库文件) 的一个字节, 用于测试备份文件的校验.
+type corruptStorage struct {
+	*MemStorage
+}
+
+func (s corruptStorage) WriteBackup(name string, data []byte) error {
+	files, err := tarball.ReadFiles(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	files[len(files)-1].Data[0] ^= 0xff
+	var buf bytes.Buffer
+	if err := tarball.Write(&buf, files); err != nil {
+		return err
+	}
+	return s.MemStorage.WriteBackup(name, buf.Bytes())
+}
+
+func TestDB_VerifyBackup(t *testing.T) {
+	db := NewDBWithStorage(corruptStorage{NewMemStorage()})
+	initTestDB(t, db, nil)
+	if _, err := db.backup(nil); err == nil {
+		t.Fatal("want: 备份文件校验失败")
+	}
+	backups, err := db.Backups()
+	checkTestErr(t, err)
+	if len(backups) != 0 {
+		t.Fatalf("校验失败的备份文件应被删除, got: %v", backups)
+	}
+}
+
+// TestDB_Fsck 在数据库文件和日志中制造各种问题, 检查 Fsck 能全部报告, 并且修复后只剩下不明文件.
+func TestDB_Fsck(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	var mimas []*Mima
+	for _, title := range []string{"one", "two", "three"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+		mimas = append(mimas, mima)
+	}
+	_, err := db.Compact()
+	checkTestErr(t, err)
+	report, err := db.Fsck(testPassword, nil, false, false)
+	checkTestErr(t, err)
+	if report.Records != 3 || len(report.Problems) != 0 {
+		t.Fatalf("want: 3 条记录, 没有问题, got: %d, %v", report.Records, report.Problems)
+	}
+
+	// 数据库文件: Title 为空, 重复的历史记录, 无法解密, 重复的 ID (同时未按更新时间排序).
+	mimas[1].Title = ""
+	mimas[0].History = []*History{{DateTime: "2020-01-01 00:00:00"}, {DateTime: "2020-01-01 00:00:00"}}
+	boxes, err := db.sealAll()
+	checkTestErr(t, err)
+	boxes[3][len(boxes[3])-1] ^= 1
+	dup := *mimas[0]
+	dup.UpdatedAt = 1
+	box, err := sealBox(db.header, &dup, db.key, dbSlot(len(boxes)))
+	checkTestErr(t, err)
+	boxes = append(boxes, box)
+	checkTestErr(t, db.saveVault(db.currentHeader(), boxes, db.key, nil))
+	// 日志: 引用不存在的记录的碎片.
+	ghost, err := NewMima("ghost")
+	checkTestErr(t, err)
+	checkTestErr(t, db.mimaTable.add(ghost))
+	checkTestErr(t, db.TrashByID(ghost.ID))
+	// 不明文件
+	checkTestErr(t, ioutil.WriteFile(filepath.Join(db.BackupDir, "orphan.txt"), nil, 0644))
+
+	report, err = db.Fsck(testPassword, nil, false, false)
+	checkTestErr(t, err)
+	problems := strings.Join(report.Problems, "\n")
+	for _, want := range []string{
+		"Title 为空", "重复的历史记录", "无法解密", "id 与前面的记录重复", "未按更新时间排序",
+		"无法应用", "不明文件: orphan.txt",
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("want: %s, got: %v", want, problems)
+		}
+	}
+	if report.Records != 4 || report.Fragments != 1 || report.Backup != "" {
+		t.Fatalf("got: %+v", report)
+	}
+
+	report, err = db.Fsck(testPassword, nil, true, false)
+	checkTestErr(t, err)
+	if report.Backup == "" || !db.IsNotInit() {
+		t.Fatal("修复前应先备份, 修复后应清空内存数据库")
+	}
+	_, err = db.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	one, err := db.GetByID(mimas[0].ID)
+	checkTestErr(t, err)
+	if db.Len() != 3 || len(one.History) != 1 || db.GetFormByID(mimas[1].ID).Title != untitled {
+		t.Fatalf("修复结果不对, db.Len() want: 3, got: %d", db.Len())
+	}
+	report, err = db.Fsck(testPassword, nil, false, false)
+	checkTestErr(t, err)
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "orphan.txt") {
+		t.Fatalf("修复后应只剩下不明文件, got: %v", report.Problems)
+	}
+
+	// 校验码不符时, 未经确认不修复 (否则等于把篡改过的内容重新签名), 确认后只保留能解密的记录.
+	content, err := ioutil.ReadFile(db.FullPath)
+	checkTestErr(t, err)
+	content[len(content)-1] ^= 1
+	checkTestErr(t, ioutil.WriteFile(db.FullPath, content, 0644))
+	report, err = db.Fsck(testPassword, nil, true, false)
+	if !errors.Is(err, ErrNeedAcceptTampered) || !report.Tampered || report.Backup != "" {
+		t.Fatalf("want: %v, got: %v, %+v", ErrNeedAcceptTampered, err, report)
+	}
+	unchanged, err := ioutil.ReadFile(db.FullPath)
+	checkTestErr(t, err)
+	if !bytes.Equal(unchanged, content) {
+		t.Fatal("未经确认不应修改数据库文件")
+	}
+	report, err = db.Fsck(testPassword, nil, true, true)
+	checkTestErr(t, err)
+	if report.Backup == "" {
+		t.Fatal("确认后应先备份再修复")
+	}
+	_, err = db.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db.Len() != 3 {
+		t.Fatalf("db.Len(), want: 3, got: %d", db.Len())
+	}
+}
+
+// TestDB_Salvage 弄坏数据库文件的文件头, 一条记录的内容和另一条记录的长度, 然后抢救:
+// 文件头取自备份文件, 被修改过的记录取自碎片, 其余丢失的记录取自备份文件.
+func TestDB_Salvage(t *testing.T) {
+	db := newTestDB(t)
+	initTestDB(t, db, nil)
+	var ids []string
+	for _, title := range []string{"one", "two", "three"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+		ids = append(ids, mima.ID)
+	}
+	_, err := db.Compact() // 整合前的备份中有这三条记录 (在日志中)
+	checkTestErr(t, err)
+	four, err := NewMima("four")
+	checkTestErr(t, err)
+	checkTestErr(t, db.Add(four))
+	form := db.GetFormByID(ids[0])
+	form.Title = "one (updated)"
+	checkTestErr(t, db.Update(form))
+
+	data, err := ioutil.ReadFile(db.FullPath)
+	checkTestErr(t, err)
+	header, body := splitVault(data)
+	if header == nil {
+		t.Fatal("want: 文件头完好")
+	}
+	var offsets []int // 每条记录在 data 中的位置
+	for rest := body; len(rest) > 0; {
+		offsets = append(offsets, len(data)-len(rest))
+		_, rest, _ = nextRecord(rest)
+	}
+	data[offsets[1]+10] ^= 1                       // one 的内容
+	copy(data[offsets[2]:], []byte{0, 0xff, 0, 0}) // two 的长度
+	data[bytes.IndexByte(data, '{')] = 'x'         // 文件头
+	checkTestErr(t, ioutil.WriteFile(db.FullPath, data, 0644))
+	if _, err := NewDB(db.FullPath, db.BackupDir).Rebuild(testPassword, nil); err == nil {
+		t.Fatal("want: 数据库文件损坏, 无法登入")
+	}
+
+	report, err := db.Salvage(testPassword, nil)
+	checkTestErr(t, err)
+	lost := strings.Join(report.Lost, "\n")
+	if !strings.Contains(lost, "文件头") || !strings.Contains(lost, "第 1 至 2 条记录无法读取") {
+		t.Fatalf("Lost, got: %v", report.Lost)
+	}
+	if report.Recovered != 3 || len(report.FromBackups) != 1 || !strings.Contains(report.FromBackups[0], ids[1]) {
+		t.Fatalf("Recovered want: 3, got: %d, FromBackups: %v", report.Recovered, report.FromBackups)
+	}
+	if report.Backup == "" || !db.IsNotInit() {
+		t.Fatal("抢救前应先备份, 抢救后应清空内存数据库")
+	}
+	_, err = db.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	if db.Len() != 5 || db.GetFormByID(ids[0]).Title != "one (updated)" || db.GetFormByID(ids[1]).Title != "two" {
+		t.Fatalf("抢救结果不对, db.Len() want: 5, got: %d", db.Len())
+	}
+	// 备份文件中的恢复密钥等其他 key slot 不应随文件头一起复活.
+	if len(db.header.Slots) != 1 || db.HasRecoveryKey() {
+		t.Fatalf("want: 只有一个密码 key slot, got: %d 个 key slot", len(db.header.Slots))
+	}
+	fsck, err := db.Fsck(testPassword, nil, false, false)
+	checkTestErr(t, err)
+	if len(fsck.Problems) != 0 {
+		t.Fatalf("抢救后应没有问题, got: %v", fsck.Problems)
+	}
+}
+
+// TestDB_Indexes 测试新增, 修改 Alias, 软删除, 还原, 彻底删除之后, 凭 ID 和 Alias 查找以及排序都正确,
+// 并且重新登入 (整合碎片) 后索引与登入前一致.
+func TestDB_Indexes(t *testing.T) {
+	db := NewDBWithStorage(NewMemStorage())
+	initTestDB(t, db, nil)
+	var ids []string
+	for _, title := range []string{"one", "two", "three", "four"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+		ids = append(ids, mima.ID)
+	}
+	for _, id := range ids[:3] {
+		form := db.GetFormByID(id)
+		form.Alias = "shared"
+		checkTestErr(t, db.Update(form))
+	}
+	form := db.GetFormByID(ids[0])
+	form.Alias = "moved"
+	form.Notes = "moved to the end"
+	checkTestErr(t, db.Update(form))
+	checkTestErr(t, db.TrashByID(ids[1]))
+	checkTestErr(t, db.TrashByID(ids[2]))
+	checkTestErr(t, db.UnDeleteByID(ids[2]))
+	checkTestErr(t, db.DeleteForeverByID(ids[3]))
+
+	check := func(db *DB) {
+		t.Helper()
+		if shared := db.GetByAlias("shared"); len(shared) != 1 || shared[0].ID != ids[2] {
+			t.Fatalf("GetByAlias(shared), want: [%s], got: %v", ids[2], shared)
+		}
+		if moved := db.GetByAlias("moved"); len(moved) != 1 || moved[0].ID != ids[0] {
+			t.Fatalf("GetByAlias(moved), want: [%s], got: %v", ids[0], moved)
+		}
+		if _, err := db.GetByID(ids[3]); err == nil {
+			t.Fatal("want: 找不到已彻底删除的记录, got: no error")
+		}
+		all := db.All()
+		if len(all) != 2 || all[0].ID != ids[0] || all[1].ID != ids[2] {
+			t.Fatalf("All(), want: [%s %s], got: %v", ids[0], ids[2], all)
+		}
+		if deleted := db.DeletedMimas(); len(deleted) != 1 || deleted[0].ID != ids[1] {
+			t.Fatalf("DeletedMimas(), want: [%s], got: %v", ids[1], deleted)
+		}
+	}
+	check(db)
+	db2 := NewDBWithStorage(db.storage)
+	_, err := db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	check(db2)
+	db3 := NewDBWithStorage(db.storage)
+	_, err = db3.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	check(db3)
+}
+
+// failingStorage 在 fail 为真时无法写入日志文件, 用于测试写入碎片失败时内存数据库恢复原状.
+type failingStorage struct {
+	*MemStorage
+	fail *bool
+}
+
+func (s failingStorage) AppendJournal(head, entry []byte) error {
+	if *s.fail {
+		return errors.New("disk full")
+	}
+	return s.MemStorage.AppendJournal(head, entry)
+}
+
+// TestDB_WriteFragFailure 测试写入碎片失败时数据表 (包括顺序和索引) 恢复原状.
+func TestDB_WriteFragFailure(t *testing.T) {
+	var fail bool
+	db := NewDBWithStorage(failingStorage{MemStorage: NewMemStorage(), fail: &fail})
+	initTestDB(t, db, nil)
+	var ids []string
+	for _, title := range []string{"one", "two", "three"} {
+		mima, err := NewMima(title)
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+		ids = append(ids, mima.ID)
+	}
+	form := db.GetFormByID(ids[0])
+	form.Alias, form.Notes = "old", "moved to the end"
+	checkTestErr(t, db.Update(form))
+	ids = []string{ids[1], ids[2], ids[0]}
+
+	check := func(step string) {
+		t.Helper()
+		var got []string
+		for _, mima := range db.mimaTable.all()[1:] {
+			got = append(got, mima.ID)
+		}
+		if strings.Join(got, " ") != strings.Join(ids, " ") {
+			t.Fatalf("%s 之后, 记录的顺序, want: %v, got: %v", step, ids, got)
+		}
+		if old := db.GetByAlias("old"); len(old) != 1 || old[0].ID != ids[2] {
+			t.Fatalf("%s 之后, GetByAlias(old), want: [%s], got: %v", step, ids[2], old)
+		}
+		if len(db.GetByAlias("new")) != 0 {
+			t.Fatalf("%s 之后, GetByAlias(new) 应为空", step)
+		}
+	}
+	check("准备")
+
+	fail = true
+	mima, err := NewMima("four")
+	checkTestErr(t, err)
+	if err := db.Add(mima); err == nil {
+		t.Fatal("Add, want: error, got: no error")
+	}
+	check("Add")
+	form = db.GetFormByID(ids[2])
+	form.Alias, form.Notes = "new", "changed"
+	if err := db.Update(form); err == nil {
+		t.Fatal("Update, want: error, got: no error")
+	}
+	check("Update")
+	if db.GetFormByID(ids[2]).Notes != "moved to the end" {
+		t.Fatal("Update 失败后内容应恢复原状")
+	}
+	if err := db.DeleteForeverByID(ids[0]); err == nil {
+		t.Fatal("DeleteForeverByID, want: error, got: no error")
+	}
+	check("DeleteForeverByID")
+}
+
+// TestDB_ParallelDecrypt 测试并行解密时结果的顺序, 出错时返回的错误, 以及整合碎片的结果都与逐条解密相同.
+func TestDB_ParallelDecrypt(t *testing.T) {
+	defer func(n int) { DecryptWorkers = n }(DecryptWorkers)
+	DecryptWorkers = 4
+
+	results := make([]int, 100)
+	err := parallel(len(results), func(i int) error {
+		results[i] = i * i
+		if i >= 37 && i%2 == 1 {
+			return fmt.Errorf("error %d", i)
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "error 37" {
+		t.Fatalf("want: error 37, got: %v", err)
+	}
+	for i := 0; i <= 37; i++ {
+		if results[i] != i*i {
+			t.Fatalf("results[%d], want: %d, got: %d", i, i*i, results[i])
+		}
+	}
+
+	db := NewDBWithStorage(NewMemStorage())
+	initTestDB(t, db, nil)
+	for i := 0; i < 50; i++ {
+		mima, err := NewMima(fmt.Sprintf("title %d", i))
+		checkTestErr(t, err)
+		checkTestErr(t, db.Add(mima))
+	}
+	checkTestErr(t, db.TrashByID(db.GetByIndex(10).ID))
+	db2 := NewDBWithStorage(db.storage)
+	_, err = db2.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	db3 := NewDBWithStorage(db.storage)
+	_, err = db3.Rebuild(testPassword, nil)
+	checkTestErr(t, err)
+	for _, other := range []*DB{db2, db3} {
+		if other.Len() != db.Len() {
+			t.Fatalf("Len(), want: %d, got: %d", db.Len(), other.Len())
+		}
+		for i, mima := range db.MimaTable() {
+			got := other.GetByIndex(i)
+			if got.ID != mima.ID || got.IsDeleted() != mima.IsDeleted() {
+				t.Fatalf("第 %d 条记录, want: %s, got: %s", i, mima.ID, got.ID)
+			}
+		}
+	}
+}
+
+// newBenchStorage 生成一个 MemStorage, 其中的数据库先新增 inserts 条记录, 再依次修改 updates 次
+// (每次修改都会生成一条历史记录). 全部碎片保留在日志中, 不整合.
+func newBenchStorage(b *testing.B, inserts, updates int) *MemStorage {
+	storage := NewMemStorage()
+	db := NewDBWithStorage(storage)
+	db.CompactAfter = 0
+	_, err := db.Init(testPassword, nil)
+	checkTestErr(b, err)
+	var ids []string
+	for i := 0; i < inserts; i++ {
+		mima, err := NewMima(fmt.Sprintf("title %d", i))
+		checkTestErr(b, err)
+		mima.ID = strconv.Itoa(i) // 瞬间生成几万个 NewID 有可能重复.
+		mima.Notes = strings.Repeat("n", 200)
+		checkTestErr(b, db.Add(mima))
+		ids = append(ids, mima.ID)
+	}
+	for i := 0; i < updates; i++ {
+		form := db.GetFormByID(ids[i*7%len(ids)])
+		form.Notes = strconv.Itoa(i)
+		checkTestErr(b, db.Update(form))
+	}
+	return storage
+}
+
+// benchWorkers 分别以逐条解密 (原来的做法) 和并行解密运行 bench, 以便对比.
+func benchWorkers(b *testing.B, bench func(b *testing.B)) {
+	defer func(n int) { DecryptWorkers = n }(DecryptWorkers)
+	workerCounts := []int{1}
+	if n := runtime.NumCPU(); n > 1 {
+		workerCounts = append(workerCounts, n)
+	}
+	for _, workers := range workerCounts {
+		DecryptWorkers = workers
+		b.Run(fmt.Sprintf("workers=%d", workers), bench)
+	}
+}
+
+// BenchmarkDB_Replay 测试登入时整合一万个数据库碎片 (2000 次新增, 8000 次修改) 的速度,
+// 不包括解锁数据库文件的时间.
+func BenchmarkDB_Replay(b *testing.B) {
+	storage := newBenchStorage(b, 2000, 8000)
+	names, err := storage.Fragments()
+	checkTestErr(b, err)
+
+	benchWorkers(b, func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			tmp := NewDBWithStorage(storage)
+			checkTestErr(b, tmp.readFullPath(testPassword, nil))
+			b.StartTimer()
+			checkTestErr(b, tmp.readFragFilesAndUpdate(names))
+			if tmp.Len() != 2001 {
+				b.Fatalf("tmp.Len(), want: 2001, got: %d", tmp.Len())
+			}
+		}
+	})
+}
+
+// BenchmarkDB_ReadFullPath 测试解锁并读取一个有两万条记录 (每条都有历史记录) 的数据库文件的速度.
+func BenchmarkDB_ReadFullPath(b *testing.B) {
+	storage := newBenchStorage(b, 20000, 20000)
+	db := NewDBWithStorage(storage)
+	_, err := db.Rebuild(testPassword, nil)
+	checkTestErr(b, err)
+
+	benchWorkers(b, func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tmp := NewDBWithStorage(storage)
+			checkTestErr(b, tmp.readFullPath(testPassword, nil))
+			if tmp.Len() != 20001 {
+				b.Fatalf("tmp.Len(), want: 20001, got: %d", tmp.Len())
+			}
+		}
+	})
+}
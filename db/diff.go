@@ -0,0 +1,216 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// 对比两个备份文件, 或者一个备份文件与当前的数据库 (数据库文件连同尚未整合的碎片):
+//
+// 两者都用同一个内部密码读取 (详见 openBackup), 逐条对比记录, 报告新增, 彻底删除,
+// 移到回收站, 从回收站还原以及修改了的记录, 修改的内容逐个字段列出.
+// 密码和备注 (可能含有敏感信息, 详见 HideSecrets) 默认不显示内容, 只显示是否有修改.
+
+// CurrentVault 表示当前的数据库, 可代替备份文件的文件名用于 Compare.
+const CurrentVault = "current"
+
+// 两次之间一条记录的变化.
+const (
+	ChangeAdded    = "新增"
+	ChangeRemoved  = "彻底删除"
+	ChangeTrashed  = "移到回收站"
+	ChangeRestored = "从回收站还原"
+	ChangeModified = "修改"
+)
+
+// masked 代替不显示的密码和备注.
+const masked = "******"
+
+// FieldChange 是一个字段的修改.
+type FieldChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// EntryChange 是一条记录的变化 (Kind), 以及修改了的字段 (移到回收站或还原的同时也可能有修改).
+type EntryChange struct {
+	ID     string
+	Title  string
+	Kind   string
+	Fields []*FieldChange
+}
+
+// Comparison 是 Compare 的结果. Unchanged 是没有变化的记录数量.
+type Comparison struct {
+	From      string
+	To        string
+	Changes   []*EntryChange
+	Unchanged int
+}
+
+// openSnapshot 用当前的内部密码读取备份文件 name (或者 CurrentVault), 返回一个只在内存中的 DB.
+func (db *DB) openSnapshot(name string) (*DB, error) {
+	if name != CurrentVault {
+		snap, _, err := db.openBackup(name)
+		return snap, err
+	}
+	snap := NewDBWithStorage(db.storage)
+	if err := snap.readWithKey(db.key); err != nil {
+		return nil, err
+	}
+	names, err := snap.storage.Fragments()
+	if err == nil {
+		err = snap.readFragFilesAndUpdate(names)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Compare 对比 from 和 to (备份文件的文件名或 CurrentVault) 中的记录 (第一条记录除外).
+// 变化按 to 中的更新时间排列 (最新的在前面), 彻底删除的记录排在最后. reveal 为真时显示密码和备注的内容.
+func (db *DB) Compare(from, to string, reveal bool) (*Comparison, error) {
+	if db.key == nil {
+		return nil, errors.New("内存中的数据库没有数据, 请先登入")
+	}
+	before, err := db.openSnapshot(from)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", from, err)
+	}
+	after, err := db.openSnapshot(to)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", to, err)
+	}
+	return compare(before, after, from, to, reveal), nil
+}
+
+// compare 对比 before 和 after 中的记录, from 和 to 是它们的名称 (详见 Compare).
+func compare(before, after *DB, from, to string, reveal bool) *Comparison {
+	result := &Comparison{From: from, To: to}
+	after.mimaTable.reverse(func(mima *Mima) {
+		old, err := before.GetByID(mima.ID)
+		if err != nil {
+			result.add(nil, mima, ChangeAdded, reveal)
+			return
+		}
+		kind := ChangeModified
+		switch {
+		case !old.IsDeleted() && mima.IsDeleted():
+			kind = ChangeTrashed
+		case old.IsDeleted() && !mima.IsDeleted():
+			kind = ChangeRestored
+		}
+		if !result.add(old, mima, kind, reveal) {
+			result.Unchanged++
+		}
+	})
+	before.mimaTable.reverse(func(mima *Mima) {
+		if _, err := after.GetByID(mima.ID); err != nil {
+			result.add(mima, nil, ChangeRemoved, reveal)
+		}
+	})
+	return result
+}
+
+// CompareWithPassword 用 password 和 keyfile 解锁数据库 (不影响内存数据库) 后进行对比 (详见 Compare), 用于命令行.
+// 与 Compare 不同, from 和 to 也可以是备份文件的路径 (含有文件夹), 比如复制到别处的备份文件
+// (必须采用当前的内部密码, 详见 openBackup). 只有文件名时仍在数据库文件夹中查找.
+func (db *DB) CompareWithPassword(password string, keyfile []byte, from, to string, reveal bool) (*Comparison, error) {
+	tmp := NewDBWithStorage(db.storage)
+	header, boxes, err := tmp.loadVault()
+	if err != nil {
+		return nil, err
+	}
+	if tmp.key, _, _, _, err = unlockVault(header, boxes, password, keyfile); err != nil {
+		return nil, err
+	}
+	before, err := tmp.openSnapshotPath(from)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", from, err)
+	}
+	after, err := tmp.openSnapshotPath(to)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", to, err)
+	}
+	return compare(before, after, from, to, reveal), nil
+}
+
+// openSnapshotPath 与 openSnapshot 相同, 但 name 含有文件夹时直接读取该路径的备份文件.
+func (db *DB) openSnapshotPath(name string) (*DB, error) {
+	if filepath.Base(name) == name {
+		return db.openSnapshot(name)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	snap, _, err := db.openBackupData(filepath.Base(name), data)
+	return snap, err
+}
+
+// add 对比一条记录在前后两次的内容 (nil 表示不存在), 如有变化就记入结果, 返回是否有变化.
+// 新增或彻底删除的记录列出全部非空字段.
+func (result *Comparison) add(old, mima *Mima, kind string, reveal bool) bool {
+	var empty Mima
+	change := &EntryChange{Kind: kind}
+	switch {
+	case old == nil:
+		change.ID, change.Title, old = mima.ID, mima.Title, &empty
+	case mima == nil:
+		change.ID, change.Title, mima = old.ID, old.Title, &empty
+	default:
+		change.ID, change.Title = mima.ID, mima.Title
+	}
+	field := func(name, oldValue, newValue string, secret bool) {
+		if oldValue == newValue {
+			return
+		}
+		if secret && !reveal {
+			oldValue, newValue = maskValue(oldValue), maskValue(newValue)
+		}
+		change.Fields = append(change.Fields, &FieldChange{Field: name, Old: oldValue, New: newValue})
+	}
+	field("Title", old.Title, mima.Title, false)
+	field("Alias", old.Alias, mima.Alias, false)
+	field("Username", old.Username, mima.Username, false)
+	field("Password", old.Password, mima.Password, true)
+	field("Notes", old.Notes, mima.Notes, true)
+	field("History", historyCount(old), historyCount(mima), false)
+
+	if kind == ChangeModified && len(change.Fields) == 0 {
+		return false
+	}
+	result.Changes = append(result.Changes, change)
+	return true
+}
+
+// maskValue 隐藏密码或备注的内容, 只保留是否为空.
+func maskValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return masked
+}
+
+// historyCount 用于对比历史记录的数量.
+func historyCount(mima *Mima) string {
+	if len(mima.History) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d 条", len(mima.History))
+}
+
+// String 把一条记录的变化转换为一行或多行文字, 用于命令行.
+func (change *EntryChange) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s (id: %s)", change.Kind, change.Title, change.ID)
+	for _, f := range change.Fields {
+		fmt.Fprintf(&b, "\n    %s: %q -> %q", f.Field, f.Old, f.New)
+	}
+	return b.String()
+}
@@ -0,0 +1,260 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// 全面检查数据库 (fsck):
+//
+// Inspect 只检查校验码和校验链, 并且数据库文件中只要有一条记录无法解密就无法继续检查.
+// Fsck 则逐条解密数据库文件中的记录和每一个数据库碎片, 一处出错不影响检查其余部分,
+// 并检查记录的内容 (重复的 ID, 空的 Title 等), 以及数据库文件夹中的不明文件.
+// 可选择修复: 跳过无法修复的部分, 重写数据库文件 (修复前先备份).
+// 修复时只采用能通过解密验证 (AEAD) 的记录和碎片, 并报告被丢弃的部分.
+// 数据库文件的校验码或碎片的校验链不符时, 修复等于把现有内容重新签名为可信内容,
+// 因此必须另外确认 (acceptTampered) 才会修复.
+
+// untitled 是修复时给 Title 为空的记录补上的 Title.
+const untitled = "(无标题)"
+
+// ErrNeedAcceptTampered 表示校验码或校验链不符, 未经确认不能修复 (详见 Fsck).
+var ErrNeedAcceptTampered = errors.New(
+	"数据库文件的校验码或碎片的校验链不符, 内容可能已被篡改 (或有碎片缺失). " +
+		"修复会把现有内容重新签名为可信内容, 因此需要确认后才能修复")
+
+// FsckReport 是 Fsck 的检查结果.
+type FsckReport struct {
+	Records   int // 数据库文件中的记录数量 (不包括第一条记录)
+	Fragments int // 数据库碎片数量 (日志中的每个条目算一个碎片)
+	Problems  []string
+
+	// Tampered 表示数据库文件的校验码或碎片的校验链不符.
+	Tampered bool
+
+	// Dropped 是修复时不会写入数据库文件的内容 (无法解密的记录和碎片, 无法应用的碎片等).
+	Dropped []string
+
+	// 修复前的备份文件 (只有修复时才有).
+	Backup string
+}
+
+func (report *FsckReport) add(format string, a ...interface{}) {
+	report.Problems = append(report.Problems, fmt.Sprintf(format, a...))
+}
+
+// drop 记录一个问题, 同时说明修复时会丢弃该部分.
+func (report *FsckReport) drop(format string, a ...interface{}) {
+	report.add(format, a...)
+	report.Dropped = append(report.Dropped, report.Problems[len(report.Problems)-1])
+}
+
+// checkMima 检查一条记录 (或碎片中的记录) 的内容, where 用来说明它的位置.
+// 发现问题的同时修正内存中的 mima (修复时采用): Title 为空时补上 untitled,
+// 重复的历史记录只保留第一条 (历史记录由 Seq 和 DateTime 共同确定, 详见 History).
+func (report *FsckReport) checkMima(where string, mima *Mima) {
+	if strings.TrimSpace(mima.Title) == "" {
+		report.add("%s (id: %s) 的 Title 为空", where, mima.ID)
+		mima.Title = untitled
+	}
+	seen := make(map[string]bool)
+	history := mima.History[:0]
+	for _, h := range mima.History {
+		key := fmt.Sprintf("%d/%s", h.Seq, h.DateTime)
+		if seen[key] {
+			report.add("%s (id: %s) 有重复的历史记录: %s", where, mima.ID, h.DateTime)
+			continue
+		}
+		seen[key] = true
+		history = append(history, h)
+	}
+	mima.History = history
+}
+
+// Fsck 逐条解密并检查数据库文件和全部数据库碎片, 返回检查结果.
+// 报告的问题包括: 无法解密的记录和碎片, 重复的 ID, 引用不存在的记录的碎片, Title 为空的记录,
+// 重复的历史记录, 未按 UpdatedAt 排序的记录, 校验码和校验链的问题, 以及数据库文件夹中的不明文件.
+//
+// 不影响内存数据库. 如果 repair 为真并且发现问题, 就先备份, 然后用能够读取的记录和碎片
+// (修正后的内容, 重复的 ID 只保留最新的一条) 重写数据库文件, 并删除已整合的碎片 (不明文件不会删除).
+// 被丢弃的部分列在 FsckReport.Dropped 中. 修复后清空内存数据库, 需要重新登入.
+// 如果校验码或校验链不符 (FsckReport.Tampered), 只有 acceptTampered 为真才修复,
+// 否则返回检查结果和 ErrNeedAcceptTampered.
+func (db *DB) Fsck(password string, keyfile []byte, repair, acceptTampered bool) (*FsckReport, error) {
+	tmp := NewDBWithStorage(db.storage)
+	header, boxes, err := tmp.loadVault()
+	if err != nil {
+		return nil, err
+	}
+	key, _, first, slotID, err := unlockVault(header, boxes, password, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	if repair && header.isLegacy() {
+		return nil, errors.New("旧版数据库请先登入一次 (自动升级为当前格式) 再修复")
+	}
+	tmp.header, tmp.key, tmp.slotID = header, key, slotID
+	tmp.seq, tmp.chain = header.Seq, header.Chain
+
+	report := &FsckReport{Records: len(boxes) - 1}
+	if err := header.verifyMAC(key, boxes); err != nil {
+		report.add("%v", err)
+		report.Tampered = true
+	}
+	tmp.mimaTable = newTable(first)
+	tmp.fsckRecords(boxes, report)
+
+	names, err := tmp.storage.Fragments()
+	if err != nil {
+		return nil, err
+	}
+	frags, err := tmp.fsckFragments(names, report)
+	if err != nil {
+		return nil, err
+	}
+	if problems := tmp.chainProblems(frags); len(problems) > 0 {
+		report.Problems = append(report.Problems, problems...)
+		report.Tampered = true
+	}
+	for _, f := range frags {
+		report.checkMima("碎片 "+f.name, f.mima)
+		if f.meta != nil && f.meta.Seq <= header.Seq {
+			// 已整合过的旧碎片或重复的碎片 (chainProblems 已报告), 不可再应用.
+			report.Dropped = append(report.Dropped, fmt.Sprintf("碎片 %s (已整合过的旧碎片或重复的碎片)", f.name))
+			continue
+		}
+		if err := tmp.applyFrag(f); err != nil {
+			report.drop("碎片 %s 无法应用: %v", f.name, err)
+		}
+	}
+
+	if lister, ok := tmp.storage.(orphanLister); ok {
+		orphans, err := lister.Orphans()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range orphans {
+			report.add("数据库文件夹中有不明文件: %s", name)
+		}
+	}
+
+	if !repair || len(report.Problems) == 0 {
+		return report, nil
+	}
+	if report.Tampered && !acceptTampered {
+		return report, ErrNeedAcceptTampered
+	}
+	if report.Backup, err = tmp.backup(names); err != nil {
+		return report, err
+	}
+	if err := tmp.rewriteDBFile(names); err != nil && !errors.Is(err, errPendingCleanup) {
+		return report, err
+	}
+	db.Reset()
+	return report, nil
+}
+
+// fsckRecords 逐条 (并行) 解密数据库文件中的记录 (第一条除外), 检查后填充 db.mimaTable (详见 table.addLatest).
+func (db *DB) fsckRecords(boxes [][]byte, report *FsckReport) {
+	mimas := make([]*Mima, len(boxes))
+	errs := make([]error, len(boxes))
+	_ = parallel(len(boxes)-1, func(i int) error {
+		mimas[i+1], errs[i+1] = openBox(db.header, boxes[i+1], db.key, dbSlot(i+1))
+		return nil
+	})
+
+	seen := make(map[string]bool)
+	var records []*Mima
+	var lastUpdated int64
+	for i := 1; i < len(boxes); i++ {
+		if errs[i] != nil {
+			report.drop("数据库文件第 %d 条记录无法解密: %v", i, errs[i])
+			continue
+		}
+		mima := mimas[i]
+		where := fmt.Sprintf("数据库文件第 %d 条记录", i)
+		report.checkMima(where, mima)
+		if mima.UpdatedAt < lastUpdated {
+			report.add("%s (id: %s) 未按更新时间排序", where, mima.ID)
+		}
+		lastUpdated = mima.UpdatedAt
+		if seen[mima.ID] {
+			report.add("%s 的 id 与前面的记录重复: %s", where, mima.ID)
+			report.Dropped = append(report.Dropped,
+				fmt.Sprintf("id 为 %s 的重复记录 (只保留更新时间最新的一条)", mima.ID))
+		}
+		seen[mima.ID] = true
+		records = append(records, mima)
+	}
+	db.mimaTable.addLatest(records)
+}
+
+// fsckFragments 逐个读取并解密数据库碎片 (日志中的条目逐条解密), 返回能够读取的碎片.
+func (db *DB) fsckFragments(names []string, report *FsckReport) (frags []*fragment, err error) {
+	for _, name := range names {
+		if name != JournalName {
+			report.Fragments++
+			frag, err := db.readFragFile(name)
+			if err != nil {
+				report.drop("%v", err)
+				continue
+			}
+			frags = append(frags, frag)
+			continue
+		}
+		// 条目格式错误时仍检查此前的条目.
+		entries, size, fileSize, err := db.journalEntries()
+		if err != nil {
+			if !errors.Is(err, ErrTampered) {
+				return nil, err
+			}
+			report.drop("%v", err)
+		} else if size < fileSize {
+			report.Problems = append(report.Problems, tornTail(fileSize-size))
+		}
+		report.Fragments += len(entries)
+		for _, entry := range entries {
+			frag, err := db.openEntry(entry)
+			if err != nil {
+				report.drop("%v", err)
+				continue
+			}
+			frags = append(frags, frag)
+		}
+	}
+	return frags, nil
+}
+
+// orphanLister 由能够列出不明文件的 Storage 实现 (比如 FileStorage).
+type orphanLister interface {
+	Orphans() ([]string, error)
+}
+
+// Orphans 返回 BackupDir 中不属于本程序的文件 (以及文件夹) 的文件名,
+// 即数据库文件, 日志文件, 旧版碎片文件, 备份文件, 锁文件以及说明文件 (.md) 以外的文件.
+// 上次未完成的写入留下的临时文件在启动时已被清理 (详见 RecoverPendingWrites), 因此也算不明文件.
+func (s *FileStorage) Orphans() (orphans []string, err error) {
+	infos, err := ioutil.ReadDir(s.BackupDir)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{
+		filepath.Base(s.FullPath): true,
+		JournalName:               true,
+		LockFileName:              true,
+	}
+	for _, info := range infos {
+		name := info.Name()
+		switch {
+		case known[name]:
+		case strings.HasSuffix(name, FragExt), strings.HasSuffix(name, TarballExt):
+		case strings.HasSuffix(name, ".md"):
+		default:
+			orphans = append(orphans, name)
+		}
+	}
+	return orphans, nil
+}
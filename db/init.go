@@ -1,12 +1,10 @@
 package db
 
 import (
-	"bufio"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
-	"io/ioutil"
 	"math/big"
 	"os"
 	"strconv"
@@ -27,9 +25,10 @@ const (
 )
 
 var (
-	FileNotFound = errors.New("找不到数据库文件")
-	errNeedTitle = errors.New("'Title' 长度不可为零, 请填写 Title")
+	FileNotFound         = errors.New("找不到数据库文件")
+	errNeedTitle         = errors.New("'Title' 长度不可为零, 请填写 Title")
 	errCloudDataNotEqual = errors.New("NotEqual: (云端)数据与本地数据不一致")
+	errVaultChanged      = errors.New("数据库文件已被其他操作修改, 请重新登入")
 )
 
 type (
@@ -51,10 +50,6 @@ func randomString() string {
 	return base64.StdEncoding.EncodeToString(someBytes)
 }
 
-func writeFile(fullPath string, box64 string) error {
-	return ioutil.WriteFile(fullPath, []byte(box64), 0644)
-}
-
 func newNonce() (nonce Nonce, err error) {
 	_, err = rand.Read(nonce[:])
 	return
@@ -78,25 +73,22 @@ func bytesToKey(b []byte) (key SecretKey) {
 	return
 }
 
-func newTimestampFilename(ext string) string {
-	name := strconv.FormatInt(time.Now().UnixNano(), 10)
-	return name + ext
-}
-
-func readAndDecrypt(fullPath string, key *SecretKey) (mima *Mima, err error) {
-	var b []byte
-	if b, err = ioutil.ReadFile(fullPath); err != nil {
-		return
+// decodeKey 把 base64 格式的 key (保存在第一条记录的 Password 中) 转换为 SecretKey.
+func decodeKey(key64 string) (*SecretKey, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(key64)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyBytes) != KeySize {
+		return nil, errors.New("内部密码长度错误")
 	}
-	box64 := string(b)
-	return Decrypt(box64, key)
+	key := bytesToKey(keyBytes)
+	return &key, nil
 }
 
-func bufWriteln(w *bufio.Writer, box64 string) error {
-	if _, err := w.WriteString(box64 + "\n"); err != nil {
-		return err
-	}
-	return nil
+func newTimestampFilename(ext string) string {
+	name := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return name + ext
 }
 
 func DeleteFiles(filePaths []string) error {
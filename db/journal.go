@@ -0,0 +1,383 @@
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ahui2016/mima-go/util"
+)
+
+// 数据库日志 (journal):
+//
+// 每次修改 (Add, Update, Trash 等) 不再各自生成一个以时间戳命名的碎片文件
+// (文件名和修改时间会泄露操作的时间线, 文件多了也不好管理), 而是追加到同一个日志文件中.
+// 日志文件格式:
+//
+//	magic (8 bytes) | 条目 | 条目 | ...
+//
+// 每个条目的格式 (整数均采用 big endian, 校验和采用 CRC-32C):
+//
+//	内容长度 (uint32) | 内容长度的校验和 (uint32) | 内容 | 内容的校验和 (uint32)
+//
+// 内容由两条带长度前缀的记录组成: 序号和校验码 (FragMeta, json), 以及已加密的 mima.
+// 条目与旧版碎片一样构成校验链 (详见 chain.go), 已加密的 mima 以 journalSlot(序号) 作为附加认证数据.
+// 每次追加后立即 fsync. 如果追加时中断, 文件末尾会留下不完整的条目 (torn tail),
+// 这样的条目本来就没有生效 (追加未返回成功), 由 RecoverPendingWrites 截掉 (不需要密码).
+// 只有最后一个条目确实不完整 (长度的校验和正确, 但剩余数据不足) 才算 torn tail.
+// 校验和不符说明文件已损坏, 此时不截短, 而是拒绝启动, 由 Inspect 和 Fsck 报告
+// (跳过损坏的部分后仍能读取其后的条目, 详见 parseJournal).
+// 追加和截短由 Storage 负责 (详见 storage.go), 条目的格式则由 DB 负责.
+//
+// 旧版程序生成的 .db.frag 碎片文件仍可读取, 下次 Rebuild 时与日志一起整合到数据库文件中, 然后删除.
+// 较早版本的日志 (legacyJournalMagic) 的条目没有校验和, 同样只能读取, 登入时整合后删除,
+// 因此不会有新的条目追加到旧格式的日志中 (万一还未整合, AppendJournal 也会拒绝追加).
+
+// JournalName 是日志文件的文件名, 日志文件与旧版碎片文件一样放在 BackupDir 中 (采用 FileStorage 时).
+const JournalName = "mima.journal"
+
+// frameHeadSize 是条目开头的内容长度及其校验和的长度, frameSumSize 是内容的校验和的长度.
+const (
+	frameHeadSize = 8
+	frameSumSize  = 4
+)
+
+var (
+	journalMagic       = []byte("MIMA-JR\x01")
+	legacyJournalMagic = []byte("MIMA-JR\x00")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	errShortFrame = errors.New("条目不完整")
+	errBadFrame   = errors.New("条目的校验和不符")
+
+	// errJournalHead 表示日志文件的格式不是当前版本 (比如较早版本的日志), 不可追加新的条目.
+	errJournalHead = errors.New("日志文件不是当前版本的格式, 不可追加新的条目, 请重新登入以整合日志")
+)
+
+// journalEntry 是日志中的一个条目 (尚未解密). end 是条目在文件中的结束位置.
+type journalEntry struct {
+	meta   *FragMeta
+	sealed []byte
+	end    int64
+}
+
+func (s *FileStorage) journalPath() string {
+	return filepath.Join(s.BackupDir, JournalName)
+}
+
+// encodeEntry 把序号, 校验码和已加密的数据合并为一个条目 (加上内容长度和校验和).
+func encodeEntry(meta *FragMeta, sealed []byte) ([]byte, error) {
+	body, err := encodeRecords(meta, sealed)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 4, frameHeadSize+len(body)+frameSumSize)
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	frame = appendChecksum(frame, frame[:4])
+	frame = append(frame, body...)
+	return appendChecksum(frame, body), nil
+}
+
+// encodeRecords 把序号, 校验码和已加密的数据编码为两条带长度前缀的记录 (即条目的内容).
+func encodeRecords(meta *FragMeta, sealed []byte) ([]byte, error) {
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeRecord(&buf, metaJSON); err != nil {
+		return nil, err
+	}
+	if err := writeRecord(&buf, sealed); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// appendChecksum 把 data 的校验和追加到 b 的末尾.
+func appendChecksum(b, data []byte) []byte {
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(data, crcTable))
+	return append(b, sum[:]...)
+}
+
+func validChecksum(sum, data []byte) bool {
+	return binary.BigEndian.Uint32(sum) == crc32.Checksum(data, crcTable)
+}
+
+// nextFrame 从 data 开头取出一个条目并解析其内容. 剩余数据不足一个完整的条目 (并且内容长度的
+// 校验和正确, 或者连内容长度都不完整) 时返回 errShortFrame, 校验和不符或内容格式错误时返回 errBadFrame.
+func nextFrame(data []byte) (entry *journalEntry, rest []byte, err error) {
+	if len(data) < frameHeadSize {
+		return nil, nil, errShortFrame
+	}
+	if !validChecksum(data[4:frameHeadSize], data[:4]) {
+		return nil, nil, errBadFrame
+	}
+	size := uint64(binary.BigEndian.Uint32(data))
+	if uint64(len(data)) < frameHeadSize+size+frameSumSize {
+		return nil, nil, errShortFrame
+	}
+	body := data[frameHeadSize : frameHeadSize+size]
+	rest = data[frameHeadSize+size:]
+	if !validChecksum(rest[:frameSumSize], body) {
+		return nil, nil, errBadFrame
+	}
+	metaJSON, afterMeta, ok := nextRecord(body)
+	if !ok {
+		return nil, nil, errBadFrame
+	}
+	sealed, afterSealed, ok := nextRecord(afterMeta)
+	if !ok || len(afterSealed) > 0 {
+		return nil, nil, errBadFrame
+	}
+	meta := new(FragMeta)
+	if err := json.Unmarshal(metaJSON, meta); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errBadFrame, err)
+	}
+	return &journalEntry{meta: meta, sealed: sealed}, rest[frameSumSize:], nil
+}
+
+// nextRecord 从 data 开头取出一条带长度前缀的记录. 剩余数据不足一条完整的记录时 ok 为 false.
+func nextRecord(data []byte) (record, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	size := uint64(binary.BigEndian.Uint32(data))
+	if uint64(len(data)-4) < size {
+		return nil, nil, false
+	}
+	return data[4 : 4+size], data[4+size:], true
+}
+
+// journalEntries 读取日志文件中的全部完整条目 (不需要密码, 不检查校验码).
+// size 是最后一个完整条目的结束位置, 如果小于文件长度 fileSize, 说明文件末尾有不完整的条目.
+// 日志文件不存在时全部返回零值.
+func (db *DB) journalEntries() (entries []*journalEntry, size, fileSize int64, err error) {
+	data, err := db.storage.ReadFragment(JournalName)
+	if isNotExist(err) {
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return parseJournal(data)
+}
+
+// parseJournal 解析日志文件的内容, 详见 journalEntries.
+// 遇到损坏的条目 (校验和不符) 时, 逐字节向后寻找下一个完整的条目并继续解析,
+// 最后返回全部能够读取的条目, 以及说明跳过了哪些部分的错误 (ErrTampered, 供 Fsck 和抢救时使用).
+// 此时 size 仍是最后一个完整条目的结束位置, 但文件末尾并不是 torn tail, 不可截掉.
+func parseJournal(data []byte) (entries []*journalEntry, size, fileSize int64, err error) {
+	fileSize = int64(len(data))
+	if len(data) < len(journalMagic) && bytes.HasPrefix(journalMagic, data) {
+		// 刚建立日志文件时中断, 连 magic 都不完整.
+		return nil, 0, fileSize, nil
+	}
+	if bytes.HasPrefix(data, legacyJournalMagic) {
+		return parseLegacyJournal(data)
+	}
+	if !bytes.HasPrefix(data, journalMagic) {
+		return nil, 0, fileSize, fmt.Errorf("%w: 日志文件格式错误", ErrTampered)
+	}
+	rest := data[len(journalMagic):]
+	size = int64(len(journalMagic))
+	var damaged []string
+	for len(rest) > 0 {
+		entry, after, err := nextFrame(rest)
+		if err == errShortFrame {
+			break
+		}
+		if err != nil {
+			skip := resyncJournal(rest)
+			damaged = append(damaged, fmt.Sprintf("第 %d 至 %d 字节 (%v)",
+				fileSize-int64(len(rest)), fileSize-int64(len(rest))+int64(skip)-1, err))
+			rest = rest[skip:]
+			continue
+		}
+		rest = after
+		size = fileSize - int64(len(rest))
+		entry.end = size
+		entries = append(entries, entry)
+	}
+	if len(damaged) > 0 {
+		err = fmt.Errorf("%w: 日志文件已损坏 (不是写入时中断), 无法读取%s", ErrTampered, strings.Join(damaged, ", "))
+	}
+	return entries, size, fileSize, err
+}
+
+// resyncJournal 返回 data 中下一个完整条目的位置 (跳过 data 开头损坏的条目). 找不到时返回 len(data).
+func resyncJournal(data []byte) int {
+	for i := 1; i < len(data); i++ {
+		if _, _, err := nextFrame(data[i:]); err == nil {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// parseLegacyJournal 解析较早版本的日志 (条目没有校验和, 只有内容的两条记录).
+// 条目格式错误时, 除了错误, 还返回此前已解析的条目.
+func parseLegacyJournal(data []byte) (entries []*journalEntry, size, fileSize int64, err error) {
+	fileSize = int64(len(data))
+	rest := data[len(legacyJournalMagic):]
+	size = int64(len(legacyJournalMagic))
+	for len(rest) > 0 {
+		metaJSON, afterMeta, ok := nextRecord(rest)
+		if !ok {
+			break
+		}
+		sealed, afterSealed, ok := nextRecord(afterMeta)
+		if !ok {
+			break
+		}
+		meta := new(FragMeta)
+		if err := json.Unmarshal(metaJSON, meta); err != nil {
+			return entries, size, fileSize, fmt.Errorf("%w: 日志第 %d 个条目格式错误: %v", ErrTampered, len(entries)+1, err)
+		}
+		rest = afterSealed
+		size = fileSize - int64(len(rest))
+		entries = append(entries, &journalEntry{meta: meta, sealed: sealed, end: size})
+	}
+	return entries, size, fileSize, nil
+}
+
+// readJournal 读取并 (并行) 解密日志中的全部完整条目, 并检查每个条目的校验码 (校验链由 chainProblems 检查).
+// 文件末尾不完整的条目 (如有) 没有生效, 直接忽略.
+func (db *DB) readJournal() ([]*fragment, error) {
+	entries, _, _, err := db.journalEntries()
+	if err != nil {
+		return nil, err
+	}
+	frags := make([]*fragment, len(entries))
+	err = parallel(len(entries), func(i int) (err error) {
+		frags[i], err = db.openEntry(entries[i])
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return frags, nil
+}
+
+// openEntry 检查日志中一个条目的校验码并解密.
+func (db *DB) openEntry(entry *journalEntry) (*fragment, error) {
+	meta := entry.meta
+	name := fmt.Sprintf("%s#%d", JournalName, meta.Seq)
+	if !hmac.Equal(meta.MAC, fragMAC(db.key, meta, entry.sealed)) {
+		return nil, fmt.Errorf("%w: 日志条目 %s 的校验码不符", ErrTampered, name)
+	}
+	mima, err := openBox(db.header, entry.sealed, db.key, journalSlot(meta.Seq))
+	if err != nil {
+		return nil, fmt.Errorf("%w: 日志条目 %s: %v", ErrTampered, name, err)
+	}
+	return &fragment{name: name, meta: meta, mima: mima}, nil
+}
+
+// appendJournal 把一个条目追加到日志文件末尾 (详见 Storage.AppendJournal).
+func (db *DB) appendJournal(meta *FragMeta, sealed []byte) error {
+	entry, err := encodeEntry(meta, sealed)
+	if err != nil {
+		return err
+	}
+	return db.storage.AppendJournal(journalMagic, entry)
+}
+
+// repairJournal 截掉日志文件末尾不完整的条目 (不需要密码). 截掉了才返回 true.
+// 日志文件损坏时 (详见 parseJournal) 不截短任何数据, 返回 ErrTampered.
+// 较早版本的日志无法区分不完整的条目与损坏的长度前缀, 因此也不截短
+// (末尾不完整的条目在读取时被忽略, 登入时先备份再整合).
+func (db *DB) repairJournal() (repaired bool, err error) {
+	data, err := db.storage.ReadFragment(JournalName)
+	if isNotExist(err) {
+		return false, nil
+	}
+	if err != nil || bytes.HasPrefix(data, legacyJournalMagic) {
+		return false, err
+	}
+	_, size, fileSize, err := parseJournal(data)
+	if err != nil {
+		return false, fmt.Errorf("%w. 已保留日志文件, 请用 -fsck 或 -salvage 检查和修复", err)
+	}
+	if size == fileSize {
+		return false, nil
+	}
+	if err := db.storage.TruncateJournal(size); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// AppendJournal 把 entry 追加到日志文件末尾并 fsync. 日志文件不存在时新建, 并先写入 head.
+// 出错时把文件截回原来的长度, 以免之后的条目接在不完整的条目后面.
+// 日志文件不以 head 开头时 (比如较早版本的日志) 不追加, 返回 errJournalHead.
+func (s *FileStorage) AppendJournal(head, entry []byte) error {
+	file, err := os.OpenFile(s.journalPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	size := info.Size()
+	if size == 0 {
+		entry = append(append([]byte{}, head...), entry...)
+	} else if err := checkJournalHead(file, head); err != nil {
+		_ = file.Close()
+		return err
+	}
+	_, err = file.WriteAt(entry, size)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		_ = file.Truncate(size)
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if size == 0 {
+		return syncDir(s.BackupDir)
+	}
+	return nil
+}
+
+// checkJournalHead 检查日志文件是否以 head 开头 (详见 AppendJournal).
+func checkJournalHead(file *os.File, head []byte) error {
+	buf := make([]byte, len(head))
+	if _, err := file.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.Equal(buf, head) {
+		return errJournalHead
+	}
+	return nil
+}
+
+// TruncateJournal 把日志文件截短为 size 字节并 fsync.
+func (s *FileStorage) TruncateJournal(size int64) error {
+	file, err := os.OpenFile(s.journalPath(), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(size)
+	if err == nil {
+		err = file.Sync()
+	}
+	return util.WrapErrors(err, file.Close())
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// kdfArgon2id 是目前采用的密钥派生算法的名称.
+const kdfArgon2id = "argon2id"
+
+// 生成新的 KDFParams 时采用的参数, 可根据机器性能调整.
+// 已保存在数据库文件中的参数不受影响, 下次修改密码时才会采用新参数.
+var (
+	Argon2Time    uint32 = 3
+	Argon2Memory  uint32 = 64 * 1024 // 单位: KiB
+	Argon2Threads uint8  = 4
+	SaltSize             = 16
+)
+
+// 成本参数的上限. 数据库文件中的参数超出上限时拒绝解锁,
+// 以免损坏或伪造的文件头在登入时分配过多内存或长时间占用 CPU.
+const (
+	maxArgon2Time    = 32
+	maxArgon2Memory  = 1 << 20 // 单位: KiB, 即 1 GiB
+	maxArgon2Threads = 64
+)
+
+// KDFParams 记录由用户密码生成 userKey 所需的参数 (算法, 盐, 成本参数).
+// 每个数据库有自己的随机盐, 与数据库文件一起保存.
+type KDFParams struct {
+	Name    string
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+
+	// UsesKeyfile 表示解锁时除了密码还需要 keyfile (第二因素).
+	// 不保存 keyfile 的校验值, 以免有人不经过 argon2 就能离线猜测 keyfile.
+	UsesKeyfile bool `json:",omitempty"`
+}
+
+var (
+	ErrWrongPassword = errors.New("密码错误")
+	ErrNeedKeyfile   = errors.New("此数据库需要 keyfile 才能解锁, 请选择 keyfile")
+	ErrNoKeyfile     = errors.New("此数据库未设置 keyfile, 请不要选择 keyfile")
+
+	// ErrWrongPasswordOrKeyfile 用于需要 keyfile 的数据库. 为了不提供离线猜测 keyfile 的途径,
+	// 无法区分是密码错误还是 keyfile 错误. errors.Is(err, ErrWrongPassword) 同样成立.
+	ErrWrongPasswordOrKeyfile = fmt.Errorf("%w, 或 keyfile 错误 (不是设置时采用的文件, 或文件内容已改变)", ErrWrongPassword)
+)
+
+// newKDFParams 采用随机盐和当前默认的成本参数生成新的 KDFParams.
+// keyfile 为 nil 时表示只采用密码解锁.
+func newKDFParams(keyfile []byte) (*KDFParams, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	params := &KDFParams{
+		Name:    kdfArgon2id,
+		Salt:    salt,
+		Time:    Argon2Time,
+		Memory:  Argon2Memory,
+		Threads: Argon2Threads,
+	}
+	params.UsesKeyfile = keyfile != nil
+	return params, nil
+}
+
+// DeriveKey 根据用户密码 (以及 keyfile, 如有) 生成 userKey.
+// params 为 nil 时表示旧版数据库 (直接使用 sha256, 没有盐, 不支持 keyfile).
+// 如果需要 keyfile 却没有提供, 或者不需要却提供了, 返回 ErrNeedKeyfile 或 ErrNoKeyfile.
+// keyfile 是否正确只能由生成的 key 能否解密得知.
+func DeriveKey(password string, keyfile []byte, params *KDFParams) (*SecretKey, error) {
+	if err := params.checkKeyfile(keyfile); err != nil {
+		return nil, err
+	}
+	var key SecretKey
+	if params == nil {
+		key = sha256.Sum256([]byte(password))
+		return &key, nil
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	input := []byte(password)
+	if keyfile != nil {
+		// keyfile 的内容经 sha256 后与密码一起作为 argon2id 的输入.
+		digest := sha256.Sum256(keyfile)
+		input = append(input, digest[:]...)
+	}
+	b := argon2.IDKey(input, params.Salt, params.Time, params.Memory, params.Threads, KeySize)
+	copy(key[:], b)
+	return &key, nil
+}
+
+// needsKeyfile 判断是否需要 keyfile. params 可以为 nil.
+func (params *KDFParams) needsKeyfile() bool {
+	return params != nil && params.UsesKeyfile
+}
+
+// checkKeyfile 检查是否提供了 keyfile (不检查 keyfile 的内容). params 可以为 nil.
+func (params *KDFParams) checkKeyfile(keyfile []byte) error {
+	switch {
+	case !params.needsKeyfile() && keyfile != nil:
+		return ErrNoKeyfile
+	case params.needsKeyfile() && keyfile == nil:
+		return ErrNeedKeyfile
+	}
+	return nil
+}
+
+// wrongPassword 返回由 params 生成的 key 无法解密时的错误 (详见 ErrWrongPasswordOrKeyfile).
+func (params *KDFParams) wrongPassword() error {
+	if params.needsKeyfile() {
+		return ErrWrongPasswordOrKeyfile
+	}
+	return ErrWrongPassword
+}
+
+// validate 检查算法名称以及成本参数是否在合理范围内 (详见 maxArgon2Time 等).
+func (params *KDFParams) validate() error {
+	switch {
+	case params.Name != kdfArgon2id:
+		return fmt.Errorf("%w: 无法识别的密钥派生算法: %s", ErrTampered, params.Name)
+	case params.Time < 1 || params.Time > maxArgon2Time:
+		return fmt.Errorf("%w: argon2 参数 t=%d 超出范围 (1-%d)", ErrTampered, params.Time, maxArgon2Time)
+	case params.Memory < 1 || params.Memory > maxArgon2Memory:
+		return fmt.Errorf("%w: argon2 参数 m=%d 超出范围 (1-%d)", ErrTampered, params.Memory, maxArgon2Memory)
+	case params.Threads < 1 || params.Threads > maxArgon2Threads:
+		return fmt.Errorf("%w: argon2 参数 p=%d 超出范围 (1-%d)", ErrTampered, params.Threads, maxArgon2Threads)
+	}
+	return nil
+}
+
+// String 把参数转换为一行文本, 格式参考 PHC string format,
+// 例如 $argon2id$v=19$m=65536,t=3,p=4$c2FsdA
+// 由于 base64 字符串不包含 '$', 因此可据此区分参数行与数据行.
+func (params *KDFParams) String() string {
+	salt := base64.RawStdEncoding.EncodeToString(params.Salt)
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s",
+		params.Name, argon2.Version, params.Memory, params.Time, params.Threads, salt)
+}
+
+func isKDFLine(line string) bool {
+	return strings.HasPrefix(line, "$")
+}
+
+// parseKDFParams 与 KDFParams.String 相反, 从一行文本中解析出参数.
+func parseKDFParams(line string) (*KDFParams, error) {
+	parts := strings.Split(line, "$")
+	if len(parts) != 5 || parts[1] != kdfArgon2id {
+		return nil, errors.New("无法识别的密钥派生参数: " + line)
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, err
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("不支持的 argon2 版本: %d", version)
+	}
+	params := &KDFParams{Name: parts[1]}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d",
+		&params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, err
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	params.Salt = salt
+	return params, nil
+}
+
+// equalKeys 以固定时间比较两个 key, 避免时序攻击.
+func equalKeys(a, b *SecretKey) bool {
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
@@ -0,0 +1,467 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// 内部密码 (DB.key) 的保存方式 (version 5 开始):
+//
+// 全部记录 (包括第一条记录) 都由内部密码加密, 内部密码则由文件头中的 key slot 加密保存.
+// 每个 key slot 由一个秘密 (用户密码, 恢复密钥等) 经 KDF 生成 key, 再用该 key 加密内部密码,
+// 因此任意一个 key slot 都能解锁数据库, 增加, 更换, 撤销 key slot 也不需要重新加密全部记录.
+//
+// 可以有多个密码 key slot (比如团队中每个成员一个), 但最多只有一个恢复密钥 key slot.
+//
+// 旧版数据库 (version 4 及以前) 没有 key slot, 第一条记录由 userKey 加密,
+// 内部密码保存在第一条记录的 Password 中.
+
+// key slot 的种类.
+const (
+	SlotPassword = "password"
+	SlotRecovery = "recovery"
+)
+
+// 默认的 key slot 标签.
+const (
+	defaultPasswordLabel   = "主密码"
+	defaultRecoveryLabel   = "恢复密钥"
+	recoveredPasswordLabel = "由恢复密钥设置的密码"
+	sharesPasswordLabel    = "由分享还原后设置的密码"
+)
+
+// recoveryKeySize 是恢复密钥的长度 (随机字节数), 转为 base32 后是 52 个字符.
+const recoveryKeySize = 32
+
+var (
+	ErrWrongRecoveryKey = errors.New("恢复密钥错误")
+	ErrNoRecoveryKey    = errors.New("此数据库没有恢复密钥 (从未生成或已撤销)")
+	errSlotNotFound     = errors.New("找不到该 key slot")
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// KeySlot 保存由某个秘密加密的内部密码.
+type KeySlot struct {
+	Kind    string
+	Label   string
+	KDF     *KDFParams
+	Wrapped []byte // nonce + XChaCha20-Poly1305 密文
+
+	// 生成时间和最后一次用来解锁的时间 (UnixNano), 0 表示未知 (旧版) 或从未使用.
+	CreatedAt int64
+	LastUsed  int64
+}
+
+// SlotInfo 用于在网页中显示 key slot 的信息 (不包含任何秘密).
+type SlotInfo struct {
+	ID          string
+	Kind        string
+	Label       string
+	UsesKeyfile bool
+	CreatedAt   string
+	LastUsed    string
+	Current     bool // 是否当前登入所用的 key slot
+}
+
+// newKeySlot 用 secret (以及 keyfile, 如有) 生成 key, 加密 dataKey.
+func newKeySlot(kind, label, secret string, keyfile []byte, dataKey *SecretKey, vaultID string) (*KeySlot, error) {
+	params, err := newKDFParams(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := DeriveKey(secret, keyfile, params)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	slot := &KeySlot{Kind: kind, Label: label, KDF: params, CreatedAt: time.Now().UnixNano()}
+	slot.Wrapped = aead.Seal(nonce[:], nonce[:], dataKey[:], slot.ad(vaultID))
+	return slot, nil
+}
+
+// ID 是 key slot 的唯一标识, 由密文计算得出, 因此不需要另外保存.
+// 同一个 key slot 重新加密 (比如修改密码) 后 ID 会改变.
+func (slot *KeySlot) ID() string {
+	sum := sha256.Sum256(slot.Wrapped)
+	return hex.EncodeToString(sum[:6])
+}
+
+// ad 是 key slot 的附加认证数据, 因此 key slot 不能被移动到另一个数据库或改为另一个种类.
+// Label 等其他信息由数据库文件的校验码保护.
+func (slot *KeySlot) ad(vaultID string) []byte {
+	return []byte("mima-go key slot\x00" + vaultID + "\x00" + slot.Kind)
+}
+
+// unwrap 用 secret (以及 keyfile, 如有) 解密出内部密码.
+// secret 错误时返回 ErrWrongPassword, ErrWrongPasswordOrKeyfile 或 ErrWrongRecoveryKey,
+// 缺少或多余的 keyfile 详见 DeriveKey.
+func (slot *KeySlot) unwrap(secret string, keyfile []byte, vaultID string) (*SecretKey, error) {
+	key, err := DeriveKey(secret, keyfile, slot.KDF)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(slot.Wrapped) < NonceSize {
+		return nil, errors.New("key slot 格式错误")
+	}
+	nonce, ciphertext := slot.Wrapped[:NonceSize], slot.Wrapped[NonceSize:]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, slot.ad(vaultID))
+	if err != nil {
+		if slot.Kind == SlotRecovery {
+			return nil, ErrWrongRecoveryKey
+		}
+		return nil, slot.KDF.wrongPassword()
+	}
+	if len(plaintext) != KeySize {
+		return nil, errors.New("内部密码长度错误")
+	}
+	dataKey := bytesToKey(plaintext)
+	return &dataKey, nil
+}
+
+func (slot *KeySlot) info(currentID string) SlotInfo {
+	info := SlotInfo{
+		ID:          slot.ID(),
+		Kind:        slot.Kind,
+		Label:       slot.Label,
+		UsesKeyfile: slot.KDF.needsKeyfile(),
+		CreatedAt:   formatNano(slot.CreatedAt),
+		LastUsed:    formatNano(slot.LastUsed),
+	}
+	info.Current = info.ID == currentID
+	return info
+}
+
+// formatNano 把 UnixNano 转换为 DateTimeFormat 格式, 0 表示未知.
+func formatNano(t int64) string {
+	if t == 0 {
+		return "-"
+	}
+	return time.Unix(0, t).Format(DateTimeFormat)
+}
+
+// slot 返回第一个种类为 kind 的 key slot, 找不到时返回 nil.
+func (header *Header) slot(kind string) *KeySlot {
+	for _, slot := range header.Slots {
+		if slot.Kind == kind {
+			return slot
+		}
+	}
+	return nil
+}
+
+// slotByID 返回指定 ID 的 key slot, 找不到时返回 nil.
+func (header *Header) slotByID(id string) *KeySlot {
+	for _, slot := range header.Slots {
+		if slot.ID() == id {
+			return slot
+		}
+	}
+	return nil
+}
+
+// passwordSlots 返回全部密码 key slot.
+func (header *Header) passwordSlots() (slots []*KeySlot) {
+	for _, slot := range header.Slots {
+		if slot.Kind == SlotPassword {
+			slots = append(slots, slot)
+		}
+	}
+	return
+}
+
+// setSlot 用 newSlot 替换同种类的全部 key slot, 如果没有同种类的 key slot 则添加.
+// newSlot 为 nil 时删除该种类的全部 key slot. 主要用于恢复密钥 (最多只有一个).
+func (header *Header) setSlot(kind string, newSlot *KeySlot) {
+	var slots []*KeySlot
+	for _, slot := range header.Slots {
+		if slot.Kind != kind {
+			slots = append(slots, slot)
+		}
+	}
+	if newSlot != nil {
+		slots = append(slots, newSlot)
+	}
+	header.Slots = slots
+}
+
+// replaceSlot 用 newSlot 替换指定 ID 的 key slot, newSlot 为 nil 时删除.
+// Slots 总是替换为新的 slice, 因此不影响该文件头的其他副本.
+func (header *Header) replaceSlot(id string, newSlot *KeySlot) error {
+	var slots []*KeySlot
+	found := false
+	for _, slot := range header.Slots {
+		if slot.ID() != id {
+			slots = append(slots, slot)
+			continue
+		}
+		found = true
+		if newSlot != nil {
+			slots = append(slots, newSlot)
+		}
+	}
+	if !found {
+		return errSlotNotFound
+	}
+	header.Slots = slots
+	return nil
+}
+
+// markUsed 更新指定 ID 的 key slot 的最后使用时间.
+// 与 replaceSlot 一样不修改原有的 KeySlot, 因此不影响该文件头的其他副本.
+func (header *Header) markUsed(id string) {
+	for i, slot := range header.Slots {
+		if slot.ID() == id {
+			used := *slot
+			used.LastUsed = time.Now().UnixNano()
+			slots := append([]*KeySlot(nil), header.Slots...)
+			slots[i] = &used
+			header.Slots = slots
+			return
+		}
+	}
+}
+
+// newRecoveryKey 生成一个随机的恢复密钥, 采用 base32 每 4 个字符一组, 方便抄写和打印.
+func newRecoveryKey() (string, error) {
+	b := make([]byte, recoveryKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := recoveryEncoding.EncodeToString(b)
+	var groups []string
+	for len(s) > 4 {
+		groups = append(groups, s[:4])
+		s = s[4:]
+	}
+	groups = append(groups, s)
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeRecoveryKey 去除用户输入的恢复密钥中的分隔符和空白, 并转为大写.
+func normalizeRecoveryKey(recoveryKey string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, strings.ToUpper(recoveryKey))
+}
+
+// newRecoverySlot 生成新的恢复密钥及其 key slot.
+func newRecoverySlot(dataKey *SecretKey, vaultID string) (recoveryKey string, slot *KeySlot, err error) {
+	if recoveryKey, err = newRecoveryKey(); err != nil {
+		return "", nil, err
+	}
+	slot, err = newKeySlot(SlotRecovery, defaultRecoveryLabel,
+		normalizeRecoveryKey(recoveryKey), nil, dataKey, vaultID)
+	if err != nil {
+		return "", nil, err
+	}
+	return recoveryKey, slot, nil
+}
+
+// unlockSlots 逐个尝试全部密码 key slot, 返回内部密码以及能解锁的 key slot.
+// 如果只有一个密码 key slot (或全部 key slot 的错误都相同), 返回具体的错误
+// (比如 ErrNeedKeyfile), 否则返回 ErrWrongPassword.
+func (header *Header) unlockSlots(password string, keyfile []byte) (*SecretKey, *KeySlot, error) {
+	slots := header.passwordSlots()
+	if len(slots) == 0 {
+		return nil, nil, fmt.Errorf("%w: 缺少密码 key slot", ErrTampered)
+	}
+	var firstErr error
+	for _, slot := range slots {
+		dataKey, err := slot.unwrap(password, keyfile, header.VaultID)
+		if err == nil {
+			return dataKey, slot, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		} else if err != firstErr {
+			firstErr = ErrWrongPassword
+		}
+	}
+	return nil, nil, firstErr
+}
+
+// unlockVault 用 password (和 keyfile) 解锁数据库, 返回内部密码, 第一条记录,
+// 加密第一条记录的 key (旧版数据库是 userKey, 否则就是内部密码), 以及所用 key slot 的 ID
+// (旧版数据库没有 key slot, 此时为空字符串).
+func unlockVault(header *Header, boxes [][]byte, password string, keyfile []byte) (
+	dataKey, firstKey *SecretKey, first *Mima, slotID string, err error) {
+
+	if len(boxes) == 0 {
+		return nil, nil, nil, "", fmt.Errorf("%w: 数据库文件中没有任何记录", ErrTampered)
+	}
+	if header.hasSlots() {
+		dataKey, slot, err := header.unlockSlots(password, keyfile)
+		if err != nil {
+			return nil, nil, nil, "", err
+		}
+		if first, err = openBox(header, boxes[0], dataKey, dbSlot(0)); err != nil {
+			return nil, nil, nil, "", err
+		}
+		return dataKey, dataKey, first, slot.ID(), nil
+	}
+
+	// 旧版数据库: 第一条记录由 userKey 加密, 其中的 Password 是内部密码.
+	if firstKey, err = DeriveKey(password, keyfile, header.KDF); err != nil {
+		return nil, nil, nil, "", err
+	}
+	if first, err = openBox(header, boxes[0], firstKey, dbSlot(0)); err != nil {
+		return nil, nil, nil, "", fmt.Errorf("%w: %v", header.KDF.wrongPassword(), err)
+	}
+	if dataKey, err = decodeKey(first.Password); err != nil {
+		return nil, nil, nil, "", err
+	}
+	return dataKey, firstKey, first, "", nil
+}
+
+// RecoverWithKey 用恢复密钥解锁数据库文件, 并添加一个新的密码 key slot (以及新的 keyfile, 如有).
+// 用于忘记密码的情形, 因此不需要登入, 只修改数据库文件 (修改前先备份), 不影响内存数据库.
+// 原有的密码 key slot 保持不变 (可在登入后删除), 恢复密钥也保持有效 (可在登入后重新生成或撤销).
+func (db *DB) RecoverWithKey(recoveryKey, newPassword string, newKeyfile []byte) error {
+	header, boxes, err := db.loadVault()
+	if err != nil {
+		return err
+	}
+	slot := header.slot(SlotRecovery)
+	if !header.hasSlots() || slot == nil {
+		return ErrNoRecoveryKey
+	}
+	dataKey, err := slot.unwrap(normalizeRecoveryKey(recoveryKey), nil, header.VaultID)
+	if err != nil {
+		return err
+	}
+	header.markUsed(slot.ID())
+	return db.addRecoveredSlot(header, boxes, dataKey, recoveredPasswordLabel, newPassword, newKeyfile)
+}
+
+// addRecoveredSlot 用已还原的内部密码添加一个新的密码 key slot, 并重写数据库文件 (重写前先备份).
+// 用于忘记密码的情形, 因此只修改数据库文件, 不影响内存数据库.
+func (db *DB) addRecoveredSlot(header *Header, boxes [][]byte, dataKey *SecretKey,
+	label, newPassword string, newKeyfile []byte) error {
+
+	if err := header.verifyMAC(dataKey, boxes); err != nil {
+		return err
+	}
+	passwordSlot, err := newKeySlot(SlotPassword, label, newPassword, newKeyfile, dataKey, header.VaultID)
+	if err != nil {
+		return err
+	}
+	if _, err = db.backup(nil); err != nil {
+		return err
+	}
+	header.Slots = append(header.Slots, passwordSlot)
+	return db.saveVault(header, boxes, dataKey, nil)
+}
+
+// HasRecoveryKey 判断当前数据库是否有恢复密钥.
+func (db *DB) HasRecoveryKey() bool {
+	return db.header.slot(SlotRecovery) != nil
+}
+
+// NewRecoveryKey 生成新的恢复密钥 (旧的恢复密钥随之失效), 返回新的恢复密钥.
+func (db *DB) NewRecoveryKey() (string, error) {
+	recoveryKey, slot, err := newRecoverySlot(db.key, db.header.VaultID)
+	if err != nil {
+		return "", err
+	}
+	err = db.updateSlots(func(header *Header) error {
+		header.setSlot(SlotRecovery, slot)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return recoveryKey, nil
+}
+
+// RevokeRecoveryKey 撤销恢复密钥. 此后忘记密码将无法恢复数据库.
+func (db *DB) RevokeRecoveryKey() error {
+	return db.updateSlots(func(header *Header) error {
+		header.setSlot(SlotRecovery, nil)
+		return nil
+	})
+}
+
+// Slots 返回全部 key slot 的信息, 用于在网页中显示.
+func (db *DB) Slots() (slots []SlotInfo) {
+	for _, slot := range db.header.Slots {
+		slots = append(slots, slot.info(db.slotID))
+	}
+	return
+}
+
+// AddSlot 添加一个密码 key slot, 比如团队中的另一个成员, 此后该成员可用自己的密码 (和 keyfile) 解锁.
+func (db *DB) AddSlot(label, password string, keyfile []byte) error {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return errors.New("标签不可为空, 请填写标签 (比如成员的名字)")
+	}
+	if password == "" {
+		return errors.New("密码不能为空")
+	}
+	slot, err := newKeySlot(SlotPassword, label, password, keyfile, db.key, db.header.VaultID)
+	if err != nil {
+		return err
+	}
+	return db.updateSlots(func(header *Header) error {
+		header.Slots = append(append([]*KeySlot(nil), header.Slots...), slot)
+		return nil
+	})
+}
+
+// RemoveSlot 删除一个 key slot. 不可删除当前登入所用的 key slot.
+// 注意: 被删除的成员可能已经得到了内部密码, 如需彻底撤销其权限, 应接着执行 RotateKey.
+func (db *DB) RemoveSlot(id string) error {
+	if id == db.slotID {
+		return errors.New("不可删除当前登入所用的 key slot")
+	}
+	return db.updateSlots(func(header *Header) error {
+		return header.replaceSlot(id, nil)
+	})
+}
+
+// findSlot 返回能用 password (和 keyfile) 解锁当前数据库的密码 key slot.
+func (db *DB) findSlot(password string, keyfile []byte) (*KeySlot, error) {
+	dataKey, slot, err := db.header.unlockSlots(password, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	if !equalKeys(dataKey, db.key) {
+		return nil, ErrWrongPassword
+	}
+	return slot, nil
+}
+
+// markSlotUsed 把当前 key slot 的最后使用时间写入数据库文件 (只修改文件头, 不备份).
+func (db *DB) markSlotUsed() error {
+	if db.slotID == "" {
+		return nil
+	}
+	return db.rewriteHeader(func(header *Header) error {
+		header.markUsed(db.slotID)
+		return nil
+	})
+}
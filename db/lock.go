@@ -0,0 +1,108 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 为了防止两个 mima-go 进程 (比如用不同的端口, 或者启动器被打开了两次) 同时写入同一个
+// 文件夹中的数据库碎片和数据库文件 (这会导致 Rebuild 时丢失数据), 程序启动时在 BackupDir 中
+// 建立一个锁文件, 并在整个运行期间持有. 锁文件中保存持有者的 PID, 以便报告是哪个进程打开了数据库.
+//
+// 具体的加锁方式因平台而异 (详见 lock_flock.go 和 lock_windows.go):
+// 在 Linux 等平台采用 flock, 进程退出时由系统自动释放; 在 Windows 则靠 PID 判断持有者是否仍在运行.
+
+// LockFileName 是锁文件的文件名.
+const LockFileName = "mima-go.lock"
+
+// LockedError 表示数据库文件夹已被另一个仍在运行的进程锁定.
+type LockedError struct {
+	Path string
+	PID  int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("数据库已被另一个 mima-go 进程 (PID: %d) 打开, 锁文件: %s", e.PID, e.Path)
+	}
+	return fmt.Sprintf("数据库已被另一个 mima-go 进程打开, 锁文件: %s", e.Path)
+}
+
+// dirLocker 是可以锁定的 Storage (比如 FileStorage). 其他 Storage 不需要锁定.
+type dirLocker interface {
+	LockDir() (stalePID int, err error)
+	UnlockDir() error
+}
+
+// LockDir 锁定数据库 (详见 FileStorage.LockDir). Storage 不支持锁定时什么都不做.
+func (db *DB) LockDir() (stalePID int, err error) {
+	if locker, ok := db.storage.(dirLocker); ok {
+		return locker.LockDir()
+	}
+	return 0, nil
+}
+
+// UnlockDir 释放 LockDir 建立的锁.
+func (db *DB) UnlockDir() error {
+	if locker, ok := db.storage.(dirLocker); ok {
+		return locker.UnlockDir()
+	}
+	return nil
+}
+
+func (s *FileStorage) lockPath() string {
+	return filepath.Join(s.BackupDir, LockFileName)
+}
+
+// LockDir 锁定数据库文件夹 (BackupDir), 直至调用 UnlockDir 或进程退出.
+// 如果已被另一个仍在运行的进程锁定, 返回 *LockedError.
+// 如果发现已退出的进程留下的锁 (stale lock), 会自动接管, 并返回该进程的 PID (否则返回 0).
+func (s *FileStorage) LockDir() (stalePID int, err error) {
+	if s.dirLock != nil {
+		return 0, nil
+	}
+	file, stalePID, err := lockFile(s.lockPath())
+	if err != nil {
+		return 0, err
+	}
+	s.dirLock = file
+	return stalePID, nil
+}
+
+// UnlockDir 释放 LockDir 建立的锁.
+func (s *FileStorage) UnlockDir() error {
+	if s.dirLock == nil {
+		return nil
+	}
+	err := unlockFile(s.dirLock)
+	s.dirLock = nil
+	return err
+}
+
+// readLockPID 读取锁文件中的 PID, 文件为空或格式错误时返回 0.
+func readLockPID(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// writeLockPID 把当前进程的 PID 写入锁文件 (覆盖原有内容).
+func writeLockPID(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
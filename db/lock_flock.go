@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile 用 flock 锁定 path (不存在则新建). flock 在进程退出时由系统自动释放,
+// 因此只要能加锁, 原持有者就一定已退出; 此时如果锁文件中仍有其他进程的 PID,
+// 说明该进程没有正常退出 (stale lock), 返回该 PID.
+func lockFile(path string) (file *os.File, stalePID int, err error) {
+	file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, 0, &LockedError{Path: path, PID: readLockPID(path)}
+		}
+		return nil, 0, err
+	}
+	if pid := readLockPID(path); pid > 0 && pid != os.Getpid() {
+		stalePID = pid
+	}
+	if err := writeLockPID(file); err != nil {
+		_ = file.Close()
+		return nil, 0, err
+	}
+	return file, stalePID, nil
+}
+
+// unlockFile 清空锁文件并释放锁. 不删除锁文件, 因为其他进程可能已打开同一个文件并在等待加锁.
+func unlockFile(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
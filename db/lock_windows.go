@@ -0,0 +1,74 @@
+//go:build windows
+// +build windows
+
+package db
+
+import (
+	"os"
+	"time"
+)
+
+// emptyLockGrace 是空的锁文件 (或内容不是 PID 的锁文件) 被当作 stale lock 之前的等待时间.
+// 另一个进程从建立锁文件到写入 PID 只需很短的时间, 超过这个时间仍为空, 说明该进程在写入 PID 之前就已退出.
+const emptyLockGrace = 10 * time.Second
+
+// lockFile 以独占方式新建锁文件 path (已存在则失败). Windows 没有 flock,
+// 进程异常退出时锁文件会留下来, 因此已存在时检查其中的 PID 对应的进程是否仍在运行,
+// 如果已退出 (stale lock) 就删除锁文件再重试一次, 并返回该 PID.
+// 锁文件为空并且已超过 emptyLockGrace 时, 同样当作 stale lock (此时返回的 PID 为 0).
+func lockFile(path string) (file *os.File, stalePID int, err error) {
+	for i := 0; i < 2; i++ {
+		file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			if err := writeLockPID(file); err != nil {
+				_ = file.Close()
+				_ = os.Remove(path)
+				return nil, 0, err
+			}
+			return file, stalePID, nil
+		}
+		if !os.IsExist(err) {
+			return nil, 0, err
+		}
+		pid := readLockPID(path)
+		if pid > 0 && processAlive(pid) {
+			return nil, 0, &LockedError{Path: path, PID: pid}
+		}
+		// 锁文件为空可能是另一个进程刚建立锁文件还未写入 PID, 因此要等超过 emptyLockGrace 才接管.
+		if pid == 0 && !emptyLockExpired(path) {
+			return nil, 0, &LockedError{Path: path}
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, 0, err
+		}
+		stalePID = pid
+	}
+	return nil, 0, &LockedError{Path: path}
+}
+
+// emptyLockExpired 判断 (没有 PID 的) 锁文件最后修改时间是否已超过 emptyLockGrace.
+func emptyLockExpired(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return time.Since(info.ModTime()) > emptyLockGrace
+}
+
+// processAlive 判断 pid 对应的进程是否仍在运行. 在 Windows 中进程不存在时 FindProcess 会返回错误.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = p.Release()
+	return true
+}
+
+// unlockFile 关闭并删除锁文件.
+func unlockFile(file *os.File) error {
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(file.Name())
+}
@@ -1,15 +1,12 @@
 package db
 
 import (
-	"encoding/base64"
-	"encoding/json"
-	"errors"
-	"golang.org/x/crypto/nacl/secretbox"
+	"fmt"
 	"time"
 )
 
 // Mima 用来表示一条记录.
-// 其中, 标题是必须的, Nonce 是必须且唯一的.
+// 其中, 标题是必须的.
 type Mima struct {
 
 	// (主键) (必须) (唯一)
@@ -25,11 +22,6 @@ type Mima struct {
 	// 注意从回收站恢复条目时 (把 DeletedAt 重置为零时), 需要检查 Alias 冲突.
 	Alias string
 
-	// 一次性随机码, 用于加密 (必须) (唯一)
-	// 但鉴于 Nonce 具有足够的长度使随机生成的 nonce 也不用担心重复,
-	// 因此平时可偷懒不检查其唯一性.
-	Nonce Nonce
-
 	Username  string
 	Password  string
 	Notes     string
@@ -44,14 +36,9 @@ type Mima struct {
 
 // NewMima 生成一个新的 mima.
 func NewMima(title string) (*Mima, error) {
-	nonce, err := newNonce()
-	if err != nil {
-		return nil, err
-	}
 	mima := new(Mima)
 	mima.ID = NewID()
 	mima.Title = title
-	mima.Nonce = nonce
 	mima.CreatedAt = time.Now().UnixNano()
 	mima.UpdatedAt = mima.CreatedAt
 	return mima, nil
@@ -68,29 +55,6 @@ func NewMimaFromForm(form *MimaForm) (mima *Mima, err error) {
 	return
 }
 
-// Decrypt 从已加密数据中解密出一个 Mima 来.
-// 用于从数据库文件中读取数据进内存数据库 (DB.readFullPath).
-func Decrypt(box64 string, key *SecretKey) (*Mima, error) {
-	box, err := base64.StdEncoding.DecodeString(box64)
-	if err != nil {
-		return nil, err
-	}
-	if len(box) < NonceSize {
-		return nil, errors.New("it's not a secretbox")
-	}
-	var nonce Nonce
-	copy(nonce[:], box[:NonceSize])
-	mimaJSON, ok := secretbox.Open(nil, box[NonceSize:], &nonce, key)
-	if !ok {
-		return nil, errors.New("Mima.Decrypt: secretbox open fail")
-	}
-	mima := new(Mima)
-	if err := json.Unmarshal(mimaJSON, mima); err != nil {
-		return nil, err
-	}
-	return mima, nil
-}
-
 // UpdateFromFrag 以数据库碎片中的内容为准, 更新内存中的条目.
 func (mima *Mima) UpdateFromFrag(fragment *Mima) (needChangeIndex bool) {
 	// Alias 或 History 有可能发生了更改 (即使更新日期没有变化)
@@ -146,25 +110,24 @@ func (mima *Mima) ToForm() *MimaForm {
 
 // UpdateFromForm 以前端传回来的 MimaForm 为准, 更新内存中的条目内容.
 // 如果只有 Alias 发生改变, 则改变 Alias, 但不生成历史记录, 也不移动元素.
-func (mima *Mima) UpdateFromForm(form *MimaForm) (needChangeIndex bool, needWriteFrag bool, err error) {
+// seq 是生成历史记录时所用的序号 (详见 History).
+func (mima *Mima) UpdateFromForm(form *MimaForm, seq uint64) (needChangeIndex bool, needWriteFrag bool) {
 	if mima.Alias != form.Alias {
 		mima.Alias = form.Alias
 		needWriteFrag = true
 	}
 	if mima.equalToForm(form) {
-		return false, needWriteFrag, nil
+		return false, needWriteFrag
 	}
 	updatedAt := time.Now().UnixNano()
-	if err = mima.makeHistory(updatedAt); err != nil {
-		return
-	}
+	mima.makeHistory(seq, updatedAt)
 
 	mima.Title = form.Title
 	mima.Username = form.Username
 	mima.Password = form.Password
 	mima.Notes = form.Notes
 	mima.UpdatedAt = updatedAt
-	return true, true, nil
+	return true, true
 }
 
 // equalToForm 用于检查 mima 与 form 的内容是否需要基本相等.
@@ -176,52 +139,44 @@ func (mima *Mima) equalToForm(form *MimaForm) bool {
 	return s1 == s2
 }
 
+// equalContent 检查两个 mima 的内容 (包括 Alias 以及是否已软删除) 是否相同, 不检查日期和历史记录.
+func (mima *Mima) equalContent(other *Mima) bool {
+	return mima.Title == other.Title && mima.Username == other.Username &&
+		mima.Password == other.Password && mima.Notes == other.Notes &&
+		mima.Alias == other.Alias && mima.IsDeleted() == other.IsDeleted()
+}
+
 // EqualByUpdatedAt 检查两个 mima 的更新日期是否一致.
 func (mima *Mima) EqualByUpdatedAt(other *Mima) bool {
 	return mima.UpdatedAt == other.UpdatedAt
 }
 
-func (mima *Mima) makeHistory(updatedAt int64) error {
-	datetime := time.Unix(0, updatedAt).Format(DateTimeFormat)
-	for _, v := range mima.History {
-		if v.DateTime == datetime {
-			return errors.New("历史记录的 DateTime 发生重复")
-		}
-	}
+// makeHistory 把修改前的内容保存为一条历史记录 (最新的在前面).
+func (mima *Mima) makeHistory(seq uint64, updatedAt int64) {
 	h := &History{
 		Title:    mima.Title,
 		Username: mima.Username,
 		Password: mima.Password,
 		Notes:    mima.Notes,
-		DateTime: datetime,
+		Seq:      seq,
+		DateTime: time.Unix(0, updatedAt).Format(DateTimeFormat),
 	}
 	mima.History = append([]*History{h}, mima.History...)
-	return nil
-}
-
-// Seal 先把 mima 转换为 json, 再加密并返回 base64 字节码.
-func (mima *Mima) Seal(key *SecretKey) (string, error) {
-	mimaJSON, err := json.Marshal(mima)
-	if err != nil {
-		return "", err
-	}
-	box := secretbox.Seal(mima.Nonce[:], mimaJSON, &mima.Nonce, key)
-	return base64.StdEncoding.EncodeToString(box), nil
 }
 
-// DeleteHistory 彻底删除一条历史记录.
-func (mima *Mima) DeleteHistory(datetime string) error {
-	if i := mima.getHistory(datetime); i < 0 {
-		return errors.New("找不到历史记录:" + datetime)
+// DeleteHistory 彻底删除一条历史记录. 历史记录由 seq 和 datetime 共同确定 (详见 History).
+func (mima *Mima) DeleteHistory(seq uint64, datetime string) error {
+	if i := mima.getHistory(seq, datetime); i < 0 {
+		return fmt.Errorf("找不到历史记录: %d (%s)", seq, datetime)
 	} else {
 		mima.History = append(mima.History[:i], mima.History[i+1:]...)
 		return nil
 	}
 }
 
-func (mima *Mima) getHistory(datetime string) int {
+func (mima *Mima) getHistory(seq uint64, datetime string) int {
 	for i, item := range mima.History {
-		if item.DateTime == datetime {
+		if item.Seq == seq && item.DateTime == datetime {
 			return i
 		}
 	}
@@ -240,8 +195,10 @@ type History struct {
 	Password string
 	Notes    string
 
-	// 考虑到实际使用情景, 在一个 mima 的历史记录里面,
-	// DateTime 应该是唯一的 (同一条记录不可能同时修改两次).
+	// Seq 是生成该历史记录的数据库碎片的序号, 由数据库统一递增 (不受系统时间调整的影响),
+	// 因此在一个数据库中是唯一的. DateTime 只是修改时的系统时间, 仅供显示, 有可能重复或倒退.
+	// 旧版历史记录的 Seq 为零, 它们的 DateTime 是唯一的 (旧版不允许重复), 因此以两者共同确定一条历史记录.
+	Seq      uint64 `json:",omitempty"`
 	DateTime string
 }
 
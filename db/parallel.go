@@ -0,0 +1,57 @@
+package db
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// DecryptWorkers 是登入 (Rebuild) 时并行解密记录和数据库碎片的 goroutine 数量.
+// 为 1 时逐条解密 (即原来的做法). 解密结果的顺序不受影响.
+var DecryptWorkers = runtime.NumCPU()
+
+// parallel 用最多 DecryptWorkers 个 goroutine 对 0 至 n-1 执行 fn, 全部完成后才返回.
+// fn 应把结果保存到以 i 为下标的位置, 以保持原来的顺序.
+// 出错后不再开始新的任务, 并返回下标最小的错误, 即与逐条执行时返回的错误相同
+// (下标是按顺序分配的, 因此比它小的任务都已执行).
+func parallel(n int, fn func(i int) error) error {
+	workers := DecryptWorkers
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	errs := make([]error, n)
+	var next int64 = -1
+	var failed int32
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				if errs[i] = fn(i); errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 重建某个时间点的数据库 (point-in-time):
+//
+// 以该时间点之前最新的一个备份文件为起点 (备份时的完整状态, 详见 openBackup),
+// 按序号依次应用此后生成的数据库碎片, 直到碎片的生成时间 (FragMeta.Time) 超过该时间点.
+// 这些碎片来自更新的备份文件 (整合碎片前都会先备份) 以及当前的数据库碎片.
+// 旧的碎片没有生成时间, 采用其中记录的更新时间或删除时间, 因此只是近似的.
+//
+// 如果缺少部分碎片 (比如保存这些碎片的备份文件已被删除), 就只能重建到缺少的碎片之前.
+// 恢复整个备份, 修复 (Fsck) 和抢救 (Salvage) 直接重写数据库文件而不生成碎片,
+// 因此跨越这些操作的时间点, 重建的结果不包含这些操作的影响.
+// 重建的结果只在内存中, 不影响当前数据库, 只用于浏览, 对比以及恢复其中的记录.
+
+// PointInTime 是重建某个时间点的数据库的概况.
+type PointInTime struct {
+	At      string      // 重建的时间点
+	Base    *BackupInfo // 作为起点的备份文件
+	Applied int         // 在备份文件的基础上应用的碎片数量
+	Records int         // 记录数量 (不包括已软删除的记录)
+	Deleted int         // 已软删除的记录数量
+	Note    string      // 无法完全重建的原因 (如有)
+}
+
+// fragTime 返回数据库碎片的生成时间, 旧的碎片没有生成时间, 采用其中记录的更新时间或删除时间.
+func fragTime(f *fragment) int64 {
+	if f.meta.Time != 0 {
+		return f.meta.Time
+	}
+	if f.mima.DeletedAt > f.mima.UpdatedAt {
+		return f.mima.DeletedAt
+	}
+	return f.mima.UpdatedAt
+}
+
+// stateAt 重建时间点 t 的数据库, 返回一个只在内存中的 DB.
+func (db *DB) stateAt(t time.Time) (snap *DB, pit *PointInTime, err error) {
+	if db.IsNotInit() {
+		return nil, nil, errors.New("内存中的数据库没有数据, 请先登入")
+	}
+	names, err := db.storage.Backups()
+	if err != nil {
+		return nil, nil, err
+	}
+	// 起点: t 之前最新的, 能够用当前的内部密码读取的备份文件.
+	base := -1
+	for i := len(names) - 1; i >= 0; i-- {
+		if bt, ok := backupTime(names[i]); !ok || bt.After(t) {
+			continue
+		}
+		var info *BackupInfo
+		if snap, info, err = db.openBackup(names[i]); err == nil {
+			base = i
+			pit = &PointInTime{At: t.Format(DateTimeFormat), Base: info}
+			break
+		}
+	}
+	if base < 0 {
+		if err == nil {
+			err = fmt.Errorf("没有 %s 之前的备份文件", t.Format(DateTimeFormat))
+		}
+		return nil, nil, err
+	}
+
+	// pending 是已读取但尚未应用的碎片, 按序号索引. apply 按序号依次应用, 直到缺少下一个碎片,
+	// 或者下一个碎片的生成时间超过 t (此时已完成重建, 返回 true).
+	pending := make(map[uint64]*fragment)
+	apply := func() (done bool, err error) {
+		for {
+			f, ok := pending[snap.seq+1]
+			if !ok {
+				return false, nil
+			}
+			if fragTime(f) > t.UnixNano() {
+				return true, nil
+			}
+			if !bytes.Equal(f.meta.Prev, snap.chain) {
+				return false, fmt.Errorf("%w: 碎片 %s 与之前的碎片不相连", ErrTampered, f.name)
+			}
+			if err := snap.applyFrag(f); err != nil {
+				return false, err
+			}
+			delete(pending, f.meta.Seq)
+			pit.Applied++
+		}
+	}
+	add := func(frags []*fragment) {
+		for _, f := range frags {
+			if f.meta != nil && f.meta.Seq > snap.seq {
+				pending[f.meta.Seq] = f
+			}
+		}
+	}
+
+	done := false
+	for _, name := range names[base+1:] {
+		// 无法读取的备份文件只是少了一些碎片, 由下面的检查说明.
+		if frags, err := db.backupFragments(name); err == nil {
+			add(frags)
+		}
+		if done, err = apply(); err != nil || done {
+			break
+		}
+	}
+	if err == nil && !done {
+		var frags []*fragment
+		if frags, err = db.currentFragments(); err == nil {
+			add(frags)
+			done, err = apply()
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !done && len(pending) > 0 {
+		pit.Note = fmt.Sprintf("缺少序号为 %d 的数据库碎片 (保存它的备份文件可能已被删除), 只能重建到 %d 号碎片为止",
+			snap.seq+1, snap.seq)
+	}
+	snap.mimaTable.reverse(func(mima *Mima) {
+		if mima.IsDeleted() {
+			pit.Deleted++
+		} else {
+			pit.Records++
+		}
+	})
+	return snap, pit, nil
+}
+
+// backupFragments 用当前的内部密码读取备份文件 name 中的全部数据库碎片 (只检查每个碎片的校验码).
+func (db *DB) backupFragments(name string) ([]*fragment, error) {
+	data, err := db.storage.ReadBackup(name)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := backupStorage(data)
+	if err != nil {
+		return nil, err
+	}
+	tmp := NewDBWithStorage(storage)
+	header, _, err := tmp.loadVault()
+	if err != nil {
+		return nil, err
+	}
+	tmp.header, tmp.key = header, db.key
+	return tmp.currentFragments()
+}
+
+// currentFragments 读取 db.storage 中的全部数据库碎片 (只检查每个碎片的校验码, 不检查校验链).
+func (db *DB) currentFragments() (frags []*fragment, err error) {
+	names, err := db.storage.Fragments()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		fs, err := db.readFragments(name)
+		if err != nil {
+			return nil, err
+		}
+		frags = append(frags, fs...)
+	}
+	return frags, nil
+}
+
+// PointInTimeEntries 重建时间点 t 的数据库, 返回其概况, 以及其中的全部记录与当前数据库的对比
+// (更新时间最新的在前面), 最后列出当时还没有的记录 (DiffAdded).
+func (db *DB) PointInTimeEntries(t time.Time) (*PointInTime, []*BackupEntry, error) {
+	snap, pit, err := db.stateAt(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := db.compareEntries(snap)
+	db.mimaTable.reverse(func(mima *Mima) {
+		if _, err := snap.GetByID(mima.ID); err != nil {
+			entries = append(entries, &BackupEntry{MimaForm: mima.ToForm().HideSecrets(), Diff: DiffAdded})
+		}
+	})
+	return pit, entries, nil
+}
+
+// RestoreEntriesAt 把时间点 t 的数据库中的记录 ids 恢复到当前数据库中 (详见 restoreEntry).
+// 恢复前先备份当前的数据库文件和全部碎片, 返回该备份文件的文件名.
+func (db *DB) RestoreEntriesAt(t time.Time, ids []string) (safety string, err error) {
+	if len(ids) == 0 {
+		return "", errors.New("请选择需要恢复的记录")
+	}
+	snap, _, err := db.stateAt(t)
+	if err != nil {
+		return "", err
+	}
+	return db.restoreFrom(snap, ids)
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/mima-go/tarball"
+)
+
+// 从本地备份文件 (tarball, 详见 DB.backup) 恢复:
+//
+// 备份文件中有当时的数据库文件以及尚未整合的碎片, 读取时先在内存中整合 (不影响当前数据库),
+// 因此看到的是备份时的完整状态. 备份文件采用当时的内部密码加密, 读取时直接采用当前的内部密码,
+// 因此修改密码之前的备份也可以读取, 但更换内部密码 (RotateKey) 之前的备份无法读取.
+//
+// 可以恢复整个数据库, 也可以只恢复选中的记录. 恢复前都会先备份当前状态.
+// 第一条记录 (程序的设定) 不会被恢复.
+
+// BackupInfo 是一个备份文件的概况. Records 和 Deleted 需要解密才能得知,
+// 因此只有打开备份文件 (预览, 恢复等) 时才有, 列出备份文件时为零.
+type BackupInfo struct {
+	Name      string
+	CreatedAt string // 由文件名 (时间戳) 得出
+	Size      int64
+	Records   int // 记录数量 (不包括已软删除的记录)
+	Deleted   int // 已软删除的记录数量
+}
+
+// newBackupInfo 根据文件名和文件大小生成备份文件的概况 (不读取其内容).
+func newBackupInfo(name string, size int64) *BackupInfo {
+	info := &BackupInfo{Name: name, Size: size}
+	if t, ok := backupTime(name); ok {
+		info.CreatedAt = t.Format(DateTimeFormat)
+	}
+	return info
+}
+
+// BackupEntry 是备份文件中的一条记录 (不含密码等敏感信息), 以及它与当前数据库中同一条记录的对比.
+type BackupEntry struct {
+	*MimaForm
+	Diff string
+}
+
+// IsAdded 表示当时没有这条记录 (详见 DiffAdded), 因此不能恢复.
+func (entry *BackupEntry) IsAdded() bool {
+	return entry.Diff == DiffAdded
+}
+
+// 备份中的记录与当前数据库的对比结果.
+const (
+	DiffSame    = "与当前相同"
+	DiffChanged = "与当前不同"
+	DiffMissing = "当前没有 (已彻底删除)"
+	DiffAdded   = "当时没有 (之后添加的)" // 只用于某个时间点的数据库 (详见 PointInTimeEntries)
+)
+
+// openBackup 用当前的内部密码读取备份文件, 返回一个只在内存中的 DB (已整合备份中的碎片).
+func (db *DB) openBackup(name string) (snap *DB, info *BackupInfo, err error) {
+	if !strings.HasSuffix(name, TarballExt) {
+		return nil, nil, fmt.Errorf("不是备份文件: %s", name)
+	}
+	data, err := db.storage.ReadBackup(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db.openBackupData(name, data)
+}
+
+// openBackupData 与 openBackup 相同, 但备份文件的内容 data 由调用者读取 (比如数据库文件夹以外的备份文件).
+func (db *DB) openBackupData(name string, data []byte) (snap *DB, info *BackupInfo, err error) {
+	info = newBackupInfo(name, int64(len(data)))
+	storage, err := backupStorage(data)
+	if err != nil {
+		return nil, info, err
+	}
+	snap = NewDBWithStorage(storage)
+	if err := snap.readWithKey(db.key); err != nil {
+		return nil, info, fmt.Errorf("无法用当前的内部密码读取 (可能是更换内部密码之前的备份): %w", err)
+	}
+	names, err := storage.Fragments()
+	if err == nil {
+		err = snap.readFragFilesAndUpdate(names)
+	}
+	if err != nil {
+		return nil, info, err
+	}
+	snap.mimaTable.reverse(func(mima *Mima) {
+		if mima.IsDeleted() {
+			info.Deleted++
+		} else {
+			info.Records++
+		}
+	})
+	return snap, info, nil
+}
+
+// backupStorage 把备份文件的内容 data (tarball) 中的数据库文件和碎片读入一个 MemStorage.
+func backupStorage(data []byte) (*MemStorage, error) {
+	files, err := tarball.ReadFiles(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	storage := NewMemStorage()
+	for _, f := range files {
+		switch {
+		case f.Name == VaultName:
+			storage.vault = f.Data
+		case f.Name == JournalName || strings.HasSuffix(f.Name, FragExt):
+			storage.fragments[f.Name] = f.Data
+		}
+	}
+	if storage.vault == nil {
+		return nil, errors.New("备份文件中没有数据库文件")
+	}
+	return storage, nil
+}
+
+// readWithKey 用内部密码 key 读取数据库文件 (不需要用户密码), 填充 db. 用于读取备份文件.
+// 第一条记录不会被恢复, 因此不解密 (旧版数据库的第一条记录由 userKey 加密, 也无法解密).
+func (db *DB) readWithKey(key *SecretKey) error {
+	header, boxes, err := db.loadVault()
+	if err != nil {
+		return err
+	}
+	if len(boxes) == 0 {
+		return fmt.Errorf("%w: 数据库文件中没有任何记录", ErrTampered)
+	}
+	if err := header.verifyMAC(key, boxes); err != nil {
+		return err
+	}
+	db.header = header
+	db.key = key
+	db.seq, db.chain = header.Seq, header.Chain
+	return db.fillTable(boxes, new(Mima))
+}
+
+// BackupInfos 返回全部备份文件的概况 (只有文件名, 日期和大小), 最新的在前面.
+// 不读取也不解密备份文件, 因此无法读取的备份文件 (比如更换内部密码之前的备份) 也会列出,
+// 打开时才报错 (详见 BackupEntries).
+func (db *DB) BackupInfos() (infos []*BackupInfo, err error) {
+	names, err := db.storage.Backups()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		size, err := db.storage.BackupSize(names[i])
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, newBackupInfo(names[i], size))
+	}
+	return
+}
+
+// BackupEntries 返回备份文件的概况, 以及其中的全部记录 (包括已软删除的记录, 更新时间最新的在前面).
+func (db *DB) BackupEntries(name string) (*BackupInfo, []*BackupEntry, error) {
+	snap, info, err := db.openBackup(name)
+	if err != nil {
+		return info, nil, err
+	}
+	return info, db.compareEntries(snap), nil
+}
+
+// compareEntries 返回 snap 中的全部记录 (更新时间最新的在前面), 以及每条记录与当前数据库的对比.
+func (db *DB) compareEntries(snap *DB) (entries []*BackupEntry) {
+	snap.mimaTable.reverse(func(mima *Mima) {
+		entry := &BackupEntry{MimaForm: mima.ToForm().HideSecrets(), Diff: DiffSame}
+		current, err := db.GetByID(mima.ID)
+		switch {
+		case err != nil:
+			entry.Diff = DiffMissing
+		case !current.equalContent(mima):
+			entry.Diff = DiffChanged
+		}
+		entries = append(entries, entry)
+	})
+	return
+}
+
+// RestoreBackup 用备份文件中的全部记录替换当前数据库中的全部记录 (第一条记录除外), 并重写数据库文件.
+// 恢复前先备份当前的数据库文件和全部碎片, 返回该备份文件的文件名.
+// 文件头 (key slot 等) 和校验链的序号保持不变, 恢复后的数据库文件包含全部当前碎片的序号,
+// 因此当前碎片随即删除 (已备份).
+func (db *DB) RestoreBackup(name string) (safety string, err error) {
+	if db.IsNotInit() {
+		return "", errors.New("内存中的数据库没有数据, 请先登入")
+	}
+	snap, _, err := db.openBackup(name)
+	if err != nil {
+		return "", err
+	}
+	if err := db.checkVaultUnchanged(); err != nil {
+		return "", err
+	}
+	fragNames, err := db.storage.Fragments()
+	if err != nil {
+		return "", err
+	}
+	if safety, err = db.backup(fragNames); err != nil {
+		return "", err
+	}
+	oldTable := db.mimaTable
+	snap.mimaTable.first = oldTable.first
+	db.mimaTable = snap.mimaTable
+	if err = db.rewriteDBFile(fragNames); err != nil {
+		if errors.Is(err, errPendingCleanup) {
+			// 新的数据库文件已生效, 只是未能删除碎片, 下次启动时 RecoverPendingWrites 会继续删除.
+			db.clearOpLog()
+			return safety, err
+		}
+		db.mimaTable = oldTable
+		return "", err
+	}
+	// 恢复整个数据库不生成碎片, 因此无法撤销, 之前的操作也不能再撤销.
+	db.clearOpLog()
+	return safety, nil
+}
+
+// RestoreEntries 把备份文件中的记录 ids 恢复到当前数据库中 (详见 restoreEntry), 每条记录生成一个数据库碎片.
+// 恢复前先备份当前的数据库文件和全部碎片, 返回该备份文件的文件名.
+func (db *DB) RestoreEntries(name string, ids []string) (safety string, err error) {
+	if db.IsNotInit() {
+		return "", errors.New("内存中的数据库没有数据, 请先登入")
+	}
+	if len(ids) == 0 {
+		return "", errors.New("请选择需要恢复的记录")
+	}
+	snap, _, err := db.openBackup(name)
+	if err != nil {
+		return "", err
+	}
+	return db.restoreFrom(snap, ids)
+}
+
+// restoreFrom 把 snap (备份或某个时间点的数据库) 中的记录 ids 恢复到当前数据库中, 恢复前先备份.
+func (db *DB) restoreFrom(snap *DB, ids []string) (safety string, err error) {
+	var mimas []*Mima
+	for _, id := range ids {
+		mima, err := snap.GetByID(id)
+		if err != nil {
+			return "", err
+		}
+		mimas = append(mimas, mima)
+	}
+	fragNames, err := db.storage.Fragments()
+	if err != nil {
+		return "", err
+	}
+	if safety, err = db.backup(fragNames); err != nil {
+		return "", err
+	}
+	for _, mima := range mimas {
+		if err := db.restoreEntry(mima); err != nil {
+			return safety, err
+		}
+	}
+	return safety, nil
+}
+
+// restoreEntry 把备份中的一条记录恢复到当前数据库中.
+// 如果当前数据库中仍有该记录, 就把内容修改为备份中的内容 (修改前的内容保存为历史记录),
+// 如果它在回收站中, 同时还原. 否则 (已彻底删除) 重新添加该记录, 连同它的历史记录.
+func (db *DB) restoreEntry(backup *Mima) error {
+	mima, err := db.GetByID(backup.ID)
+	if err != nil {
+		restored := *backup
+		restored.UpdatedAt = time.Now().UnixNano()
+		restored.DeletedAt = 0
+		return db.Add(&restored)
+	}
+	form := backup.ToForm()
+	if err := db.Update(form); err != nil {
+		return err
+	}
+	if mima.IsDeleted() {
+		return db.UnDeleteByID(mima.ID)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/mima-go/tarball"
+)
+
+// Retention 是本地备份文件的保留策略 (grandfather-father-son):
+// 保留最新的 Last 个备份文件, 另外每天, 每周, 每月各保留一个 (当天/当周/当月最新的一个),
+// 分别保留最近的 Daily 天, Weekly 周, Monthly 个月 (只计算有备份文件的日子).
+// 同一个备份文件可以同时满足多个条件. 全部为零表示保留全部备份文件.
+type Retention struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// DefaultRetention 是默认的保留策略.
+var DefaultRetention = Retention{Last: 10, Daily: 7, Weekly: 4, Monthly: 12}
+
+// IsZero 表示保留全部备份文件 (不自动删除).
+func (r Retention) IsZero() bool {
+	return r == Retention{}
+}
+
+// String 用于在网页中说明保留策略.
+func (r Retention) String() string {
+	if r.IsZero() {
+		return "保留全部备份文件"
+	}
+	return fmt.Sprintf("保留最新的 %d 个, 以及最近 %d 天每天一个, 最近 %d 周每周一个, 最近 %d 个月每月一个",
+		r.Last, r.Daily, r.Weekly, r.Monthly)
+}
+
+// Select 把备份文件 names (从旧到新排序, 即 DB.Backups 的顺序) 分为保留和删除两部分, 两部分都保持原来的顺序.
+// 无法从文件名得出时间的文件一律保留.
+func (r Retention) Select(names []string) (keep, prune []string) {
+	if r.IsZero() {
+		return names, nil
+	}
+	kept := make(map[string]bool)
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	months := make(map[string]bool)
+	// period 把备份文件 name 计为 key 所在时段 (日, 周, 月) 中保留的一个, 最多 max 个时段.
+	period := func(seen map[string]bool, key string, max int, name string) {
+		if !seen[key] && len(seen) < max {
+			seen[key] = true
+			kept[name] = true
+		}
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		t, ok := backupTime(name)
+		if !ok || len(names)-i <= r.Last {
+			kept[name] = true
+		}
+		if !ok {
+			continue
+		}
+		year, week := t.ISOWeek()
+		period(days, t.Format("2006-01-02"), r.Daily, name)
+		period(weeks, fmt.Sprintf("%d-W%02d", year, week), r.Weekly, name)
+		period(months, t.Format("2006-01"), r.Monthly, name)
+	}
+	for _, name := range names {
+		if kept[name] {
+			keep = append(keep, name)
+		} else {
+			prune = append(prune, name)
+		}
+	}
+	return
+}
+
+// backupTime 从备份文件的文件名 (详见 newTimestampFilename) 得出备份的时间.
+func backupTime(name string) (time.Time, bool) {
+	nano, err := strconv.ParseInt(strings.TrimSuffix(name, TarballExt), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nano), true
+}
+
+// BackupsToPrune 返回按保留策略 (DB.Retention) 应删除的备份文件.
+func (db *DB) BackupsToPrune() ([]string, error) {
+	names, err := db.storage.Backups()
+	if err != nil {
+		return nil, err
+	}
+	_, prune := db.Retention.Select(names)
+	return prune, nil
+}
+
+// PruneBackups 按保留策略 (DB.Retention) 删除备份文件, 返回被删除的文件名.
+func (db *DB) PruneBackups() ([]string, error) {
+	prune, err := db.BackupsToPrune()
+	if err != nil || len(prune) == 0 {
+		return nil, err
+	}
+	if err := db.storage.DeleteBackups(prune); err != nil {
+		return nil, err
+	}
+	return prune, nil
+}
+
+// Snapshot 把当前的数据库文件和全部碎片备份为一个新的备份文件 (用于登入期间定时备份),
+// 然后按保留策略删除旧的备份文件. 如果自上次备份以来没有任何修改, 就不备份, 返回空字符串.
+func (db *DB) Snapshot() (name string, pruned []string, err error) {
+	if db.IsNotInit() {
+		return "", nil, errors.New("内存中的数据库没有数据, 请先登入")
+	}
+	if db.seq == db.snapshotSeq {
+		return "", nil, nil
+	}
+	fragNames, err := db.storage.Fragments()
+	if err != nil {
+		return "", nil, err
+	}
+	if name, err = db.backup(fragNames); err != nil {
+		return "", nil, err
+	}
+	db.snapshotSeq = db.seq
+	pruned, err = db.PruneBackups()
+	return name, pruned, err
+}
+
+// verifyBackup 用 tarball.Reader 重新读取刚写入的备份文件 name,
+// 对比其中每个文件的 SHA512 checksum 与原文件 files 是否一致.
+func (db *DB) verifyBackup(name string, files []tarball.File) error {
+	data, err := db.storage.ReadBackup(name)
+	if err != nil {
+		return err
+	}
+	tr, err := tarball.NewReaderFrom(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	checksums, err := tr.Sha512()
+	if err != nil {
+		return err
+	}
+	if err := tr.Close(); err != nil {
+		return err
+	}
+	if len(checksums) != len(files) {
+		return fmt.Errorf("备份文件中有 %d 个文件, want: %d", len(checksums), len(files))
+	}
+	for i, file := range files {
+		if sum := sha512.Sum512(file.Data); !bytes.Equal(checksums[i], sum[:]) {
+			return fmt.Errorf("备份文件中的 %s 与原文件不一致", file.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 抢救模式 (salvage):
+//
+// 数据库文件中只要有一条记录损坏, 登入 (readFullPath) 就会失败, Fsck 也要求文件头和第一条记录完好.
+// Salvage 则尽量找回能够找回的记录:
+//
+//  1. 跳过无法解析或无法解密的记录. 记录长度损坏时, 向后逐字节寻找下一条能够解密的记录
+//     (记录的位置保存在明文的附加认证数据中, 详见 RecordAD, 因此不需要猜测).
+//  2. 应用能够解密的数据库碎片. 碎片中保存的是修改后的完整记录, 因此如果被修改的记录已经丢失,
+//     就直接采用碎片中的记录.
+//  3. 如果数据库文件有无法读取的部分, 从最新的备份文件中找回缺失的记录 (该备份文件本身也有损坏时,
+//     继续查找更旧的备份文件). 注意: 备份之后被彻底删除的记录也会被找回, 需要的话可再次删除.
+//  4. 重写数据库文件 (抢救前先备份), 并报告哪些部分无法恢复, 哪些记录取自备份文件.
+//
+// 只支持当前格式 (采用 key slot) 的数据库. 文件头损坏时采用最新的能够解锁的备份文件中的文件头,
+// 但只保留能解锁的那个 key slot, 因为备份之后可能撤销过其他 key slot (旧密码, 恢复密钥等),
+// 不能让它们随着旧的文件头复活. 重写数据库文件时文件头随之重新计算校验码.
+
+// SalvageReport 是 Salvage 的结果.
+type SalvageReport struct {
+	Recovered   int      // 从当前的数据库文件和碎片中找回的记录数量
+	FromBackups []string // 取自备份文件的记录
+	Lost        []string // 无法恢复的部分
+	Backup      string   // 抢救前的备份文件
+}
+
+// salvaged 是从一个数据库文件及其碎片 (当前的或备份文件中的) 中抢救出来的状态,
+// 记录保存在对应的 DB 的 mimaTable 中.
+type salvaged struct {
+	first      *Mima           // 第一条记录, 无法读取时为 nil
+	unreadable bool            // 数据库文件是否有无法读取的部分
+	deleted    map[string]bool // 被碎片彻底删除的记录
+	lost       []string
+}
+
+// splitVault 尽量解析数据库文件的文件头, 返回文件头 (无法解析时为 nil) 以及其后的全部记录 (原始数据).
+// 文件头无法解析时, 返回 magic 之后的全部内容, 由 salvageBoxes 从中寻找记录.
+func splitVault(data []byte) (header *Header, body []byte) {
+	if !bytes.HasPrefix(data, magic) {
+		return nil, data
+	}
+	rest := data[len(magic):]
+	if len(rest) < 2 {
+		return nil, rest
+	}
+	version := binary.BigEndian.Uint16(rest)
+	headerJSON, body, ok := nextRecord(rest[2:])
+	if !ok {
+		return nil, rest
+	}
+	header = new(Header)
+	if err := json.Unmarshal(headerJSON, header); err != nil {
+		return nil, rest
+	}
+	header.Version = int(version)
+	header.rawJSON = headerJSON
+	return header, body
+}
+
+// boxIndex 从记录的附加认证数据 (明文) 中读出它在数据库文件中的位置 (详见 dbSlot).
+func boxIndex(box []byte) (int, bool) {
+	if len(box) < 2 || len(box) < 2+int(binary.BigEndian.Uint16(box)) {
+		return 0, false
+	}
+	var ad RecordAD
+	if err := json.Unmarshal(box[2:2+int(binary.BigEndian.Uint16(box))], &ad); err != nil {
+		return 0, false
+	}
+	if !strings.HasPrefix(ad.Slot, "db/") {
+		return 0, false
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(ad.Slot, "db/"))
+	return i, err == nil
+}
+
+// openBoxAt 尝试把 body[pos:] 当作一条记录 (长度 + 内容) 读取并解密, 位置不可小于 min.
+func (db *DB) openBoxAt(body []byte, pos, min int) (mima *Mima, i, next int, ok bool) {
+	box, rest, ok := nextRecord(body[pos:])
+	if !ok {
+		return nil, 0, 0, false
+	}
+	if i, ok = boxIndex(box); !ok || i < min {
+		return nil, 0, 0, false
+	}
+	mima, err := openBox(db.header, box, db.key, dbSlot(i))
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	return mima, i, len(body) - len(rest), true
+}
+
+// salvageBoxes 从 body (文件头之后的数据) 中逐条读取并解密记录, 返回第一条记录 (无法读取时为 nil)
+// 和其余能够读取的记录. 遇到无法读取的记录时, 向后逐字节寻找下一条能够解密的记录.
+func (db *DB) salvageBoxes(body []byte) (first *Mima, mimas []*Mima, lost []string) {
+	pos, want := 0, 0
+	for pos < len(body) {
+		mima, i, next, ok := db.openBoxAt(body, pos, want)
+		if !ok {
+			// 最后一条是校验码 (详见 writeVault), 不是记录.
+			if mac, rest, ok := nextRecord(body[pos:]); ok && len(rest) == 0 && len(mac) == sha256.Size {
+				break
+			}
+			found := false
+			for p := pos + 1; p < len(body) && !found; p++ {
+				mima, i, next, found = db.openBoxAt(body, p, want)
+			}
+			if !found {
+				lost = append(lost, fmt.Sprintf("数据库文件第 %d 条记录及其后的 %d 字节无法读取", want, len(body)-pos))
+				break
+			}
+		}
+		if i > want {
+			lost = append(lost, fmt.Sprintf("数据库文件第 %d 至 %d 条记录无法读取", want, i-1))
+		}
+		if i == 0 {
+			first = mima
+		} else {
+			mimas = append(mimas, mima)
+		}
+		pos, want = next, i+1
+	}
+	return
+}
+
+// salvage 抢救 db.storage 中的数据库文件 (文件头之后的数据为 body) 和全部碎片, 记录保存在 db.mimaTable 中.
+// db.header 和 db.key 必须已经设定. 完成后 db.seq 不小于任何一个已知的序号 (包括历史记录的序号).
+func (db *DB) salvage(body []byte) (*salvaged, error) {
+	first, mimas, lost := db.salvageBoxes(body)
+	s := &salvaged{first: first, unreadable: len(lost) > 0, deleted: make(map[string]bool), lost: lost}
+	if first == nil {
+		first = new(Mima)
+	}
+	db.mimaTable = newTable(first)
+	db.mimaTable.addLatest(mimas)
+
+	names, err := db.storage.Fragments()
+	if err != nil {
+		return nil, err
+	}
+	var frags []*fragment
+	for _, name := range names {
+		if name != JournalName {
+			frag, err := db.readFragFile(name)
+			if err != nil {
+				s.lost = append(s.lost, err.Error())
+				continue
+			}
+			frags = append(frags, frag)
+			continue
+		}
+		entries, _, _, err := db.journalEntries()
+		if err != nil {
+			if !errors.Is(err, ErrTampered) {
+				return nil, err
+			}
+			s.lost = append(s.lost, err.Error())
+		}
+		for _, entry := range entries {
+			frag, err := db.openEntry(entry)
+			if err != nil {
+				s.lost = append(s.lost, err.Error())
+				continue
+			}
+			frags = append(frags, frag)
+		}
+	}
+	// 旧版碎片 (没有序号) 按文件名排在前面, 新版碎片按序号排序.
+	sort.SliceStable(frags, func(i, j int) bool {
+		if frags[i].meta == nil || frags[j].meta == nil {
+			return frags[j].meta != nil && frags[i].meta == nil
+		}
+		return frags[i].meta.Seq < frags[j].meta.Seq
+	})
+	headerSeq := db.seq
+	for _, f := range frags {
+		if f.meta != nil && f.meta.Seq <= headerSeq {
+			continue // 已整合过的旧碎片或重复的碎片, 不可再应用.
+		}
+		if f.mima.Operation == DeleteForever {
+			s.deleted[f.mima.ID] = true
+		}
+		err := db.applyFrag(f)
+		if err == nil || f.mima.Operation == Insert || f.mima.Operation == DeleteForever {
+			if err != nil {
+				s.lost = append(s.lost, fmt.Sprintf("碎片 %s 无法应用: %v", f.name, err))
+			}
+			continue
+		}
+		// 被修改的记录已经丢失, 直接采用碎片中的记录.
+		mima := *f.mima
+		db.mimaTable.addLatest([]*Mima{&mima})
+	}
+	db.seq = maxSeq(db.seq, db.mimaTable)
+	return s, nil
+}
+
+// maxSeq 返回 seq 与 table 中全部历史记录的序号之中最大的一个.
+func maxSeq(seq uint64, table *table) uint64 {
+	table.reverse(func(mima *Mima) {
+		for _, h := range mima.History {
+			if h.Seq > seq {
+				seq = h.Seq
+			}
+		}
+	})
+	return seq
+}
+
+// salvageBackup 用内部密码 key 抢救备份文件 name, 返回一个只在内存中的 DB 及其抢救结果.
+// header 在备份文件中的文件头无法解析时采用.
+func (db *DB) salvageBackup(name string, header *Header, key *SecretKey) (*DB, *salvaged, error) {
+	data, err := db.storage.ReadBackup(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	storage, err := backupStorage(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	snap := NewDBWithStorage(storage)
+	h, body := splitVault(storage.vault)
+	if h == nil || h.VaultID != header.VaultID {
+		h = header
+	}
+	snap.header, snap.key, snap.seq = h, key, h.Seq
+	s, err := snap.salvage(body)
+	return snap, s, err
+}
+
+// unlockForSalvage 用 password 和 keyfile 解锁数据库文件的文件头 header (无法解析时为 nil),
+// 失败时依次尝试备份文件 names (最新的在前面) 中的文件头. 返回所用的文件头, 内部密码, 以及文件头的来源.
+// 采用备份文件中的文件头时, 返回的是一个只有能解锁的 key slot 的副本.
+func (db *DB) unlockForSalvage(header *Header, names []string, password string, keyfile []byte) (
+	*Header, *SecretKey, string, error) {
+
+	var firstErr error
+	if header != nil {
+		if header.isLegacy() {
+			return nil, nil, "", errors.New("旧版数据库不支持抢救, 请先用 /inspect-vault 检查")
+		}
+		key, _, err := header.unlockSlots(password, keyfile)
+		if err == nil {
+			return header, key, "", nil
+		}
+		if errors.Is(err, ErrWrongPassword) {
+			return nil, nil, "", err
+		}
+		firstErr = err
+	}
+	for _, name := range names {
+		data, err := db.storage.ReadBackup(name)
+		if err != nil {
+			continue
+		}
+		storage, err := backupStorage(data)
+		if err != nil {
+			continue
+		}
+		h, _ := splitVault(storage.vault)
+		if h == nil || h.isLegacy() {
+			continue
+		}
+		if key, slot, err := h.unlockSlots(password, keyfile); err == nil {
+			adopted := *h
+			adopted.Slots = []*KeySlot{slot}
+			return &adopted, key, name, nil
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("%w: 数据库文件的文件头无法解析, 也没有可用的备份文件", errBadFormat)
+	}
+	return nil, nil, "", firstErr
+}
+
+// Salvage 尽量从损坏的数据库中找回记录 (详见本文件开头的说明), 重写数据库文件 (抢救前先备份),
+// 并删除已整合的碎片. 不需要登入, 完成后清空内存数据库, 需要重新登入.
+func (db *DB) Salvage(password string, keyfile []byte) (*SalvageReport, error) {
+	data, err := db.storage.ReadVault()
+	if err != nil {
+		return nil, err
+	}
+	backups, err := db.storage.Backups()
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(backups)-1; i < j; i, j = i+1, j-1 {
+		backups[i], backups[j] = backups[j], backups[i]
+	}
+	header, body := splitVault(data)
+	header, key, source, err := db.unlockForSalvage(header, backups, password, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	report := new(SalvageReport)
+	if source != "" {
+		report.Lost = append(report.Lost, "数据库文件的文件头无法使用, 采用备份文件 "+source+
+			" 中的文件头, 但只保留本次所用的密码, 其他密码和恢复密钥 (如有) 需要重新添加或生成")
+	}
+
+	tmp := NewDBWithStorage(db.storage)
+	tmp.header, tmp.key, tmp.seq, tmp.chain = header, key, header.Seq, header.Chain
+	s, err := tmp.salvage(body)
+	if err != nil {
+		return nil, err
+	}
+	report.Lost = append(report.Lost, s.lost...)
+	report.Recovered = tmp.mimaTable.records.Len()
+
+	// 数据库文件有无法读取的部分时, 从备份文件中找回缺失的记录.
+	for _, name := range backups {
+		if !s.unreadable && s.first != nil {
+			break
+		}
+		snap, bs, err := tmp.salvageBackup(name, header, key)
+		if err != nil {
+			continue
+		}
+		if s.first == nil && bs.first != nil {
+			s.first = bs.first
+			tmp.mimaTable.first = bs.first
+			report.FromBackups = append(report.FromBackups, "第一条记录 (程序的设定), 取自 "+name)
+		}
+		var found []*Mima
+		snap.mimaTable.reverse(func(mima *Mima) {
+			if tmp.mimaTable.get(mima.ID) == nil && !s.deleted[mima.ID] {
+				found = append(found, mima)
+				report.FromBackups = append(report.FromBackups,
+					fmt.Sprintf("%s (id: %s), 取自 %s", mima.Title, mima.ID, name))
+			}
+		})
+		tmp.mimaTable.addLatest(found)
+		tmp.seq = maxSeq(tmp.seq, tmp.mimaTable)
+		for id := range bs.deleted {
+			s.deleted[id] = true
+		}
+		s.unreadable = bs.unreadable
+	}
+	if s.first == nil {
+		report.Lost = append(report.Lost, "第一条记录 (程序的设定) 无法恢复, 已重置为空白")
+	}
+
+	names, err := tmp.storage.Fragments()
+	if err != nil {
+		return report, err
+	}
+	if report.Backup, err = tmp.backup(names); err != nil {
+		return report, err
+	}
+	if err := tmp.rewriteDBFile(names); err != nil && !errors.Is(err, errPendingCleanup) {
+		return report, err
+	}
+	db.Reset()
+	return report, nil
+}
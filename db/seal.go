@@ -0,0 +1,183 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// 每条记录的加密方式:
+//
+//	旧版 (CipherSecretbox): nonce + secretbox, 没有附加认证数据.
+//	当前 (CipherXChaCha): ad 长度 (uint16) + ad (json) + nonce + XChaCha20-Poly1305 密文.
+//
+// 其中 ad (RecordAD) 以明文保存, 并作为附加认证数据 (associated data) 参与认证,
+// 因此一条记录不能被移动到另一个数据库或另一个位置, 也不能被篡改 ID 和 Operation.
+const CipherXChaCha = "xchacha20poly1305"
+
+// RecordAD 是每条记录的附加认证数据.
+type RecordAD struct {
+	// VaultID 是数据库的唯一 ID, 保存在数据库文件头中.
+	VaultID string
+
+	// Slot 表示记录的位置, 比如数据库文件中的第几条记录, 或者是哪个数据库碎片文件.
+	Slot string
+
+	ID        string
+	Operation Operation
+}
+
+// dbSlot 表示数据库文件中的第 i 条记录.
+func dbSlot(i int) string {
+	return fmt.Sprintf("db/%d", i)
+}
+
+// fragSlot 表示一个旧版的数据库碎片文件, name 是不包含文件夹的文件名.
+func fragSlot(name string) string {
+	return "frag/" + name
+}
+
+// journalSlot 表示日志中序号为 seq 的条目 (详见 journal.go).
+func journalSlot(seq uint64) string {
+	return fmt.Sprintf("journal/%d", seq)
+}
+
+// Seal 先把 mima 转换为 json, 再用 XChaCha20-Poly1305 加密.
+// vaultID, slot 以及 mima 的 ID 和 Operation 作为附加认证数据.
+// 每次加密都生成新的随机 nonce, 因此同一个 key 永远不会重复使用同一个 nonce.
+func (mima *Mima) Seal(key *SecretKey, vaultID, slot string) ([]byte, error) {
+	mimaJSON, err := json.Marshal(mima)
+	if err != nil {
+		return nil, err
+	}
+	ad, err := json.Marshal(RecordAD{
+		VaultID:   vaultID,
+		Slot:      slot,
+		ID:        mima.ID,
+		Operation: mima.Operation,
+	})
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, uint16(len(ad))); err != nil {
+		return nil, err
+	}
+	buf.Write(ad)
+	buf.Write(nonce[:])
+	return aead.Seal(buf.Bytes(), nonce[:], mimaJSON, ad), nil
+}
+
+// Open 解密由 Mima.Seal 加密的数据, 并检查记录是否属于 vaultID 和 slot.
+func Open(box []byte, key *SecretKey, vaultID, slot string) (*Mima, error) {
+	if len(box) < 2 {
+		return nil, errors.New("记录太短, 无法读取附加认证数据")
+	}
+	adLen := int(binary.BigEndian.Uint16(box))
+	if len(box) < 2+adLen+NonceSize {
+		return nil, errors.New("记录太短, 附加认证数据或 nonce 不完整")
+	}
+	ad := box[2 : 2+adLen]
+	nonce := box[2+adLen : 2+adLen+NonceSize]
+	ciphertext := box[2+adLen+NonceSize:]
+
+	var recordAD RecordAD
+	if err := json.Unmarshal(ad, &recordAD); err != nil {
+		return nil, fmt.Errorf("无法解析附加认证数据: %w", err)
+	}
+	if recordAD.VaultID != vaultID {
+		return nil, fmt.Errorf(
+			"记录 %s 属于另一个数据库 (%s), 不属于本数据库 (%s)", recordAD.ID, recordAD.VaultID, vaultID)
+	}
+	if recordAD.Slot != slot {
+		return nil, fmt.Errorf(
+			"记录 %s 的位置不符: 应为 %s, 实为 %s (可能被移动, 复制或重放)", recordAD.ID, slot, recordAD.Slot)
+	}
+
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	mimaJSON, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("记录 %s 解密失败 (密码错误或数据被篡改): %w", recordAD.ID, err)
+	}
+	mima := new(Mima)
+	if err := json.Unmarshal(mimaJSON, mima); err != nil {
+		return nil, err
+	}
+	if mima.ID != recordAD.ID || mima.Operation != recordAD.Operation {
+		return nil, fmt.Errorf("记录 %s 的内容与附加认证数据不一致", recordAD.ID)
+	}
+	return mima, nil
+}
+
+// Decrypt 从 base64 格式的 secretbox 中解密出一个 Mima 来. 只用于旧版数据.
+func Decrypt(box64 string, key *SecretKey) (*Mima, error) {
+	box, err := base64.StdEncoding.DecodeString(box64)
+	if err != nil {
+		return nil, err
+	}
+	return openSecretbox(box, key)
+}
+
+// openSecretbox 从旧版的已加密数据 (nonce + secretbox) 中解密出一个 Mima 来.
+func openSecretbox(box []byte, key *SecretKey) (*Mima, error) {
+	if len(box) < NonceSize {
+		return nil, errors.New("it's not a secretbox")
+	}
+	var nonce Nonce
+	copy(nonce[:], box[:NonceSize])
+	mimaJSON, ok := secretbox.Open(nil, box[NonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("Mima.Decrypt: secretbox open fail")
+	}
+	mima := new(Mima)
+	if err := json.Unmarshal(mimaJSON, mima); err != nil {
+		return nil, err
+	}
+	return mima, nil
+}
+
+// openBox 根据数据库文件头中记载的加密方式解密一条记录.
+func openBox(header *Header, box []byte, key *SecretKey, slot string) (*Mima, error) {
+	if header.Cipher != CipherXChaCha {
+		return openSecretbox(box, key)
+	}
+	return Open(box, key, header.VaultID, slot)
+}
+
+// sealSecretbox 采用旧版的加密方式 (nonce + secretbox), 只用于尚未升级的旧版数据库.
+func (mima *Mima) sealSecretbox(key *SecretKey) ([]byte, error) {
+	mimaJSON, err := json.Marshal(mima)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], mimaJSON, &nonce, key), nil
+}
+
+// sealBox 根据数据库文件头中记载的加密方式加密一条记录, 与 openBox 对应.
+func sealBox(header *Header, mima *Mima, key *SecretKey, slot string) ([]byte, error) {
+	if header.Cipher != CipherXChaCha {
+		return mima.sealSecretbox(key)
+	}
+	return mima.Seal(key, header.VaultID, slot)
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/ahui2016/mima-go/shamir"
+)
+
+// 紧急访问 (emergency access):
+//
+// 把内部密码 (DB.key) 用 Shamir 秘密分享拆分为 n 份, 交给 n 个家人或同事分别保管,
+// 其中任意 m 份即可还原内部密码, 然后设置新的密码 (详见 RecoverWithShares). 全程不需要联网.
+//
+// 每一份都是一行纯文本, 只包含大写字母, 数字和 '-', 方便打印, 抄写或生成二维码 (alphanumeric 模式):
+//
+//	MIMA-<VaultID>-<m>-<SetID>-<base32 数据>-<校验码>
+//
+// 其中 SetID 是每次拆分时随机生成的编号, 不同次拆分得到的分享不可混用;
+// 校验码是前面全部内容的 CRC32, 用于发现抄写错误.
+// 较早版本的分享没有 SetID (只有 5 段), 仍可使用.
+// 注意: 分享的是内部密码本身, 因此更换内部密码 (RotateKey) 后, 之前的分享全部失效.
+
+const (
+	sharePrefix    = "MIMA"
+	shareSetIDSize = 5 // 单位: byte, base32 编码后正好 8 个字符
+)
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var errNotEnoughShares = errors.New("分享不足或不正确, 无法还原内部密码")
+
+// SplitKey 把内部密码拆分为 parts 份, 任意 threshold 份即可还原. 返回每一份的文本.
+func (db *DB) SplitKey(parts, threshold int) ([]string, error) {
+	shares, err := shamir.Split(db.key[:], parts, threshold)
+	if err != nil {
+		return nil, err
+	}
+	setID := make([]byte, shareSetIDSize)
+	if _, err := rand.Read(setID); err != nil {
+		return nil, err
+	}
+	texts := make([]string, len(shares))
+	for i, share := range shares {
+		texts[i] = encodeShare(&shareInfo{
+			vaultID:   strings.ToUpper(db.header.VaultID),
+			threshold: threshold,
+			setID:     shareEncoding.EncodeToString(setID),
+			share:     share,
+		})
+	}
+	return texts, nil
+}
+
+// shareInfo 是一份分享的内容 (详见本文件开头的说明). 较早版本的分享的 setID 为空字符串.
+type shareInfo struct {
+	vaultID   string
+	threshold int
+	setID     string
+	share     []byte
+}
+
+func encodeShare(info *shareInfo) string {
+	text := fmt.Sprintf("%s-%s-%d-%s-%s", sharePrefix, info.vaultID, info.threshold,
+		info.setID, shareEncoding.EncodeToString(info.share))
+	return fmt.Sprintf("%s-%08X", text, crc32.ChecksumIEEE([]byte(text)))
+}
+
+// parseShare 与 encodeShare 相反. 忽略首尾空白, 不区分大小写.
+func parseShare(text string) (*shareInfo, error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	i := strings.LastIndex(text, "-")
+	if i < 0 {
+		return nil, fmt.Errorf("无法识别的分享: %s", text)
+	}
+	body, checksum := text[:i], text[i+1:]
+	if checksum != fmt.Sprintf("%08X", crc32.ChecksumIEEE([]byte(body))) {
+		return nil, fmt.Errorf("分享的校验码不符 (可能有抄写错误): %s", text)
+	}
+	parts := strings.Split(body, "-")
+	if len(parts) == 4 {
+		// 较早版本的分享没有 SetID.
+		parts = []string{parts[0], parts[1], parts[2], "", parts[3]}
+	}
+	if len(parts) != 5 || parts[0] != sharePrefix {
+		return nil, fmt.Errorf("无法识别的分享: %s", text)
+	}
+	info := &shareInfo{vaultID: parts[1], setID: parts[3]}
+	var err error
+	if info.threshold, err = strconv.Atoi(parts[2]); err != nil {
+		return nil, err
+	}
+	if info.share, err = shareEncoding.DecodeString(parts[4]); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// RecoverWithShares 用至少 threshold 份分享还原内部密码, 并添加一个新的密码 key slot
+// (以及新的 keyfile, 如有). 用于忘记密码 (或密码持有人无法到场) 的情形, 因此不需要登入,
+// 只修改数据库文件 (修改前先备份), 不影响内存数据库.
+func (db *DB) RecoverWithShares(texts []string, newPassword string, newKeyfile []byte) error {
+	header, boxes, err := db.loadVault()
+	if err != nil {
+		return err
+	}
+	if !header.hasSlots() || len(boxes) == 0 {
+		return errors.New("旧版数据库不支持分享, 请先用密码登入以升级数据库")
+	}
+	var shares [][]byte
+	var first *shareInfo
+	for _, text := range texts {
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		info, err := parseShare(text)
+		if err != nil {
+			return err
+		}
+		n := len(shares) + 1
+		if info.vaultID != strings.ToUpper(header.VaultID) {
+			return fmt.Errorf("第 %d 份分享属于另一个数据库 (%s), 不属于本数据库", n, info.vaultID)
+		}
+		// 不同次拆分得到的分享混在一起无法还原, 并且还原失败时无从得知是哪一份有问题, 因此先检查.
+		if first == nil {
+			first = info
+		} else if info.threshold != first.threshold || info.setID != first.setID {
+			return fmt.Errorf("第 %d 份分享与第 1 份不是同一次拆分得到的 (m 或编号不同), 不可混用", n)
+		}
+		shares = append(shares, info.share)
+	}
+	threshold := 0
+	if first != nil {
+		threshold = first.threshold
+	}
+	if len(shares) < threshold || len(shares) < 2 {
+		return fmt.Errorf("需要至少 %d 份分享, 目前只有 %d 份", threshold, len(shares))
+	}
+	secret, err := shamir.Combine(shares)
+	if err != nil {
+		return err
+	}
+	if len(secret) != KeySize {
+		return errNotEnoughShares
+	}
+	dataKey := bytesToKey(secret)
+	// 还原出的内部密码必须能解密第一条记录, 否则说明分享不正确.
+	if _, err := openBox(header, boxes[0], &dataKey, dbSlot(0)); err != nil {
+		return errNotEnoughShares
+	}
+	return db.addRecoveredSlot(header, boxes, &dataKey, sharesPasswordLabel, newPassword, newKeyfile)
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ahui2016/mima-go/tarball"
+	"github.com/ahui2016/mima-go/util"
+)
+
+// 存储 (Storage):
+//
+// DB 不直接读写文件, 而是通过 Storage 读写数据库文件, 数据库碎片 (日志) 和备份文件.
+// Storage 只负责保存字节, 不关心其内容 (加密, 校验链等都由 DB 负责), 因此换一种存储方式
+// (比如内存, 网络存储) 只需实现 Storage, 不需要修改 DB.
+//
+// 默认的 FileStorage 采用原有的文件布局: 数据库文件 (比如 mimadb/mima.db),
+// 以及同一文件夹 (BackupDir) 中的日志文件, 旧版碎片文件和备份文件.
+// MemStorage 把全部内容保存在内存中, 主要用于测试.
+
+// VaultName 是备份文件 (tarball) 中数据库文件的文件名.
+const VaultName = "mima.db"
+
+// Storage 保存数据库文件, 数据库碎片和备份文件. 碎片和备份文件均以文件名 (不含文件夹) 区分.
+// 找不到数据库文件, 碎片或备份文件时, 返回的错误应满足 errors.Is(err, os.ErrNotExist).
+type Storage interface {
+	// VaultExists 判断数据库文件是否存在.
+	VaultExists() (bool, error)
+
+	// ReadVault 读取数据库文件的全部内容.
+	ReadVault() ([]byte, error)
+
+	// WriteVault 以原子方式覆盖重写数据库文件, 即要么保持旧的内容, 要么全部更新为 data.
+	// integrated 是已整合到新数据库文件中的碎片, 新文件生效后才删除它们.
+	// 如果新文件已生效但删除碎片时出错, 返回的错误应包含 errPendingCleanup.
+	WriteVault(data []byte, integrated []string) error
+
+	// Fragments 返回尚未整合的数据库碎片的文件名, 即旧版的碎片文件 (从小到大排序)
+	// 以及日志文件 (如有, 排在最后, 详见 journal.go).
+	Fragments() ([]string, error)
+
+	// ReadFragment 读取一个旧版碎片文件或日志文件的全部内容.
+	ReadFragment(name string) ([]byte, error)
+
+	// AppendJournal 把 entry 追加到日志文件末尾, 确保已落盘才返回. 日志文件不存在或为空时先写入 head.
+	// 出错时日志文件应保持原来的长度, 以免之后的条目接在不完整的条目后面.
+	// 日志文件不以 head 开头时 (比如较早版本的日志) 不可追加, 应返回 errJournalHead.
+	AppendJournal(head, entry []byte) error
+
+	// TruncateJournal 把日志文件截短为 size 字节.
+	TruncateJournal(size int64) error
+
+	// Backups 返回全部备份文件的文件名, 从小到大 (从旧到新) 排序.
+	Backups() ([]string, error)
+
+	// ReadBackup 读取一个备份文件的全部内容.
+	ReadBackup(name string) ([]byte, error)
+
+	// BackupSize 返回一个备份文件的大小 (bytes), 不读取其内容.
+	BackupSize(name string) (int64, error)
+
+	// WriteBackup 新建一个备份文件.
+	WriteBackup(name string, data []byte) error
+
+	// DeleteBackups 删除备份文件.
+	DeleteBackups(names []string) error
+
+	// RecoverPendingWrites 处理上次未完成的写入 (详见 atomic.go), 返回已执行的操作的说明.
+	// 日志文件末尾不完整的条目由 DB 负责截掉, 不需要 Storage 处理.
+	RecoverPendingWrites() (notes []string, err error)
+}
+
+// isNotExist 判断 err 是否表示找不到文件 (包括 Storage 返回的包装后的错误).
+func isNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// loadVault 读取数据库文件, 返回文件头和全部已加密的数据.
+func (db *DB) loadVault() (*Header, [][]byte, error) {
+	data, err := db.storage.ReadVault()
+	if err != nil {
+		return nil, nil, err
+	}
+	return readVault(bytes.NewReader(data))
+}
+
+// saveVault 以当前格式覆盖重写数据库文件 (原子操作). key 是内部密码, 用于计算校验码.
+// integrated 是已整合到新数据库文件中的碎片, 新文件生效后删除 (详见 Storage.WriteVault).
+func (db *DB) saveVault(header *Header, boxes [][]byte, key *SecretKey, integrated []string) error {
+	var buf bytes.Buffer
+	if err := writeVault(&buf, header, boxes, key); err != nil {
+		return err
+	}
+	return db.storage.WriteVault(buf.Bytes(), integrated)
+}
+
+// backup 把数据库文件以及碎片 fragNames 备份到一个 tarball 里.
+// 主要在 Rebuild 或 ChangePassword 之前使用, 以防万一出错.
+// 为了方便测试返回 tarball 的文件名.
+func (db *DB) backup(fragNames []string) (name string, err error) {
+	var files []tarball.File
+	for _, fragName := range fragNames {
+		data, err := db.storage.ReadFragment(fragName)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, tarball.File{Name: fragName, Data: data})
+	}
+	data, err := db.storage.ReadVault()
+	if err != nil {
+		return "", err
+	}
+	files = append(files, tarball.File{Name: VaultName, Data: data})
+
+	var buf bytes.Buffer
+	if err := tarball.Write(&buf, files); err != nil {
+		return "", err
+	}
+	name = newTimestampFilename(TarballExt)
+	if err := db.storage.WriteBackup(name, buf.Bytes()); err != nil {
+		return "", err
+	}
+	if err := db.verifyBackup(name, files); err != nil {
+		err = fmt.Errorf("备份文件校验失败: %w", err)
+		return "", util.WrapErrors(err, db.storage.DeleteBackups([]string{name}))
+	}
+	return name, nil
+}
+
+// Backups 返回全部备份文件的文件名, 从旧到新排序.
+func (db *DB) Backups() ([]string, error) {
+	return db.storage.Backups()
+}
+
+// DeleteBackups 删除备份文件.
+func (db *DB) DeleteBackups(names []string) error {
+	return db.storage.DeleteBackups(names)
+}
+
+// FileStorage 是默认的 Storage, 把数据库文件保存在 FullPath,
+// 数据库碎片 (日志) 和备份文件保存在 BackupDir.
+type FileStorage struct {
+	FullPath  string
+	BackupDir string
+
+	// dirLock 是 LockDir 打开的锁文件 (详见 lock.go).
+	dirLock *os.File
+}
+
+// NewFileStorage 生成一个新的 FileStorage, fullPath 是数据库文件的绝对路径, backupDir 是备份文件夹的绝对路径.
+func NewFileStorage(fullPath, backupDir string) *FileStorage {
+	return &FileStorage{FullPath: fullPath, BackupDir: backupDir}
+}
+
+// path 返回 BackupDir 中的文件 name 的完整路径. name 不可包含文件夹.
+func (s *FileStorage) path(name string) string {
+	return filepath.Join(s.BackupDir, filepath.Base(name))
+}
+
+func (s *FileStorage) VaultExists() (bool, error) {
+	_, err := os.Stat(s.FullPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *FileStorage) ReadVault() ([]byte, error) {
+	return ioutil.ReadFile(s.FullPath)
+}
+
+func (s *FileStorage) Fragments() ([]string, error) {
+	names, err := s.namesByExt(FragExt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(s.journalPath())
+	if err == nil {
+		return append(names, JournalName), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (s *FileStorage) ReadFragment(name string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(name))
+}
+
+func (s *FileStorage) Backups() ([]string, error) {
+	return s.namesByExt(TarballExt)
+}
+
+func (s *FileStorage) ReadBackup(name string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(name))
+}
+
+func (s *FileStorage) BackupSize(name string) (int64, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *FileStorage) WriteBackup(name string, data []byte) error {
+	return writeFileAtomic(s.path(name), data)
+}
+
+func (s *FileStorage) DeleteBackups(names []string) error {
+	for _, name := range names {
+		if !strings.HasSuffix(name, TarballExt) {
+			continue
+		}
+		if err := os.Remove(s.path(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namesByExt 返回 BackupDir 中后缀名为 ext 的文件的文件名, 从小到大排序.
+func (s *FileStorage) namesByExt(ext string) ([]string, error) {
+	filePaths, err := filepath.Glob(filepath.Join(s.BackupDir, "*"+ext))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(filePaths))
+	for i, f := range filePaths {
+		names[i] = filepath.Base(f)
+	}
+	sort.Strings(names)
+	return names, nil
+}
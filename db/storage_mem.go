@@ -0,0 +1,162 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// MemStorage 把数据库文件, 数据库碎片和备份文件全部保存在内存中, 程序退出后全部丢失.
+// 主要用于测试, 也可作为实现其他 Storage 的参考.
+type MemStorage struct {
+	mu        sync.Mutex
+	vault     []byte // nil 表示数据库文件不存在.
+	fragments map[string][]byte
+	backups   map[string][]byte
+}
+
+// NewMemStorage 生成一个空的 MemStorage (没有数据库文件).
+func NewMemStorage() *MemStorage {
+	return &MemStorage{
+		fragments: make(map[string][]byte),
+		backups:   make(map[string][]byte),
+	}
+}
+
+func notExist(name string) error {
+	return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+}
+
+func (s *MemStorage) VaultExists() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.vault != nil, nil
+}
+
+func (s *MemStorage) ReadVault() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.vault == nil {
+		return nil, notExist(VaultName)
+	}
+	return append([]byte{}, s.vault...), nil
+}
+
+func (s *MemStorage) WriteVault(data []byte, integrated []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vault = append([]byte{}, data...)
+	for _, name := range integrated {
+		delete(s.fragments, name)
+	}
+	return nil
+}
+
+func (s *MemStorage) Fragments() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.fragments {
+		if name != JournalName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := s.fragments[JournalName]; ok {
+		names = append(names, JournalName)
+	}
+	return names, nil
+}
+
+func (s *MemStorage) ReadFragment(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.fragments[name]
+	if !ok {
+		return nil, notExist(name)
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (s *MemStorage) AppendJournal(head, entry []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	journal := s.fragments[JournalName]
+	if len(journal) == 0 {
+		journal = append([]byte{}, head...)
+	} else if !bytes.HasPrefix(journal, head) {
+		return errJournalHead
+	}
+	s.fragments[JournalName] = append(journal, entry...)
+	return nil
+}
+
+func (s *MemStorage) TruncateJournal(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	journal, ok := s.fragments[JournalName]
+	if !ok {
+		return notExist(JournalName)
+	}
+	if size < int64(len(journal)) {
+		s.fragments[JournalName] = journal[:size]
+	}
+	return nil
+}
+
+func (s *MemStorage) Backups() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.backups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemStorage) ReadBackup(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.backups[name]
+	if !ok {
+		return nil, notExist(name)
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (s *MemStorage) BackupSize(name string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.backups[name]
+	if !ok {
+		return 0, notExist(name)
+	}
+	return int64(len(data)), nil
+}
+
+func (s *MemStorage) WriteBackup(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backups[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *MemStorage) DeleteBackups(names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		if _, ok := s.backups[name]; !ok {
+			return notExist(name)
+		}
+		delete(s.backups, name)
+	}
+	return nil
+}
+
+// RecoverPendingWrites 内存中的写入不会中断, 因此什么都不用做.
+func (s *MemStorage) RecoverPendingWrites() ([]string, error) {
+	return nil, nil
+}
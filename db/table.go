@@ -0,0 +1,176 @@
+package db
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+)
+
+// table 是内存数据库中的数据表 (原来是一个按 UpdatedAt 排序的 []*Mima).
+//
+// 记录按 UpdatedAt 排序, 最新(最近)的在后面, 采用链表保存, 因此更新一条记录时
+// 把它移到最后, 或者彻底删除一条记录, 都不需要挪动其他记录.
+// 同时维护 ID 和 Alias 的索引, 因此凭 ID 或 Alias 查找记录不需要逐条对比.
+// 即使 Rebuild 时整合成千上万个数据库碎片, 每个碎片也只需常数时间.
+//
+// 第一条记录 (The First Mima, 用于保存程序的设定) 单独保存, 不在链表和索引中.
+//
+// 注意: 修改记录的 Alias 之后, 必须调用 updateAlias 更新索引.
+type table struct {
+	first   *Mima
+	records *list.List // 元素为 *Mima
+	byID    map[string]*list.Element
+	byAlias map[string]map[string]*Mima // alias -> id -> mima
+}
+
+func newTable(first *Mima) *table {
+	return &table{
+		first:   first,
+		records: list.New(),
+		byID:    make(map[string]*list.Element),
+		byAlias: make(map[string]map[string]*Mima),
+	}
+}
+
+// addLatest 把 mimas 按 UpdatedAt 排序后加入 (相同的 UpdatedAt 保持原来的顺序),
+// 重复的 ID (包括已在表中的 ID) 只保留 UpdatedAt 最新的一条. 用于检查和抢救数据库.
+func (t *table) addLatest(mimas []*Mima) {
+	latest := make(map[string]*Mima)
+	for _, mima := range append(t.all()[1:], mimas...) {
+		if prev, ok := latest[mima.ID]; !ok || mima.UpdatedAt > prev.UpdatedAt {
+			latest[mima.ID] = mima
+		}
+	}
+	var records []*Mima
+	for _, mima := range append(t.all()[1:], mimas...) {
+		if latest[mima.ID] == mima {
+			records = append(records, mima)
+			delete(latest, mima.ID)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].UpdatedAt < records[j].UpdatedAt
+	})
+	t.records.Init()
+	t.byID = make(map[string]*list.Element)
+	t.byAlias = make(map[string]map[string]*Mima)
+	for _, mima := range records {
+		_ = t.add(mima) // 上面已去除重复的 ID, 不会出错.
+	}
+}
+
+// len 返回记录的数量 (包括第一条记录).
+func (t *table) len() int {
+	return t.records.Len() + 1
+}
+
+// get 凭 id 找记录, 找不到时返回 nil.
+func (t *table) get(id string) *Mima {
+	if e, ok := t.byID[id]; ok {
+		return e.Value.(*Mima)
+	}
+	return nil
+}
+
+// add 把 mima 加到最后 (因为新记录的更新日期必然是最新的), 不允许重复的 ID.
+func (t *table) add(mima *Mima) error {
+	if _, ok := t.byID[mima.ID]; ok {
+		return fmt.Errorf("重复的 id: %s", mima.ID)
+	}
+	t.byID[mima.ID] = t.records.PushBack(mima)
+	t.addAlias(mima.Alias, mima)
+	return nil
+}
+
+// moveToBack 把 mima 移到最后, 用于更新记录之后.
+func (t *table) moveToBack(mima *Mima) {
+	if e, ok := t.byID[mima.ID]; ok {
+		t.records.MoveToBack(e)
+	}
+}
+
+// insert 按 UpdatedAt 把 mima 插入到链表中 (相同的 UpdatedAt 排在后面), 不允许重复的 ID.
+// 用于写入数据库碎片失败时把记录放回原来的位置 (详见 DB.restoreRecord).
+func (t *table) insert(mima *Mima) error {
+	if _, ok := t.byID[mima.ID]; ok {
+		return fmt.Errorf("重复的 id: %s", mima.ID)
+	}
+	e := t.records.Back()
+	for e != nil && e.Value.(*Mima).UpdatedAt > mima.UpdatedAt {
+		e = e.Prev()
+	}
+	if e == nil {
+		t.byID[mima.ID] = t.records.PushFront(mima)
+	} else {
+		t.byID[mima.ID] = t.records.InsertAfter(mima, e)
+	}
+	t.addAlias(mima.Alias, mima)
+	return nil
+}
+
+// remove 删除记录 (包括索引).
+func (t *table) remove(mima *Mima) {
+	if e, ok := t.byID[mima.ID]; ok {
+		t.records.Remove(e)
+		delete(t.byID, mima.ID)
+		t.removeAlias(mima.Alias, mima)
+	}
+}
+
+// updateAlias 在 mima 的 Alias 从 oldAlias 改为当前值之后更新索引.
+func (t *table) updateAlias(mima *Mima, oldAlias string) {
+	if mima.Alias == oldAlias {
+		return
+	}
+	t.removeAlias(oldAlias, mima)
+	t.addAlias(mima.Alias, mima)
+}
+
+func (t *table) addAlias(alias string, mima *Mima) {
+	if alias == "" {
+		return
+	}
+	if t.byAlias[alias] == nil {
+		t.byAlias[alias] = make(map[string]*Mima)
+	}
+	t.byAlias[alias][mima.ID] = mima
+}
+
+func (t *table) removeAlias(alias string, mima *Mima) {
+	mimas := t.byAlias[alias]
+	if mimas == nil {
+		return
+	}
+	delete(mimas, mima.ID)
+	if len(mimas) == 0 {
+		delete(t.byAlias, alias)
+	}
+}
+
+// getByAlias 返回 Alias 为 alias 的全部记录 (包括已软删除的), 按 UpdatedAt 排序.
+func (t *table) getByAlias(alias string) (mimas []*Mima) {
+	for _, mima := range t.byAlias[alias] {
+		mimas = append(mimas, mima)
+	}
+	sort.Slice(mimas, func(i, j int) bool {
+		return mimas[i].UpdatedAt < mimas[j].UpdatedAt
+	})
+	return
+}
+
+// all 返回全部记录 (第一条记录在最前面, 其余按 UpdatedAt 排序), 即数据库文件中的顺序.
+func (t *table) all() []*Mima {
+	mimas := make([]*Mima, 0, t.len())
+	mimas = append(mimas, t.first)
+	for e := t.records.Front(); e != nil; e = e.Next() {
+		mimas = append(mimas, e.Value.(*Mima))
+	}
+	return mimas
+}
+
+// reverse 从最新到最旧依次对每条记录 (不包括第一条记录) 执行 fn.
+func (t *table) reverse(fn func(mima *Mima)) {
+	for e := t.records.Back(); e != nil; e = e.Prev() {
+		fn(e.Value.(*Mima))
+	}
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 撤销 (undo) 和重做 (redo):
+//
+// 本次登入期间的每个操作 (Add, Update, TrashByID, UnDeleteByID, DeleteHistoryItem, DeleteForeverByID)
+// 都记录在操作日志中 (只在内存中, 登出后清空), 包括操作前后该记录的完整内容 (连同历史记录).
+// 撤销和重做都不修改以前的数据库碎片, 而是生成新的碎片 (补偿操作), 把记录恢复为操作前 (或操作后) 的内容,
+// 因此撤销本身也可以通过时间点重建等方式查看. 只能按顺序撤销最近的操作, 撤销后进行新的操作会清空重做列表.
+
+// maxUndo 是操作日志最多保留的操作数量.
+const maxUndo = 50
+
+// errUndoConflict 表示记录已被操作日志以外的操作 (比如恢复整个备份) 修改, 无法撤销或重做.
+var errUndoConflict = errors.New("该记录已被其他操作修改, 无法撤销或重做")
+
+// opRecord 是操作日志中的一个操作. before 和 after 是操作前后该记录的副本, nil 表示该记录不存在.
+type opRecord struct {
+	time   time.Time
+	desc   string
+	id     string
+	before *Mima
+	after  *Mima
+}
+
+// OpLogItem 用于在网页中显示操作日志中的一个操作.
+type OpLogItem struct {
+	DateTime    string
+	Description string
+	Steps       int // 撤销 (或重做) 到这个操作为止一共需要撤销 (或重做) 的操作数量
+}
+
+// clone 返回 mima 的副本 (历史记录列表也是副本, 以免 DeleteHistory 修改原来的列表).
+func (mima *Mima) clone() *Mima {
+	if mima == nil {
+		return nil
+	}
+	c := *mima
+	c.History = append([]*History(nil), mima.History...)
+	return &c
+}
+
+// sameState 检查 mima 是否仍是 state 所记录的状态 (nil 表示不存在).
+// 不检查更新日期, 因为撤销和重做会更新日期 (详见 revertTo).
+func sameState(mima, state *Mima) bool {
+	if mima == nil || state == nil {
+		return mima == state
+	}
+	return mima.equalContent(state) && len(mima.History) == len(state.History)
+}
+
+// logOp 把一个已完成的操作记入操作日志, 并清空重做列表. before 是操作前该记录的副本.
+func (db *DB) logOp(desc, id string, before *Mima) {
+	after, _ := db.GetByID(id)
+	db.undoLog = append(db.undoLog, &opRecord{
+		time:   time.Now(),
+		desc:   desc,
+		id:     id,
+		before: before,
+		after:  after.clone(),
+	})
+	if len(db.undoLog) > maxUndo {
+		db.undoLog = db.undoLog[len(db.undoLog)-maxUndo:]
+	}
+	db.redoLog = nil
+}
+
+// clearOpLog 清空操作日志 (登出, 或者数据库文件被整个重写时).
+func (db *DB) clearOpLog() {
+	db.undoLog, db.redoLog = nil, nil
+}
+
+// describeUpdate 用文字说明一次修改 (从 before 改为 after) 改了哪些内容.
+func describeUpdate(before, after *Mima) string {
+	var changed []string
+	if before.Title != after.Title {
+		changed = append(changed, fmt.Sprintf("标题改为 %q", after.Title))
+	}
+	if before.Username != after.Username {
+		changed = append(changed, "修改了用户名")
+	}
+	if before.Password != after.Password {
+		changed = append(changed, "修改了密码")
+	}
+	if before.Notes != after.Notes {
+		changed = append(changed, "修改了备注")
+	}
+	if before.Alias != after.Alias {
+		changed = append(changed, fmt.Sprintf("Alias 从 %q 改为 %q", before.Alias, after.Alias))
+	}
+	if len(changed) == 0 {
+		return fmt.Sprintf("修改 %q", before.Title)
+	}
+	return fmt.Sprintf("修改 %q: %s", before.Title, strings.Join(changed, ", "))
+}
+
+// OpLog 返回可撤销的操作和可重做的操作, 都是最近的在前面.
+func (db *DB) OpLog() (undo, redo []*OpLogItem) {
+	items := func(ops []*opRecord) (items []*OpLogItem) {
+		for i := len(ops) - 1; i >= 0; i-- {
+			items = append(items, &OpLogItem{
+				DateTime:    ops[i].time.Format(DateTimeFormat),
+				Description: ops[i].desc,
+				Steps:       len(ops) - i,
+			})
+		}
+		return
+	}
+	return items(db.undoLog), items(db.redoLog)
+}
+
+// Undo 撤销最近的 n 个操作 (从最近的开始), 返回已撤销的操作的说明.
+// 中途出错时, 之前已撤销的操作仍然有效.
+func (db *DB) Undo(n int) (undone []string, err error) {
+	if n > len(db.undoLog) {
+		return nil, fmt.Errorf("只有 %d 个操作可以撤销", len(db.undoLog))
+	}
+	for i := 0; i < n; i++ {
+		op := db.undoLog[len(db.undoLog)-1]
+		if op.before, err = db.revertTo(op.id, op.after, op.before); err != nil {
+			return undone, fmt.Errorf("撤销 %s 失败: %w", op.desc, err)
+		}
+		db.undoLog = db.undoLog[:len(db.undoLog)-1]
+		db.redoLog = append(db.redoLog, op)
+		undone = append(undone, op.desc)
+	}
+	return undone, nil
+}
+
+// Redo 重做最近撤销的 n 个操作 (从最近撤销的开始), 返回已重做的操作的说明.
+// 中途出错时, 之前已重做的操作仍然有效.
+func (db *DB) Redo(n int) (redone []string, err error) {
+	if n > len(db.redoLog) {
+		return nil, fmt.Errorf("只有 %d 个操作可以重做", len(db.redoLog))
+	}
+	for i := 0; i < n; i++ {
+		op := db.redoLog[len(db.redoLog)-1]
+		if op.after, err = db.revertTo(op.id, op.before, op.after); err != nil {
+			return redone, fmt.Errorf("重做 %s 失败: %w", op.desc, err)
+		}
+		db.redoLog = db.redoLog[:len(db.redoLog)-1]
+		db.undoLog = append(db.undoLog, op)
+		redone = append(redone, op.desc)
+	}
+	return redone, nil
+}
+
+// revertTo 通过生成新的数据库碎片 (补偿操作), 把记录 id 从 current 状态恢复为 state 状态 (nil 表示不存在),
+// 返回恢复后的状态. 如果该记录已不是 current 状态, 就返回 errUndoConflict.
+// 恢复内容时更新日期采用当前时间 (因为数据表按更新日期排序), 历史记录则完全恢复为 state 的历史记录.
+func (db *DB) revertTo(id string, current, state *Mima) (*Mima, error) {
+	mima, _ := db.GetByID(id)
+	if !sameState(mima, current) {
+		return nil, errUndoConflict
+	}
+	switch {
+	case state == nil:
+		before := mima.clone()
+		if _, err := db.deleteByID(id); err != nil {
+			return nil, err
+		}
+		if err := db.sealAndWriteFrag(mima, DeleteForever); err != nil {
+			db.restoreRecord(mima, before)
+			return nil, err
+		}
+		return nil, nil
+	case mima == nil:
+		mima = state.clone()
+		mima.UpdatedAt = time.Now().UnixNano()
+		if err := db.mimaTable.add(mima); err != nil {
+			return nil, err
+		}
+		if err := db.sealAndWriteFrag(mima, Insert); err != nil {
+			db.restoreRecord(mima, nil)
+			return nil, err
+		}
+		return mima.clone(), nil
+	}
+
+	contentChanged := mima.Title != state.Title || mima.Username != state.Username ||
+		mima.Password != state.Password || mima.Notes != state.Notes
+	if contentChanged || mima.Alias != state.Alias || len(mima.History) != len(state.History) {
+		before, oldAlias := mima.clone(), mima.Alias
+		mima.Title, mima.Username = state.Title, state.Username
+		mima.Password, mima.Notes = state.Password, state.Notes
+		mima.Alias = state.Alias
+		mima.History = append([]*History(nil), state.History...)
+		db.mimaTable.updateAlias(mima, oldAlias)
+		if contentChanged {
+			mima.UpdatedAt = time.Now().UnixNano()
+			db.mimaTable.moveToBack(mima)
+		}
+		if err := db.sealAndWriteFrag(mima, Update); err != nil {
+			db.restoreRecord(mima, before)
+			return nil, err
+		}
+	}
+	if mima.IsDeleted() != state.IsDeleted() {
+		before, op := mima.clone(), UnDelete
+		if state.IsDeleted() {
+			mima.Delete()
+			op = SoftDelete
+		} else {
+			mima.UnDelete()
+		}
+		if err := db.sealAndWriteFrag(mima, op); err != nil {
+			db.restoreRecord(mima, before)
+			return nil, err
+		}
+	}
+	return mima.clone(), nil
+}
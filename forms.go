@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"sync"
 	"time"
+
+	mimaDB "github.com/ahui2016/mima-go/db"
 )
 
 type SearchResult struct {
@@ -23,6 +25,82 @@ type Feedback struct {
 	Info   error
 }
 
+// IndexForm 用来显示首页的全部记录, 以及尚未整合到数据库文件中的碎片数量.
+type IndexForm struct {
+	Forms            []*MimaForm
+	PendingFragments int
+}
+
+// InspectResult 用来表示数据库检查 (fsck) 或抢救 (salvage) 的结果.
+type InspectResult struct {
+	Report  *mimaDB.FsckReport
+	Salvage *mimaDB.SalvageReport
+	Err     error
+}
+
+// RecoveryKeyForm 用来显示恢复密钥, 或恢复密钥的状态.
+type RecoveryKeyForm struct {
+	RecoveryKey    string
+	HasRecoveryKey bool
+	LoggedOut      bool
+	Info           error
+	Err            error
+}
+
+// KeySlotsForm 用来显示和管理 key slot.
+type KeySlotsForm struct {
+	Slots       []mimaDB.SlotInfo
+	RecoveryKey string
+	Info        error
+	Err         error
+}
+
+// SharesForm 用来显示拆分内部密码得到的分享.
+type SharesForm struct {
+	Parts     int
+	Threshold int
+	Shares    []string
+	Info      error
+	Err       error
+}
+
+// RestoreForm 用来显示本地备份文件的列表, 或者其中一个备份文件 (Name) 中的记录.
+type RestoreForm struct {
+	Name    string
+	Backups []*mimaDB.BackupInfo
+	Backup  *mimaDB.BackupInfo
+	Entries []*mimaDB.BackupEntry
+	Info    error
+	Err     error
+}
+
+// PointInTimeForm 用来显示某个时间点 (At, 即 datetime-local 输入框的值) 的数据库中的记录.
+type PointInTimeForm struct {
+	At      string
+	State   *mimaDB.PointInTime
+	Entries []*mimaDB.BackupEntry
+	Info    error
+	Err     error
+}
+
+// UndoForm 用来显示本次登入期间可撤销和可重做的操作 (都是最近的在前面).
+type UndoForm struct {
+	Undo []*mimaDB.OpLogItem
+	Redo []*mimaDB.OpLogItem
+	Info error
+	Err  error
+}
+
+// DiffForm 用来选择需要对比的两个备份文件 (或当前的数据库, 即 CurrentVault), 并显示对比结果.
+type DiffForm struct {
+	Backups []*mimaDB.BackupInfo // 全部备份文件, 最新的在前面
+	From    string
+	To      string
+	Reveal  bool
+	Result  *mimaDB.Comparison
+	Err     error
+}
+
 // Settings 用来表示程序的设定, 暂时主要用于云备份.
 type Settings struct {
 	ApiKey            string
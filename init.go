@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // 一些常量
@@ -37,6 +38,24 @@ var (
 	localhost = "127.0.0.1"
 	port      = flag.Int("port", 10001, "端口: 80 <= port <= 65536")
 	validTerm = flag.Int("term", 30, "有效期: 1 <= term(minutes) <= 1024")
+
+	// 登入期间定时备份的间隔, 以及本地备份文件的保留策略 (详见 db.Retention).
+	snapshotEvery = flag.Int("snapshot", 60, "登入期间每隔多少分钟自动备份一次 (有修改时), 0 表示不定时备份")
+	keepLast      = flag.Int("keep-last", mimaDB.DefaultRetention.Last, "保留最新的多少个备份文件")
+	keepDaily     = flag.Int("keep-daily", mimaDB.DefaultRetention.Daily, "保留最近多少天每天一个备份文件")
+	keepWeekly    = flag.Int("keep-weekly", mimaDB.DefaultRetention.Weekly, "保留最近多少周每周一个备份文件")
+	keepMonthly   = flag.Int("keep-monthly", mimaDB.DefaultRetention.Monthly, "保留最近多少个月每月一个备份文件")
+
+	// 命令行模式: 检查数据库 (详见 db.Fsck) 或抢救数据库 (详见 db.Salvage) 后退出, 不启动网页服务.
+	fsckMode    = flag.Bool("fsck", false, "检查数据库后退出 (不启动网页服务), 需在终端输入密码")
+	repairMode  = flag.Bool("repair", false, "与 -fsck 一起使用: 发现问题时修复数据库 (修复前先备份)")
+	acceptMode  = flag.Bool("accept-tampered", false, "与 -fsck -repair 一起使用: 校验码或校验链不符时仍然修复 (确认内容可信后才使用)")
+	salvageMode = flag.Bool("salvage", false, "抢救损坏的数据库后退出 (不启动网页服务), 需在终端输入密码")
+	keyfilePath = flag.String("keyfile", "", "与 -fsck, -salvage 或 -diff 一起使用: keyfile 的路径 (如有)")
+
+	// 命令行模式: 对比两个备份文件, 或一个备份文件与当前的数据库 (详见 db.Compare).
+	diffMode   = flag.Bool("diff", false, "对比两个备份文件 (或一个备份文件与当前的数据库) 后退出, 需在终端输入密码")
+	revealMode = flag.Bool("reveal", false, "与 -diff 一起使用: 显示密码和备注的内容")
 )
 
 type (
@@ -78,6 +97,23 @@ func getTerm() int {
 	return *validTerm
 }
 
+func getSnapshotInterval() time.Duration {
+	if *snapshotEvery < 0 {
+		log.Fatal("out of range: snapshot(minutes) >= 0")
+	}
+	return time.Minute * time.Duration(*snapshotEvery)
+}
+
+func getRetention() mimaDB.Retention {
+	retention := mimaDB.Retention{
+		Last: *keepLast, Daily: *keepDaily, Weekly: *keepWeekly, Monthly: *keepMonthly,
+	}
+	if retention.Last < 0 || retention.Daily < 0 || retention.Weekly < 0 || retention.Monthly < 0 {
+		log.Fatal("out of range: keep-last, keep-daily, keep-weekly, keep-monthly >= 0")
+	}
+	return retention
+}
+
 // makeCOS 生成一个 COS 并保存到全局变量 cos 中.
 func makeCOS(settings64 string) error {
 	settings, err := NewSettingsFromJSON64(settings64)
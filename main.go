@@ -2,15 +2,18 @@ package main
 
 import (
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	mimaDB "github.com/ahui2016/mima-go/db"
 	"github.com/atotto/clipboard"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -22,10 +25,22 @@ type (
 )
 
 func main() {
-	// 有 checkState 中间件的, 在 checkState 里对数据库加锁;
-	// 没有 checkState 的, 要注意各自加锁.
+	flag.Parse()
+	// 命令行模式不启动网页服务, 因此在设置网页服务之前处理.
+	if *fsckMode || *salvageMode || *diffMode {
+		os.Exit(runCommand())
+	}
+
+	// 有 checkState, checkLogin 或 copyInBackground 中间件的, 由中间件在每次请求时对数据库加锁;
+	// 没有这些中间件的, 要注意各自加锁 (定时备份 snapshot 也要加锁).
 	http.HandleFunc("/create-account", noCache(createAccount))
 	http.HandleFunc("/change-password/", noCache(changePassword))
+	http.HandleFunc("/rotate-key/", noCache(rotateKey))
+	http.HandleFunc("/recovery-key/", noCache(recoveryKeyHandler))
+	http.HandleFunc("/key-slots/", noCache(keySlots))
+	http.HandleFunc("/shares/", noCache(sharesHandler))
+	http.HandleFunc("/recover-with-shares", noCache(recoverWithShares))
+	http.HandleFunc("/recover-with-key", noCache(recoverWithKey))
 	http.HandleFunc("/login", noCache(loginHandler))
 	http.HandleFunc("/logout", noCache(logoutHandler))
 	http.HandleFunc("/home/", homeHandler)
@@ -36,9 +51,14 @@ func main() {
 	http.HandleFunc("/api/add", checkLogin(addHandler))
 	http.HandleFunc("/delete/", noCache(checkState(deleteHandler)))
 	http.HandleFunc("/recyclebin/", noCache(checkState(recyclebin)))
+	http.HandleFunc("/undo/", noCache(checkState(undoHandler)))
 	http.HandleFunc("/undelete/", noCache(checkState(undeleteHandler)))
 	http.HandleFunc("/delete-forever/", noCache(checkState(deleteForever)))
 	http.HandleFunc("/delete-tarballs/", noCache(deleteTarballs))
+	http.HandleFunc("/restore/", noCache(restoreHandler))
+	http.HandleFunc("/point-in-time/", noCache(pointInTimeHandler))
+	http.HandleFunc("/diff/", noCache(diffHandler))
+	http.HandleFunc("/inspect-vault", noCache(inspectVault))
 	http.HandleFunc("/edit/", noCache(checkState(editPage)))
 	http.HandleFunc("/setup-ibm", noCache(setupIBM))
 	http.HandleFunc("/recover-from-ibm/", noCache(recoverFromIBM))
@@ -52,18 +72,85 @@ func main() {
 	http.HandleFunc("/api/copy-username", copyInBackground(copyUsername))
 	http.HandleFunc("/api/count-tarballs", countTarballs)
 
-	flag.Parse()
 	addr := getAddr()
 	term := getTerm()
 	db.ValidTerm = time.Minute * time.Duration(term)
+	db.Retention = getRetention()
 	fmt.Println(addr, "time limit:", term, "minutes")
+	// 锁定数据库文件夹失败时所有页面都只显示错误信息.
+	if err := lockDir(); err != nil {
+		log.Println(err)
+		log.Fatal(http.ListenAndServe(addr, vaultLocked(err)))
+	}
+	if err := recoverPendingWrites(); err != nil {
+		// 日志文件损坏时不启动网页服务 (以免在损坏的日志之后继续追加), 可用 -fsck 或 -salvage 处理.
+		log.Fatal(err)
+	}
 	// 默认 session 有效期为 2 小时, 改时间每次 logout 再 login 时重新计算.
 	// 这个参数实际上限制了命令行 -term 参数的最长时间.
 	sessionManager = NewSessionManager(time.Hour * 2)
+	if interval := getSnapshotInterval(); interval > 0 {
+		go scheduleSnapshots(interval)
+	}
 	log.Fatal(http.ListenAndServe(addr, nil))
 }
 
+// lockDir 锁定数据库文件夹, 防止两个进程同时写入.
+func lockDir() error {
+	stalePID, err := db.LockDir()
+	if err != nil {
+		return err
+	}
+	if stalePID > 0 {
+		log.Printf("已接管已退出的进程 (PID: %d) 留下的锁", stalePID)
+	}
+	return nil
+}
+
+// recoverPendingWrites 处理上次未完成的写入 (比如程序崩溃或断电时留下的临时文件), 并记录已执行的操作.
+// 日志文件损坏时返回 ErrTampered (详见 DB.RecoverPendingWrites).
+func recoverPendingWrites() error {
+	notes, err := db.RecoverPendingWrites()
+	for _, note := range notes {
+		log.Println(note)
+	}
+	return err
+}
+
+// runCommand 执行命令行模式 (-fsck, -salvage 或 -diff), 返回程序的退出码.
+// 数据库文件夹已被另一个进程 (比如正在运行的网页服务) 锁定时, 报告错误并返回 2.
+func runCommand() int {
+	if err := lockDir(); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if err := recoverPendingWrites(); err != nil {
+		log.Println(err)
+		// 日志文件损坏时仍可用 -fsck 或 -salvage 检查和修复.
+		if !errors.Is(err, mimaDB.ErrTampered) || *diffMode {
+			return 2
+		}
+	}
+	switch {
+	case *fsckMode:
+		return runFsck()
+	case *salvageMode:
+		return runSalvage()
+	}
+	return runDiff(flag.Args())
+}
+
+// vaultLocked 在数据库已被另一个进程打开时使用, 不论访问哪个页面都显示错误信息.
+func vaultLocked(lockErr error) httpHF {
+	return func(w httpRW, r httpReq) {
+		w.WriteHeader(http.StatusConflict)
+		checkErr(w, templates.ExecuteTemplate(w, "vault-locked", &Feedback{Err: lockErr}))
+	}
+}
+
 func createAccount(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
 	if !isLoggedOut(r) || !db.FileNotExist() {
 		err := &Feedback{Err: errors.New("已存在账号, 不可重复创建")}
 		checkErr(w, templates.ExecuteTemplate(w, "create-account", err))
@@ -79,17 +166,28 @@ func createAccount(w httpRW, r httpReq) {
 		checkErr(w, templates.ExecuteTemplate(w, "create-account", err))
 		return
 	}
-	key := sha256.Sum256([]byte(password))
-	if err := db.Init(&key); err != nil {
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "create-account", &Feedback{Err: err}))
+		return
+	}
+	recoveryKey, err := db.Init(password, keyfile)
+	if err != nil {
 		checkErr(w, templates.ExecuteTemplate(w, "create-account", &Feedback{Err: err}))
 		return
 	}
 	logout(w)
-	info := &Feedback{Info: errors.New("成功创建新账号, 请登入")}
-	checkErr(w, templates.ExecuteTemplate(w, "login", info))
+	form := &RecoveryKeyForm{
+		RecoveryKey: recoveryKey,
+		LoggedOut:   true,
+		Info:        errors.New("成功创建新账号, 请先保存恢复密钥, 然后登入"),
+	}
+	checkErr(w, templates.ExecuteTemplate(w, "recovery-key", form))
 }
 
 func changePassword(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
 	if isLoggedOut(r) || db.FileNotExist() {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
@@ -99,22 +197,280 @@ func changePassword(w httpRW, r httpReq) {
 		return
 	}
 	oldPwd := r.FormValue("old-pwd")
-	key := sha256.Sum256([]byte(oldPwd))
-	if !db.EqualToUserKey(key) {
-		err := &Feedback{Err: errors.New("当前密码错误, 为了提高安全性必须输入正确的当前密码")}
-		checkErr(w, templates.ExecuteTemplate(w, "change-password", err))
+	oldKeyfile, err := getKeyfile(r, "old-keyfile")
+	if err == nil {
+		err = db.CheckPassword(oldPwd, oldKeyfile)
+	}
+	if err != nil {
+		err = fmt.Errorf("为了提高安全性必须输入正确的当前密码 (以及当前 keyfile): %w", err)
+		checkErr(w, templates.ExecuteTemplate(w, "change-password", &Feedback{Err: err}))
 		return
 	}
 	newPwd := r.FormValue("new-pwd")
-	if err := db.ChangeUserKey(newPwd); err != nil {
+	newKeyfile, err := getKeyfile(r, "new-keyfile")
+	if err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "change-password", &Feedback{Err: err}))
+		return
+	}
+	if err := db.ChangeUserKey(newPwd, newKeyfile); err != nil {
 		checkErr(w, templates.ExecuteTemplate(w, "change-password", &Feedback{Err: err}))
 		return
 	}
+	var recoveryKey string
+	if r.FormValue("rotate-key") != "" {
+		if recoveryKey, err = db.RotateKey(newPwd, newKeyfile); err != nil {
+			err = fmt.Errorf("密码已修改, 但更换内部密码失败: %w", err)
+			checkErr(w, templates.ExecuteTemplate(w, "change-password", &Feedback{Err: err}))
+			return
+		}
+	}
 	logout(w)
+	if recoveryKey != "" {
+		form := &RecoveryKeyForm{
+			RecoveryKey: recoveryKey,
+			LoggedOut:   true,
+			Info:        errors.New("密码修改成功, 并已更换内部密码. 旧的恢复密钥已失效, 请保存新的恢复密钥, 然后使用新密码登入"),
+		}
+		checkErr(w, templates.ExecuteTemplate(w, "recovery-key", form))
+		return
+	}
 	info := &Feedback{Info: errors.New("密码修改成功, 请使用新密码登入")}
 	checkErr(w, templates.ExecuteTemplate(w, "login", info))
 }
 
+// rotateKey 更换内部密码 (DB.key), 并用新的内部密码重新加密全部记录.
+func rotateKey(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
+	if isLoggedOut(r) || db.FileNotExist() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		checkErr(w, templates.ExecuteTemplate(w, "rotate-key", nil))
+		return
+	}
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "rotate-key", &Feedback{Err: err}))
+		return
+	}
+	recoveryKey, err := db.RotateKey(r.FormValue("password"), keyfile)
+	if err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "rotate-key", &Feedback{Err: err}))
+		return
+	}
+	if recoveryKey != "" {
+		form := &RecoveryKeyForm{
+			RecoveryKey:    recoveryKey,
+			HasRecoveryKey: true,
+			Info:           errors.New("已更换内部密码, 全部记录已重新加密. 旧的恢复密钥已失效, 请保存新的恢复密钥"),
+		}
+		checkErr(w, templates.ExecuteTemplate(w, "recovery-key", form))
+		return
+	}
+	info := &Feedback{Info: errors.New("已更换内部密码, 全部记录已重新加密")}
+	checkErr(w, templates.ExecuteTemplate(w, "rotate-key", info))
+}
+
+// recoveryKeyHandler 查看恢复密钥的状态, 重新生成或撤销恢复密钥.
+func recoveryKeyHandler(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
+	if isLoggedOut(r) || db.FileNotExist() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	form := &RecoveryKeyForm{HasRecoveryKey: db.HasRecoveryKey()}
+	if r.Method != http.MethodPost {
+		checkErr(w, templates.ExecuteTemplate(w, "recovery-key", form))
+		return
+	}
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err == nil {
+		err = db.CheckPassword(r.FormValue("password"), keyfile)
+	}
+	if err == nil {
+		switch r.FormValue("action") {
+		case "regenerate":
+			if form.RecoveryKey, err = db.NewRecoveryKey(); err == nil {
+				form.Info = errors.New("已生成新的恢复密钥, 旧的恢复密钥已失效, 请保存新的恢复密钥")
+			}
+		case "revoke":
+			if err = db.RevokeRecoveryKey(); err == nil {
+				form.Info = errors.New("已撤销恢复密钥")
+			}
+		default:
+			err = errors.New("未知操作: " + r.FormValue("action"))
+		}
+	}
+	form.Err = err
+	form.HasRecoveryKey = db.HasRecoveryKey()
+	checkErr(w, templates.ExecuteTemplate(w, "recovery-key", form))
+}
+
+// keySlots 查看, 添加, 删除 key slot (比如团队中每个成员一个密码).
+// 删除 key slot 时可选择同时更换内部密码, 此时其他成员的 key slot 也会被删除, 需要重新添加.
+func keySlots(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
+	if isLoggedOut(r) || db.FileNotExist() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	form := new(KeySlotsForm)
+	if r.Method == http.MethodPost {
+		form.RecoveryKey, form.Info, form.Err = updateKeySlots(r)
+	}
+	form.Slots = db.Slots()
+	checkErr(w, templates.ExecuteTemplate(w, "key-slots", form))
+}
+
+// updateKeySlots 根据表单添加或删除 key slot, 必须先输入正确的当前密码 (以及当前 keyfile).
+// 如果同时更换了内部密码并生成了新的恢复密钥, 返回新的恢复密钥.
+func updateKeySlots(r httpReq) (recoveryKey string, info error, err error) {
+	password := r.FormValue("password")
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err != nil {
+		return
+	}
+	if err = db.CheckPassword(password, keyfile); err != nil {
+		err = fmt.Errorf("为了提高安全性必须输入正确的当前密码 (以及当前 keyfile): %w", err)
+		return
+	}
+	switch r.FormValue("action") {
+	case "add":
+		memberKeyfile, err := getKeyfile(r, "member-keyfile")
+		if err != nil {
+			return "", nil, err
+		}
+		label := r.FormValue("label")
+		if err := db.AddSlot(label, r.FormValue("member-pwd"), memberKeyfile); err != nil {
+			return "", nil, err
+		}
+		info = fmt.Errorf("已添加 key slot: %s", label)
+	case "remove":
+		if err = db.RemoveSlot(r.FormValue("slot-id")); err != nil {
+			return
+		}
+		info = errors.New("已删除 key slot")
+		if r.FormValue("rotate-key") != "" {
+			if recoveryKey, err = db.RotateKey(password, keyfile); err != nil {
+				err = fmt.Errorf("已删除 key slot, 但更换内部密码失败: %w", err)
+				return
+			}
+			info = errors.New("已删除 key slot 并更换内部密码, 其他成员的 key slot 已失效, 请重新添加")
+		}
+	default:
+		err = errors.New("未知操作: " + r.FormValue("action"))
+	}
+	return
+}
+
+// sharesHandler 把内部密码拆分为 n 份, 任意 m 份即可还原 (用于紧急访问).
+func sharesHandler(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
+	if isLoggedOut(r) || db.FileNotExist() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	form := &SharesForm{Parts: 5, Threshold: 3}
+	if r.Method != http.MethodPost {
+		checkErr(w, templates.ExecuteTemplate(w, "shares", form))
+		return
+	}
+	parts, err1 := strconv.Atoi(r.FormValue("parts"))
+	threshold, err2 := strconv.Atoi(r.FormValue("threshold"))
+	if err1 != nil || err2 != nil {
+		form.Err = errors.New("份数和门限必须是整数")
+		checkErr(w, templates.ExecuteTemplate(w, "shares", form))
+		return
+	}
+	form.Parts, form.Threshold = parts, threshold
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err == nil {
+		err = db.CheckPassword(r.FormValue("password"), keyfile)
+	}
+	if err == nil {
+		form.Shares, err = db.SplitKey(parts, threshold)
+	}
+	if err != nil {
+		form.Err = err
+		checkErr(w, templates.ExecuteTemplate(w, "shares", form))
+		return
+	}
+	form.Info = fmt.Errorf("已把内部密码拆分为 %d 份, 任意 %d 份即可还原", parts, threshold)
+	checkErr(w, templates.ExecuteTemplate(w, "shares", form))
+}
+
+// recoverWithShares 用至少 m 份分享还原内部密码, 并设置新密码.
+func recoverWithShares(w httpRW, r httpReq) {
+	if db.FileNotExist() {
+		http.Redirect(w, r, "/create-account", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		checkErr(w, templates.ExecuteTemplate(w, "recover-with-shares", nil))
+		return
+	}
+	newPwd := r.FormValue("new-pwd")
+	if newPwd == "" {
+		err := &Feedback{Err: errors.New("密码不能为空")}
+		checkErr(w, templates.ExecuteTemplate(w, "recover-with-shares", err))
+		return
+	}
+	newKeyfile, err := getKeyfile(r, "new-keyfile")
+	if err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "recover-with-shares", &Feedback{Err: err}))
+		return
+	}
+	shares := strings.Split(r.FormValue("shares"), "\n")
+	db.Lock()
+	defer db.Unlock()
+	if err := db.RecoverWithShares(shares, newPwd, newKeyfile); err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "recover-with-shares", &Feedback{Err: err}))
+		return
+	}
+	// 数据库文件已改变, 必须重新登入 (重新读取数据库文件).
+	logout(w)
+	info := &Feedback{Info: errors.New("已还原内部密码并设置新密码, 请使用新密码登入")}
+	checkErr(w, templates.ExecuteTemplate(w, "login", info))
+}
+
+// recoverWithKey 忘记密码时, 用恢复密钥设置新密码.
+func recoverWithKey(w httpRW, r httpReq) {
+	if db.FileNotExist() {
+		http.Redirect(w, r, "/create-account", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		checkErr(w, templates.ExecuteTemplate(w, "recover-with-key", nil))
+		return
+	}
+	newPwd := r.FormValue("new-pwd")
+	if newPwd == "" {
+		err := &Feedback{Err: errors.New("密码不能为空")}
+		checkErr(w, templates.ExecuteTemplate(w, "recover-with-key", err))
+		return
+	}
+	newKeyfile, err := getKeyfile(r, "new-keyfile")
+	if err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "recover-with-key", &Feedback{Err: err}))
+		return
+	}
+	db.Lock()
+	defer db.Unlock()
+	if err := db.RecoverWithKey(r.FormValue("recovery-key"), newPwd, newKeyfile); err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "recover-with-key", &Feedback{Err: err}))
+		return
+	}
+	// 数据库文件已改变, 必须重新登入 (重新读取数据库文件).
+	logout(w)
+	info := &Feedback{Info: errors.New("已设置新密码, 请使用新密码登入")}
+	checkErr(w, templates.ExecuteTemplate(w, "login", info))
+}
+
 func loginHandler(w httpRW, r httpReq) {
 	db.Lock()
 	defer db.Unlock()
@@ -133,20 +489,29 @@ func loginHandler(w httpRW, r httpReq) {
 		return
 	}
 	password := r.FormValue("password")
-	key := sha256.Sum256([]byte(password))
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "login", &Feedback{Err: err}))
+		return
+	}
 	if db.IsNotInit() {
 		db.Reset()
-		if _, err := db.Rebuild(&key); err != nil {
+		if _, err := db.Rebuild(password, keyfile); err != nil {
 			logout(w)
-			checkErr(w, templates.ExecuteTemplate(w, "login", &Feedback{Err: err}))
+			fb := &Feedback{Err: err}
+			switch {
+			case errors.Is(err, mimaDB.ErrTampered):
+				fb.Msg = "可前往 /inspect-vault 查看数据库的全部问题."
+			case !errors.Is(err, mimaDB.ErrWrongPassword) && !errors.Is(err, mimaDB.ErrNeedKeyfile):
+				fb.Msg = "如果数据库文件已损坏, 可前往 /inspect-vault 检查或抢救 (Salvage)."
+			}
+			checkErr(w, templates.ExecuteTemplate(w, "login", fb))
 			return
 		}
 		// 必须更新时间, 这是容易忽略出错的地方.
 		// 如果不更新时间, 会出现 "未登入, 已超时" 的错误.
 		db.StartedAt = time.Now()
-	}
-	if key != db.UserKey() {
-		err := errors.New("密码错误")
+	} else if err := db.CheckPassword(password, keyfile); err != nil {
 		checkErr(w, templates.ExecuteTemplate(w, "login", &Feedback{Err: err}))
 		return
 	}
@@ -156,7 +521,40 @@ func loginHandler(w httpRW, r httpReq) {
 	http.Redirect(w, r, "/home/", http.StatusFound)
 }
 
+// inspectVault 全面检查数据库文件和数据库碎片 (详见 DB.Fsck), 如果勾选了修复, 发现问题时修复数据库.
+// 也可以抢救损坏的数据库 (详见 DB.Salvage). 修复或抢救后需要重新登入.
+func inspectVault(w httpRW, r httpReq) {
+	if r.Method != http.MethodPost {
+		checkErr(w, templates.ExecuteTemplate(w, "inspect-vault", nil))
+		return
+	}
+	db.Lock()
+	defer db.Unlock()
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err != nil {
+		checkErr(w, templates.ExecuteTemplate(w, "inspect-vault", &InspectResult{Err: err}))
+		return
+	}
+	result := new(InspectResult)
+	if r.FormValue("action") == "salvage" {
+		result.Salvage, result.Err = db.Salvage(r.FormValue("password"), keyfile)
+		if result.Salvage != nil && result.Salvage.Backup != "" {
+			logout(w)
+		}
+	} else {
+		result.Report, result.Err = db.Fsck(r.FormValue("password"), keyfile,
+			r.FormValue("repair") == "on", r.FormValue("accept-tampered") == "on")
+		if result.Report != nil && result.Report.Backup != "" {
+			logout(w)
+		}
+	}
+	checkErr(w, templates.ExecuteTemplate(w, "inspect-vault", result))
+}
+
 func logoutHandler(w httpRW, _ httpReq) {
+	db.Lock()
+	defer db.Unlock()
+	compactFragments()
 	logout(w)
 	info := &Feedback{Info: errors.New("已登出, 请重新登入")}
 	checkErr(w, templates.ExecuteTemplate(w, "login", info))
@@ -222,7 +620,12 @@ func recoverFromIBM(w httpRW, r httpReq) {
 		checkErrForRecoverFromIBM(w, err.Error(), &settings)
 		return
 	}
-	if err := db.WriteDBFileFromReader(data, r.FormValue("password"), settings64); err != nil {
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err != nil {
+		checkErrForRecoverFromIBM(w, err.Error(), &settings)
+		return
+	}
+	if err := db.WriteDBFileFromReader(data, r.FormValue("password"), keyfile, settings64); err != nil {
 		checkErrForRecoverFromIBM(w, err.Error(), &settings)
 		return
 	}
@@ -239,6 +642,27 @@ func recoverFromIBM(w httpRW, r httpReq) {
 	checkErr(w, templates.ExecuteTemplate(w, "backup-to-cloud", cloudInfo))
 }
 
+// getKeyfile 读取表单中上传的 keyfile (字段名为 name). 未选择文件时返回 nil.
+func getKeyfile(r httpReq, name string) ([]byte, error) {
+	file, _, err := r.FormFile(name)
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+	keyfile, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyfile) == 0 {
+		return nil, errors.New("keyfile 不可为空文件")
+	}
+	return keyfile, nil
+}
+
 func getSettings(r httpReq, needObjName bool) (settings Settings, err error) {
 	var prefix string
 	prefix = mimaDB.NewID()
@@ -353,7 +777,8 @@ func homeHandler(w httpRW, r httpReq) {
 }
 
 func indexHandler(w httpRW, _ httpReq) {
-	checkErr(w, templates.ExecuteTemplate(w, "index", db.All()))
+	form := &IndexForm{Forms: db.All(), PendingFragments: db.PendingFragments()}
+	checkErr(w, templates.ExecuteTemplate(w, "index", form))
 }
 
 func searchHandler(w httpRW, r httpReq) {
@@ -381,6 +806,39 @@ func recyclebin(w httpRW, _ httpReq) {
 	checkErr(w, templates.ExecuteTemplate(w, "recyclebin", db.DeletedMimas()))
 }
 
+// undoHandler 列出本次登入期间的操作, 撤销或重做最近的 n 个操作 (生成新的数据库碎片).
+func undoHandler(w httpRW, r httpReq) {
+	form := new(UndoForm)
+	if r.Method == http.MethodPost {
+		form.Info, form.Err = undoOrRedo(r.FormValue("action"), r.FormValue("n"))
+	}
+	form.Undo, form.Redo = db.OpLog()
+	checkErr(w, templates.ExecuteTemplate(w, "undo", form))
+}
+
+// undoOrRedo 根据表单撤销或重做最近的 n 个操作.
+func undoOrRedo(action, value string) (info error, err error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return nil, errors.New("操作数量错误: " + value)
+	}
+	var done []string
+	switch action {
+	case "undo":
+		done, err = db.Undo(n)
+		action = "撤销"
+	case "redo":
+		done, err = db.Redo(n)
+		action = "重做"
+	default:
+		return nil, errors.New("未知操作: " + action)
+	}
+	if len(done) > 0 {
+		info = fmt.Errorf("已%s: %s", action, strings.Join(done, "; "))
+	}
+	return
+}
+
 func addPage(w httpRW, _ httpReq) {
 	checkErr(w, templates.ExecuteTemplate(w, "add", nil))
 }
@@ -473,27 +931,160 @@ func deleteHandler(w httpRW, r httpReq) {
 	http.Redirect(w, r, "/home/", http.StatusFound)
 }
 
+// deleteTarballs 按保留策略 (db.Retention) 删除本地备份文件.
 func deleteTarballs(w httpRW, r httpReq) {
-	fb := new(Feedback)
-	fragFiles, err := db.GetTarballPaths()
-	if err != nil {
-		fb.Err = err
-	}
-	n := len(fragFiles)
-	if r.Method != http.MethodPost {
-		fb.Number = n
-		checkErr(w, templates.ExecuteTemplate(w, "delete-tarballs", fb))
+	db.Lock()
+	defer db.Unlock()
+	if isLoggedOut(r) || db.FileNotExist() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
-	if n > 10 {
-		if err := mimaDB.DeleteFiles(fragFiles[:n-10]); err != nil {
+	fb := &Feedback{Msg: db.Retention.String()}
+	if r.Method == http.MethodPost {
+		pruned, err := db.PruneBackups()
+		if err != nil {
 			fb.Err = err
+		} else {
+			fb.Info = fmt.Errorf("已删除 %d 个备份文件", len(pruned))
 		}
 	}
-	fb.Info = errors.New("已成功删除一部分备份文件")
+	prune, err := db.BackupsToPrune()
+	if err != nil && fb.Err == nil {
+		fb.Err = err
+	}
+	fb.Number = len(prune)
 	checkErr(w, templates.ExecuteTemplate(w, "delete-tarballs", fb))
 }
 
+// restoreHandler 列出本地备份文件, 预览其中的记录, 恢复整个数据库或选中的记录 (恢复前先备份当前状态).
+func restoreHandler(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
+	if isLoggedOut(r) || db.FileNotExist() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	form := &RestoreForm{Name: r.FormValue("name")}
+	if r.Method == http.MethodPost {
+		form.Info, form.Err = restoreFromBackup(r, form.Name)
+	}
+	var err error
+	if form.Name == "" {
+		form.Backups, err = db.BackupInfos()
+	} else {
+		form.Backup, form.Entries, err = db.BackupEntries(form.Name)
+	}
+	if form.Err == nil {
+		form.Err = err
+	}
+	checkErr(w, templates.ExecuteTemplate(w, "restore", form))
+}
+
+// restoreFromBackup 根据表单恢复整个数据库或选中的记录, 必须先输入正确的当前密码 (以及当前 keyfile).
+func restoreFromBackup(r httpReq, name string) (info error, err error) {
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err == nil {
+		err = db.CheckPassword(r.FormValue("password"), keyfile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("为了提高安全性必须输入正确的当前密码 (以及当前 keyfile): %w", err)
+	}
+	var safety string
+	switch r.FormValue("action") {
+	case "all":
+		if safety, err = db.RestoreBackup(name); err == nil {
+			info = fmt.Errorf("已恢复整个数据库, 恢复前的状态已备份到 %s", safety)
+		}
+	case "entries":
+		ids := r.Form["id"]
+		if safety, err = db.RestoreEntries(name, ids); err == nil {
+			info = fmt.Errorf("已恢复 %d 条记录, 恢复前的状态已备份到 %s", len(ids), safety)
+		}
+	default:
+		err = errors.New("未知操作: " + r.FormValue("action"))
+	}
+	return
+}
+
+// pointInTimeHandler 重建某个时间点的数据库, 只读浏览其中的记录并与当前对比, 恢复选中的记录 (恢复前先备份当前状态).
+func pointInTimeHandler(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
+	if isLoggedOut(r) || db.FileNotExist() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	form := &PointInTimeForm{At: r.FormValue("at")}
+	if form.At == "" {
+		checkErr(w, templates.ExecuteTemplate(w, "point-in-time", form))
+		return
+	}
+	at, err := parseDateTimeLocal(form.At)
+	if err != nil {
+		form.Err = err
+		checkErr(w, templates.ExecuteTemplate(w, "point-in-time", form))
+		return
+	}
+	if r.Method == http.MethodPost {
+		form.Info, form.Err = restoreFromPointInTime(r, at)
+	}
+	form.State, form.Entries, err = db.PointInTimeEntries(at)
+	if form.Err == nil {
+		form.Err = err
+	}
+	checkErr(w, templates.ExecuteTemplate(w, "point-in-time", form))
+}
+
+// diffHandler 对比两个备份文件, 或一个备份文件与当前的数据库.
+func diffHandler(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
+	if isLoggedOut(r) || db.FileNotExist() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	form := &DiffForm{
+		From:   r.FormValue("from"),
+		To:     r.FormValue("to"),
+		Reveal: r.FormValue("reveal") == "on",
+	}
+	var err error
+	form.Backups, err = db.BackupInfos()
+	if err == nil && form.From != "" && form.To != "" {
+		form.Result, err = db.Compare(form.From, form.To, form.Reveal)
+	}
+	form.Err = err
+	checkErr(w, templates.ExecuteTemplate(w, "diff", form))
+}
+
+// parseDateTimeLocal 解析 datetime-local 输入框的值 (本地时间, 秒可省略).
+func parseDateTimeLocal(value string) (t time.Time, err error) {
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err = time.ParseInLocation(layout, value, time.Local); err == nil {
+			return
+		}
+	}
+	return t, fmt.Errorf("时间格式错误: %s", value)
+}
+
+// restoreFromPointInTime 把时间点 at 的数据库中选中的记录恢复到当前数据库中,
+// 必须先输入正确的当前密码 (以及当前 keyfile).
+func restoreFromPointInTime(r httpReq, at time.Time) (info error, err error) {
+	keyfile, err := getKeyfile(r, "keyfile")
+	if err == nil {
+		err = db.CheckPassword(r.FormValue("password"), keyfile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("为了提高安全性必须输入正确的当前密码 (以及当前 keyfile): %w", err)
+	}
+	ids := r.Form["id"]
+	safety, err := db.RestoreEntriesAt(at, ids)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Errorf("已恢复 %d 条记录, 恢复前的状态已备份到 %s", len(ids), safety), nil
+}
+
 func undeleteHandler(w httpRW, r httpReq) {
 	form := new(MimaForm)
 	id, ok := getAndCheckID(w, r, "undelete", form)
@@ -545,23 +1136,31 @@ func deleteHistory(w httpRW, r httpReq) {
 		http.Error(w, "id 不可为空", http.StatusNotAcceptable)
 		return
 	}
+	seq, err := strconv.ParseUint(r.FormValue("seq"), 10, 64)
 	datetime := strings.TrimSpace(r.FormValue("datetime"))
-	if len(datetime) < len(mimaDB.DateTimeFormat) {
-		http.Error(w, fmt.Sprintf("格式错误: %s", datetime), http.StatusConflict)
+	if err != nil || len(datetime) < len(mimaDB.DateTimeFormat) {
+		http.Error(w, fmt.Sprintf("格式错误: %s (%s)", r.FormValue("seq"), datetime), http.StatusConflict)
 		return
 	}
-	if err := db.DeleteHistoryItem(id, datetime); err != nil {
+	if err := db.DeleteHistoryItem(id, seq, datetime); err != nil {
 		http.Error(w, err.Error(), http.StatusConflict)
 	}
 }
 
-func countTarballs(w httpRW, _ httpReq) {
-	fragFiles, err := db.GetTarballPaths()
+func countTarballs(w httpRW, r httpReq) {
+	db.Lock()
+	defer db.Unlock()
+	if isLoggedOut(r) {
+		http.Error(w, "未登入(或已登出)", http.StatusNotAcceptable)
+		return
+	}
+	tarballs, err := db.BackupsToPrune()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	if len(fragFiles) <= 10 {
-		http.Error(w, "不超过 10 个备份文件, 不需要删除.", http.StatusNotAcceptable)
+	if len(tarballs) == 0 {
+		http.Error(w, "按保留策略没有需要删除的备份文件.", http.StatusNotAcceptable)
 	}
 }
 
@@ -596,6 +1195,159 @@ func checkErr(w httpRW, err error) {
 	}
 }
 
+// runFsck 在命令行中检查数据库 (-fsck, 可选 -repair, -accept-tampered 和 -keyfile), 返回程序的退出码:
+// 未发现问题 (或已修复) 返回 0, 发现问题返回 1, 无法检查返回 2.
+func runFsck() int {
+	password, keyfile, err := readPasswordAndKeyfile()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	report, err := db.Fsck(password, keyfile, *repairMode, *acceptMode)
+	if report == nil {
+		log.Println(err)
+		return 2
+	}
+	fmt.Printf("记录: %d, 数据库碎片: %d\n", report.Records, report.Fragments)
+	for _, problem := range report.Problems {
+		fmt.Println("-", problem)
+	}
+	if len(report.Dropped) > 0 {
+		fmt.Println("以下部分无法通过验证或无法应用, 修复时不会写入数据库文件:")
+		for _, dropped := range report.Dropped {
+			fmt.Println("-", dropped)
+		}
+	}
+	switch {
+	case errors.Is(err, mimaDB.ErrNeedAcceptTampered):
+		fmt.Println(err)
+		fmt.Println("确认内容可信 (比如只是碎片缺失) 后, 可加上 -accept-tampered 参数修复.")
+		return 1
+	case err != nil:
+		log.Println("修复失败:", err)
+		return 2
+	case len(report.Problems) == 0:
+		fmt.Println("未发现问题.")
+	case report.Backup != "":
+		fmt.Println("已修复, 修复前的数据库已备份到", report.Backup)
+	default:
+		fmt.Println("发现以上问题, 可加上 -repair 参数修复.")
+		return 1
+	}
+	return 0
+}
+
+// runSalvage 在命令行中抢救损坏的数据库 (-salvage, 可选 -keyfile), 返回程序的退出码:
+// 抢救成功返回 0, 失败返回 2.
+func runSalvage() int {
+	password, keyfile, err := readPasswordAndKeyfile()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	report, err := db.Salvage(password, keyfile)
+	if report == nil {
+		log.Println(err)
+		return 2
+	}
+	printSalvageReport(report)
+	if err != nil {
+		log.Println("抢救失败:", err)
+		return 2
+	}
+	fmt.Println("抢救完成, 抢救前的数据库已备份到", report.Backup)
+	return 0
+}
+
+func printSalvageReport(report *mimaDB.SalvageReport) {
+	fmt.Println("从当前的数据库文件和碎片中找回的记录:", report.Recovered)
+	for _, item := range report.FromBackups {
+		fmt.Println("取自备份文件:", item)
+	}
+	for _, item := range report.Lost {
+		fmt.Println("无法恢复:", item)
+	}
+}
+
+// runDiff 在命令行中对比两个备份文件 (args 为两个文件名), 或一个备份文件与当前的数据库 (args 为一个文件名),
+// 返回程序的退出码: 没有变化返回 0, 有变化返回 1, 出错返回 2.
+func runDiff(args []string) int {
+	if len(args) == 1 {
+		args = append(args, mimaDB.CurrentVault)
+	}
+	if len(args) != 2 {
+		log.Println("用法: mima-go -diff [-reveal] [-keyfile path] backup1.tar.gz [backup2.tar.gz]")
+		return 2
+	}
+	password, keyfile, err := readPasswordAndKeyfile()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	result, err := db.CompareWithPassword(
+		password, keyfile, args[0], args[1], *revealMode)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	fmt.Printf("%s -> %s\n", result.From, result.To)
+	for _, change := range result.Changes {
+		fmt.Println(change)
+	}
+	fmt.Printf("有变化的记录: %d, 没有变化的记录: %d\n", len(result.Changes), result.Unchanged)
+	if len(result.Changes) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readPasswordAndKeyfile 在终端中读取密码 (不显示), 以及 -keyfile 参数指定的 keyfile (如有).
+func readPasswordAndKeyfile() (password string, keyfile []byte, err error) {
+	if *keyfilePath != "" {
+		if keyfile, err = ioutil.ReadFile(*keyfilePath); err != nil {
+			return
+		}
+	}
+	fmt.Print("Password: ")
+	pwd, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(pwd), keyfile, err
+}
+
+// compactFragments 在主动登出或超时登出前把数据库碎片整合到数据库文件中 (详见 DB.Compact).
+// 出错时只记录日志, 碎片仍会保留到下次登入时整合.
+func compactFragments() {
+	if db.IsNotInit() || db.PendingFragments() == 0 {
+		return
+	}
+	if _, err := db.Compact(); err != nil {
+		log.Println("整合数据库碎片失败:", err)
+	}
+}
+
+// scheduleSnapshots 在登入期间每隔 interval 把数据库备份一次 (自上次备份以来有修改时),
+// 并按保留策略删除旧的备份文件 (详见 DB.Snapshot). 出错时只记录日志.
+func scheduleSnapshots(interval time.Duration) {
+	for range time.Tick(interval) {
+		snapshot()
+	}
+}
+
+func snapshot() {
+	db.Lock()
+	defer db.Unlock()
+	if db.IsNotInit() || db.IsExpired() {
+		return
+	}
+	name, pruned, err := db.Snapshot()
+	if name != "" {
+		log.Printf("定时备份: %s, 按保留策略删除了 %d 个旧的备份文件", name, len(pruned))
+	}
+	if err != nil {
+		log.Println("定时备份失败:", err)
+	}
+}
+
 func logout(w httpRW) {
 	db.Reset()
 	sessionManager.DeleteSID(w)
@@ -7,9 +7,10 @@ import (
 )
 
 func checkState(fn httpHF) httpHF {
-	db.Lock()
-	defer db.Unlock()
 	return func(w httpRW, r httpReq) {
+		// 每次请求都要加锁, 与定时备份 (snapshot) 等其他操作互斥.
+		db.Lock()
+		defer db.Unlock()
 		// 数据库不存在, 需要创建新账号.
 		if db.FileNotExist() {
 			checkErr(w, templates.ExecuteTemplate(w, "create-account", nil))
@@ -25,6 +26,9 @@ func checkState(fn httpHF) httpHF {
 			// 假设客户端 A 登入成功后, 客户端 B 尝试登陆, 会导致 logout (即 A 也被强行登出).
 			// 但如果 B 紧接着输入了正确密码成功登入, 则 A 也会自动再次变成已登入状态.
 			// 这可以说是一个 bug, 但恰好可以发现有人尝试登入, 所以也可以说这是一个 feature.
+			if db.IsExpired() {
+				compactFragments()
+			}
 			logout(w)
 			err := &Feedback{Err: errors.New("超时或session验证失败, 请重新登录")}
 			checkErr(w, templates.ExecuteTemplate(w, "login", err))
@@ -39,9 +43,9 @@ func checkState(fn httpHF) httpHF {
 // checkLogin 用于 Add 和 Edit 页面, 不检查超时.
 // 不检查超时, 但还是要顺便更新有效时长.
 func checkLogin(fn httpHF) httpHF {
-	db.Lock()
-	defer db.Unlock()
 	return func(w httpRW, r httpReq) {
+		db.Lock()
+		defer db.Unlock()
 		// 数据库不存在, 需要创建新账号.
 		if db.FileNotExist() {
 			checkErr(w, templates.ExecuteTemplate(w, "create-account", nil))
@@ -50,6 +54,7 @@ func checkLogin(fn httpHF) httpHF {
 		// 未登入(已登出)
 		if isLoggedOut(r) {
 			checkErr(w, templates.ExecuteTemplate(w, "login", nil))
+			return
 		}
 		// 已登入
 		db.StartedAt = time.Now()
@@ -69,11 +74,12 @@ func noCache(fn httpHF) httpHF {
 }
 
 func copyInBackground(fn func(*Mima)) httpHF {
-	db.Lock()
-	defer db.Unlock()
 	return func(w httpRW, r httpReq) {
+		db.Lock()
+		defer db.Unlock()
 		if !isLoggedOut(r) && db.IsExpired() {
 			// 已登入, 但超时.
+			compactFragments()
 			logout(w)
 			http.Error(w, "超时自动登出, 请重新登录", http.StatusNotAcceptable)
 			return
@@ -87,7 +93,7 @@ func copyInBackground(fn func(*Mima)) httpHF {
 			return
 		}
 		id := r.FormValue("id")
-		_, mima, err := db.GetByID(id)
+		mima, err := db.GetByID(id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	mimaDB "github.com/ahui2016/mima-go/db"
 	"testing"
-	"time"
 )
 
 // TestSortMima 用来测试 InsertByUpdatedAt 能否正确排序.
@@ -19,13 +18,10 @@ func TestMima_DeleteHistory(t *testing.T) {
 	checkTestErr(t, err)
 
 	titles := []string{"one", "two"}
-	for _, v := range titles {
-		// 确保两次生成历史记录之间超过 1 秒
-		time.Sleep(1100 * time.Millisecond)
-		t.Log("time.Sleep... (1.1 second)")
+	for i, v := range titles {
+		// 历史记录以序号区分, 即使在同一秒内修改两次也不会重复.
 		t.Run("Test update from form", func(*testing.T) { // 注意这里的 *testing.T 没有变量名, 因为希望出错时使用上级的 t.Fatal 使该测试函数整体失败.
-			needChangeIndex, needWriteFrag, err := mima.UpdateFromForm(&MimaForm{Title: v})
-			checkTestErr(t, err)
+			needChangeIndex, needWriteFrag := mima.UpdateFromForm(&MimaForm{Title: v}, uint64(i+1))
 			if !needChangeIndex || !needWriteFrag {
 				t.Fatal("want 'needChangeIndex' and 'needWriteFrag' both true")
 			}
@@ -40,13 +36,13 @@ func TestMima_DeleteHistory(t *testing.T) {
 	})
 	t.Run("Test not found", func(*testing.T) {
 		wrongDatetime := "abc"
-		if err := mima.DeleteHistory(wrongDatetime); err == nil {
+		if err := mima.DeleteHistory(1, wrongDatetime); err == nil {
 			t.Fatal("want: Error Not Found, got: no error")
 		}
 	})
 	for i := len(titles) - 1; i >= 0; i-- {
-		datetime := mima.History[i].DateTime
-		if err := mima.DeleteHistory(datetime); err != nil {
+		h := mima.History[i]
+		if err := mima.DeleteHistory(h.Seq, h.DateTime); err != nil {
 			t.Fatal(err)
 		}
 		name := fmt.Sprintf("Test deleting History[%d]", i)
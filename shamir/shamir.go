@@ -0,0 +1,139 @@
+// Package shamir 实现 Shamir 秘密分享 (Shamir's Secret Sharing), 运算在 GF(2^8) 上进行.
+// 把一个秘密拆分为 n 份, 其中任意 threshold 份即可还原秘密, 少于 threshold 份则得不到任何信息.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// 每一份 (share) 的格式: 与秘密等长的 y 值 + 1 字节的 x 坐标 (1 至 255).
+
+// Split 把 secret 拆分为 parts 份, 任意 threshold 份即可还原.
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("秘密不可为空")
+	}
+	if threshold < 2 || threshold > parts || parts > 255 {
+		return nil, fmt.Errorf("参数错误: 要求 2 <= threshold (%d) <= parts (%d) <= 255", threshold, parts)
+	}
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+	// 对秘密的每个字节分别生成一个随机多项式, 常数项就是该字节.
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			shares[i][j] = evaluate(coefficients, byte(i+1))
+		}
+	}
+	return shares, nil
+}
+
+// Combine 用至少 threshold 份还原秘密. 份数不足时会得到错误的结果 (无法察觉),
+// 因此调用者应另外验证结果.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("至少需要 2 份")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("格式错误: 长度太短")
+	}
+	xs := make([]byte, len(shares))
+	seen := make(map[byte]bool)
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, errors.New("各份的长度不一致")
+		}
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("x 坐标 (%d) 无效或重复", x)
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+	secret := make([]byte, size-1)
+	ys := make([]byte, len(shares))
+	for j := range secret {
+		for i, share := range shares {
+			ys[i] = share[j]
+		}
+		secret[j] = interpolateAtZero(xs, ys)
+	}
+	return secret, nil
+}
+
+// evaluate 用 Horner 法则计算多项式在 x 处的值.
+func evaluate(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = add(mul(result, x), coefficients[i])
+	}
+	return result
+}
+
+// interpolateAtZero 用拉格朗日插值法计算经过各点的多项式在 0 处的值 (即常数项).
+func interpolateAtZero(xs, ys []byte) byte {
+	var result byte
+	for i := range xs {
+		basis := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// basis *= (0 - xj) / (xi - xj), 在 GF(2^8) 中减法就是加法 (异或).
+			basis = mul(basis, div(xs[j], add(xs[i], xs[j])))
+		}
+		result = add(result, mul(ys[i], basis))
+	}
+	return result
+}
+
+// GF(2^8) 运算, 采用 AES 的不可约多项式 x^8 + x^4 + x^3 + x + 1 (0x11b), 生成元为 3.
+var expTable, logTable [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+		// x *= 3, 即 x ^ (x * 2)
+		x ^= xtime(x)
+	}
+	expTable[255] = expTable[0]
+}
+
+// xtime 计算 b * 2.
+func xtime(b byte) byte {
+	if b&0x80 != 0 {
+		return b<<1 ^ 0x1b
+	}
+	return b << 1
+}
+
+func add(a, b byte) byte {
+	return a ^ b
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+// div 计算 a / b, b 不可为 0.
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/ahui2016/mima-go/util"
 )
@@ -63,7 +64,7 @@ func addFileToTar(filePath string, tarWriter *tar.Writer) error {
 // Reader 用来帮助读取 tarball 内容.
 // 主要是为了更方便地关闭资源.
 type Reader struct {
-	file       *os.File
+	file       io.Closer
 	gzipReader *gzip.Reader
 	tarReader  *tar.Reader
 }
@@ -87,6 +88,19 @@ func NewReader(filePath string) (*Reader, error) {
 	return tr, nil
 }
 
+// NewReaderFrom 与 NewReader 相同, 但从 r 中读取 tarball (比如已读入内存的 tarball).
+func NewReaderFrom(r io.Reader) (*Reader, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		file:       ioutil.NopCloser(r),
+		gzipReader: gzipReader,
+		tarReader:  tar.NewReader(gzipReader),
+	}, nil
+}
+
 // Sha512 返回一个 tarball 里面全部文件的 SHA512 checksum.
 // 只适用于 tarball 里只有文件, 没有文件夹的情况.
 func (tr Reader) Sha512() (checksums [][]byte, err error) {
@@ -115,3 +129,60 @@ func (tr Reader) Sha512() (checksums [][]byte, err error) {
 func (tr Reader) Close() error {
 	return util.WrapErrors(tr.gzipReader.Close(), tr.file.Close())
 }
+
+// File 是 tarball 里的一个文件 (只有文件名和内容).
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Write 把 files 打包压缩后写入 w. 不关闭 w.
+func Write(w io.Writer, files []File) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	var allErrors []error
+	for _, file := range files {
+		header := &tar.Header{
+			Name:    file.Name,
+			Size:    int64(len(file.Data)),
+			Mode:    0644,
+			ModTime: time.Now(),
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			allErrors = append(allErrors, err)
+			break
+		}
+		if _, err := tarWriter.Write(file.Data); err != nil {
+			allErrors = append(allErrors, err)
+			break
+		}
+	}
+	allErrors = append(allErrors, tarWriter.Close(), gzipWriter.Close())
+	return util.WrapErrors(allErrors...)
+}
+
+// ReadFiles 读取 r 中的 tarball (gzip 压缩), 返回其中全部文件的文件名和内容.
+// 只适用于 tarball 里只有文件, 没有文件夹的情况.
+func ReadFiles(r io.Reader) (files []File, err error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, util.WrapErrors(gzipReader.Close(), err)
+		}
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return nil, util.WrapErrors(gzipReader.Close(), err)
+		}
+		files = append(files, File{Name: header.Name, Data: data})
+	}
+	return files, gzipReader.Close()
+}